@@ -0,0 +1,139 @@
+package clob
+
+import (
+	"sort"
+	"time"
+
+	"authex/model"
+
+	ob "github.com/i25959341/orderbook"
+	"github.com/labstack/gommon/log"
+	"github.com/shopspring/decimal"
+)
+
+// amend changes the price and/or the open size of a resting order or of a stop order
+// waiting to be triggered. A resting order whose size is reduced keeps its time priority,
+// otherwise it is removed from the book and processed again as a new order, that
+// may trade. The amendment is ignored if the order is no longer open.
+func (e *engine) amend(r *model.SignedRequest[model.Order]) {
+	id := r.Payload.Amends
+	if stop := e.trigger(id); stop != nil {
+		if r.Payload.Price != "" {
+			stop.Payload.Price = r.Payload.Price
+		}
+		if r.Payload.Size.IsPositive() {
+			stop.Payload.Size = r.Payload.Size
+		}
+		m := cancellation(&stop.Payload, stop.Payload.Size, model.StatusAmended)
+		m.ID = r.Payload.ID
+		log.Debugf("order %s %s AMENDED price %s, quantity %s", m.OrderID, m.Side, m.Price, m.Size)
+		e.matches <- m
+		return
+	}
+	order, rest := e.book.Order(id), e.resting[id]
+	if order == nil || rest == nil || rest.request == nil {
+		log.Debugf("order %s not found, amendment %s ignored", id, r.Payload.ID)
+		return
+	}
+	price := order.Price()
+	if r.Payload.Price != "" {
+		var err error
+		if price, err = decimal.NewFromString(r.Payload.Price); err != nil {
+			log.Error(err)
+			return
+		}
+	}
+	open := order.Quantity().Add(e.hidden(id))
+	size := open
+	if r.Payload.Size.IsPositive() {
+		size = r.Payload.Size
+	}
+	m := orderToMatch(r.Payload.ID, order, model.StatusAmended)
+	m.Price, m.Size, m.Time = price, size, time.Now().UTC()
+	log.Debugf("order %s %s AMENDED price %s, quantity %s", m.OrderID, m.Side, m.Price, m.Size)
+	e.matches <- m
+	if price.Equal(order.Price()) && size.LessThanOrEqual(open) {
+		e.reduce(order, open.Sub(size))
+		return
+	}
+	// the order loses its time priority
+	e.book.CancelOrder(id)
+	delete(e.expiries, id)
+	delete(e.icebergs, id)
+	delete(e.resting, id)
+	amended := *rest.request
+	amended.Payload.Price = price.String()
+	amended.Payload.Size = size
+	e.execute(&amended, r.Payload.ID)
+}
+
+// trigger returns a stop order that has not been triggered yet,
+// it returns nil if the order is not found
+func (e *engine) trigger(orderID string) *model.SignedRequest[model.Order] {
+	for _, r := range e.triggers {
+		if r.Payload.ID == orderID {
+			return r
+		}
+	}
+	return nil
+}
+
+// reduce decreases the open size of a resting order without changing its time
+// priority, the hidden quantity of iceberg orders is reduced first
+func (e *engine) reduce(order *ob.Order, quantity decimal.Decimal) {
+	if !quantity.IsPositive() {
+		return
+	}
+	if ice, ok := e.icebergs[order.ID()]; ok {
+		if ice.hidden.GreaterThan(quantity) {
+			ice.hidden = ice.hidden.Sub(quantity)
+			return
+		}
+		quantity = quantity.Sub(ice.hidden)
+		delete(e.icebergs, order.ID())
+		if quantity.IsZero() {
+			return
+		}
+	}
+	// the book does not change orders in place: the order and the ones
+	// behind it in the price level are placed again in the same sequence
+	behind := e.behind(order)
+	e.book.CancelOrder(order.ID())
+	for _, o := range behind {
+		e.book.CancelOrder(o.ID())
+	}
+	if _, _, _, err := e.book.ProcessLimitOrder(order.Side(), order.ID(), order.Quantity().Sub(quantity), order.Price()); err != nil {
+		log.Error(err)
+	}
+	for _, o := range behind {
+		if _, _, _, err := e.book.ProcessLimitOrder(o.Side(), o.ID(), o.Quantity(), o.Price()); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// behind returns the orders placed after an order at the same price level,
+// in time priority
+func (e *engine) behind(order *ob.Order) []*ob.Order {
+	r, ok := e.resting[order.ID()]
+	if !ok {
+		return nil
+	}
+	var (
+		orders    []*ob.Order
+		sequences = make(map[string]uint64)
+	)
+	for id, other := range e.resting {
+		if other.sequence <= r.sequence {
+			continue
+		}
+		if o := e.book.Order(id); o != nil && o.Side() == order.Side() && o.Price().Equal(order.Price()) {
+			orders = append(orders, o)
+			sequences[id] = other.sequence
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		return sequences[orders[i].ID()] < sequences[orders[j].ID()]
+	})
+	return orders
+}
@@ -0,0 +1,85 @@
+package clob_test
+
+import (
+	"authex/clob"
+	"authex/model"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+// BenchmarkPool_Markets measures the throughput of the pool when the
+// orders are spread over an increasing number of markets, each market
+// is fed by its own client
+func BenchmarkPool_Markets(b *testing.B) {
+	for _, markets := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("markets=%d", markets), func(b *testing.B) {
+			benchmarkMarkets(b, markets)
+		})
+	}
+}
+
+func benchmarkMarkets(b *testing.B, markets int) {
+	matches := make(chan *model.Match, 1024)
+	go func() {
+		for range matches {
+		}
+	}()
+	pool := clob.NewPool(matches)
+	addresses := make([]string, markets)
+	for i := range addresses {
+		addresses[i] = fmt.Sprintf("0x%040d", i)
+		pool.OpenMarket(addresses[i])
+	}
+	done := make(chan struct{})
+	go func() {
+		pool.Run()
+		close(done)
+	}()
+
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for m, market := range addresses {
+		// the orders are split evenly among the markets
+		orders := b.N / markets
+		if m < b.N%markets {
+			orders++
+		}
+		wg.Add(1)
+		go func(market string, orders int) {
+			defer wg.Done()
+			for i := 0; i < orders; i++ {
+				if err := pool.Submit(benchmarkOrder(market, i)); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(market, orders)
+	}
+	wg.Wait()
+	pool.Close()
+	<-done
+	b.StopTimer()
+	close(matches)
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "orders/s")
+}
+
+// benchmarkOrder returns the i-th order of a stream that alternates
+// resting asks and bids crossing them
+func benchmarkOrder(market string, i int) *model.SignedRequest[model.Order] {
+	side, price := model.SideAsk, 100+i%10
+	if i%2 == 1 {
+		side, price = model.SideBid, 110
+	}
+	return &model.SignedRequest[model.Order]{
+		Payload: model.Order{
+			ID:     fmt.Sprintf("%s-%d", market, i),
+			Market: market,
+			Side:   side,
+			Size:   decimal.NewFromInt(1),
+			Price:  fmt.Sprint(price),
+		},
+	}
+}
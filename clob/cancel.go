@@ -0,0 +1,100 @@
+package clob
+
+import (
+	"sort"
+	"time"
+
+	"authex/model"
+
+	ob "github.com/i25959341/orderbook"
+)
+
+// CancelAll cancels the open orders of an account, including the stop orders not triggered yet.
+// The orders of all the accounts are cancelled if the owner is empty, the orders of all
+// the markets if the market is empty and the orders of both sides if the side is empty.
+// The orders of a market are cancelled at once, after the requests already submitted,
+// and each cancellation is journaled. The reason, if any, is reported in the matches
+// of the cancelled orders. It returns the IDs of the cancelled orders.
+func (p *Pool) CancelAll(owner, market, side, reason string) ([]string, error) {
+	var engines []*engine
+	if market != "" {
+		e, ok := p.engine(market)
+		if !ok {
+			return nil, model.ErrMarketNotFound
+		}
+		engines = append(engines, e)
+	} else {
+		p.mu.RLock()
+		for _, e := range p.engines {
+			engines = append(engines, e)
+		}
+		p.mu.RUnlock()
+		sort.Slice(engines, func(i, j int) bool { return engines[i].market < engines[j].market })
+	}
+	cancelled := make([]string, 0)
+	for _, e := range engines {
+		select {
+		case <-p.quit:
+			return cancelled, ErrPoolClosed
+		default:
+		}
+		e.do(func() {
+			cancelled = append(cancelled, e.cancelAll(owner, side, reason)...)
+		})
+	}
+	return cancelled, nil
+}
+
+// cancelAll cancels the open orders of an owner on a side of the book, in time priority,
+// it returns the IDs of the cancelled orders
+func (e *engine) cancelAll(owner, side, reason string) []string {
+	// the requests submitted before are processed first
+	for len(e.inbox) > 0 {
+		e.accept(<-e.inbox)
+	}
+	now := time.Now().UTC()
+	e.expireOrders(now)
+	var (
+		ids       []string
+		sequences = make(map[string]uint64)
+	)
+	for id, r := range e.resting {
+		o := e.book.Order(id)
+		if o == nil || (owner != "" && r.owner != owner) || (side != "" && bookSide(side) != o.Side()) {
+			continue
+		}
+		ids = append(ids, id)
+		sequences[id] = r.sequence
+	}
+	sort.Slice(ids, func(i, j int) bool { return sequences[ids[i]] < sequences[ids[j]] })
+	for _, r := range e.triggers {
+		if (owner == "" || r.From == owner) && (side == "" || r.Payload.Side == side) {
+			ids = append(ids, r.Payload.ID)
+		}
+	}
+	cancelled := make([]string, 0, len(ids))
+	for _, id := range ids {
+		r := &model.SignedRequest[model.Order]{
+			From: owner,
+			Payload: model.Order{
+				ID:         id,
+				Market:     e.market,
+				Side:       model.CancelOrder,
+				RecordedAt: now,
+			},
+		}
+		if e.record(r) {
+			e.cancel(id, reason)
+			cancelled = append(cancelled, id)
+		}
+	}
+	return cancelled
+}
+
+// bookSide returns the side of the book of an order side
+func bookSide(side string) ob.Side {
+	if side == model.SideAsk {
+		return ob.Sell
+	}
+	return ob.Buy
+}
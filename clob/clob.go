@@ -1,6 +1,12 @@
 package clob
 
 import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
 	"authex/model"
 
 	ob "github.com/i25959341/orderbook"
@@ -8,103 +14,523 @@ import (
 	"github.com/shopspring/decimal"
 )
 
+// ErrPoolClosed is returned when a request is submitted to a closed pool
+var ErrPoolClosed = errors.New("pool closed")
+
+// Pool routes the requests to the matching engines of the markets,
+// each market is matched by its own goroutine
 type Pool struct {
-	// order books, indexed by symbol
-	markets map[string]*ob.OrderBook
-	// account balances, indexed by address and symbol
-	balances map[string]map[string]decimal.Decimal
-	// incoming orders
-	Inbound chan *model.SignedRequest[model.Order]
+	mu sync.RWMutex
+	// matching engines, indexed by symbol
+	engines map[string]*engine
 	// order matches
 	Matches chan *model.Match
+	// trades between the orders, optional
+	trades chan *model.Trade
+	// journal of the accepted requests, optional
+	journal *Journal
+	// quit is closed to stop the engines
+	quit      chan struct{}
+	closeOnce sync.Once
+	// running is set once Run has started the engines
+	running bool
+	wg      sync.WaitGroup
+	// dead man's switches of the accounts, indexed by owner
+	heartbeats   map[string]*heartbeat
+	heartbeatsMu sync.Mutex
 }
 
+// expirationInterval is how often the expired orders are removed from the books
+const expirationInterval = time.Second
+
+// defaultTickSize is the price increment used to reprice post only orders
+// in the markets that do not set a tick size
+var defaultTickSize = decimal.NewFromInt(1)
+
 func NewPool(matches chan *model.Match) *Pool {
 	return &Pool{
-		markets:  make(map[string]*ob.OrderBook),
-		balances: make(map[string]map[string]decimal.Decimal),
-		Inbound:  make(chan *model.SignedRequest[model.Order]),
-		Matches:  matches,
+		engines:    make(map[string]*engine),
+		Matches:    matches,
+		quit:       make(chan struct{}),
+		heartbeats: make(map[string]*heartbeat),
 	}
 }
 
+// WithJournal sets the journal where the accepted requests are
+// recorded before being processed
+func (p *Pool) WithJournal(j *Journal) *Pool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.journal = j
+	for _, e := range p.engines {
+		e.journal = j
+	}
+	return p
+}
+
+// WithTrades sets the channel where the trades are sent, the trades
+// are not reported if the channel is not set
+func (p *Pool) WithTrades(trades chan *model.Trade) *Pool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.trades = trades
+	for _, e := range p.engines {
+		e.trades = trades
+	}
+	return p
+}
+
+// Close stops the engines and disarms the dead man's switches,
+// the requests already submitted are processed
 func (p *Pool) Close() {
-	close(p.Inbound)
+	p.closeOnce.Do(func() {
+		close(p.quit)
+		p.disarmAll()
+	})
 }
 
+// Run starts the engines of the markets and blocks until the pool is closed
+// and the engines have processed the submitted requests. The engines of the
+// markets opened while running are started immediately.
 func (p *Pool) Run() {
-	for {
-		order, ok := <-p.Inbound
-		if !ok {
-			// channel is closed
-			return
+	p.mu.Lock()
+	p.running = true
+	for _, e := range p.engines {
+		p.start(e)
+	}
+	p.mu.Unlock()
+	<-p.quit
+	p.wg.Wait()
+}
+
+// start runs the goroutine of an engine, it must be called with the lock held.
+// An engine started after the pool is closed processes its inbox and returns.
+func (p *Pool) start(e *engine) {
+	e.running.Store(true)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		e.run(p.quit)
+	}()
+}
+
+// Submit sends a request to the engine of its market, it blocks
+// while the inbox of the market is full
+func (p *Pool) Submit(r *model.SignedRequest[model.Order]) error {
+	e, ok := p.engine(r.Payload.Market)
+	if !ok {
+		return model.ErrMarketNotFound
+	}
+	select {
+	case <-p.quit:
+		return ErrPoolClosed
+	default:
+	}
+	select {
+	case e.inbox <- r:
+		return nil
+	case <-p.quit:
+		return ErrPoolClosed
+	}
+}
+
+// engine returns the matching engine of a market
+func (p *Pool) engine(market string) (*engine, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	e, ok := p.engines[market]
+	return e, ok
+}
+
+// processingTime is the time used to expire the orders before processing
+// a request, the recorded time is used so that replays are deterministic
+func processingTime(r *model.SignedRequest[model.Order]) time.Time {
+	if r.Payload.RecordedAt.IsZero() {
+		return time.Now().UTC()
+	}
+	return r.Payload.RecordedAt
+}
+
+// Recover replays the journal entries to rebuild the order books, starting
+// from the snapshot of a compacted journal. The matches and the trades produced
+// are sent again, so the consumers must be able to handle duplicates.
+// It must be called before Run.
+func (p *Pool) Recover(entries []*JournalEntry) {
+	for _, e := range entries {
+		if e.Snapshot != nil {
+			p.applySnapshot(e.Snapshot)
+			continue
 		}
-		p.handleOrder(order)
+		p.Replay([]*model.SignedRequest[model.Order]{e.Request()})
 	}
 }
 
+// Replay processes the requests synchronously, in the given order,
+// without recording them in the journal.
+// It must not be called concurrently with Run.
+func (p *Pool) Replay(requests []*model.SignedRequest[model.Order]) {
+	for _, r := range requests {
+		p.OpenMarket(r.Payload.Market)
+		e, _ := p.engine(r.Payload.Market)
+		if !r.Payload.RecordedAt.IsZero() {
+			e.expireOrders(r.Payload.RecordedAt)
+		}
+		e.handleOrder(r)
+	}
+}
+
+// OpenMarket creates the engine of a market, the engine is started
+// if the pool is running
 func (p *Pool) OpenMarket(market string) {
-	if _, ok := p.markets[market]; !ok {
-		p.markets[market] = ob.NewOrderBook()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.engines[market]; ok {
+		return
+	}
+	e := newEngine(market, p.Matches, p.trades, p.journal)
+	p.engines[market] = e
+	if p.running {
+		p.start(e)
 	}
 }
 
-func (p *Pool) handleOrder(r *model.SignedRequest[model.Order]) {
-	// get the order book for the symbol
-	orderBook, ok := p.markets[r.Payload.Market]
-	if !ok {
-		orderBook = ob.NewOrderBook()
-		p.markets[r.Payload.Market] = orderBook
+// SetMarketRules sets the matching rules of a market
+func (p *Pool) SetMarketRules(market string, rules model.MarketRules) {
+	if e, ok := p.engine(market); ok {
+		e.do(func() { e.rules = rules })
 	}
-	// if it is a cancel order, cancel it
-	if r.Payload.Side == model.CancelOrder {
-		orderBook.CancelOrder(r.Payload.ID)
-		return
+}
+
+// SetTradeSequence sets the sequence number of the last trade of a market,
+// the next trade of the market is numbered from there
+func (p *Pool) SetTradeSequence(market string, sequence uint64) {
+	if e, ok := p.engine(market); ok {
+		e.do(func() { e.tradeSequence = sequence })
+	}
+}
+
+// TradeSequence returns the sequence number of the last trade of a market
+func (p *Pool) TradeSequence(market string) (sequence uint64) {
+	if e, ok := p.engine(market); ok {
+		e.do(func() { sequence = e.tradeSequence })
 	}
+	return
+}
+
+// processOrder matches an order against the book
+func (e *engine) processOrder(r *model.SignedRequest[model.Order]) {
+	e.execute(r, r.Payload.ID)
+}
+
+// execute matches an order against the book, the matches of the order and of
+// the makers it trades with are reported with the given ID
+func (e *engine) execute(r *model.SignedRequest[model.Order], matchID string) {
 	// check the side
 	side := ob.Buy
 	if r.Payload.Side == model.SideAsk {
 		side = ob.Sell
 	}
-	quantity := decimal.NewFromInt(int64(r.Payload.Size))
+	quantity := r.Payload.Size
+	timeInForce := r.Payload.GetTimeInForce()
 
 	var (
-		done            []*ob.Order
-		partial         *ob.Order
-		partialQuantity decimal.Decimal
-		err             error
+		price decimal.Decimal
+		err   error
 	)
-	if r.Payload.Price == "" {
-		log.Debugf("handling market %s order %s", r.Payload.Side, r.Payload.ID)
-		// limit order
-		if done, partial, partialQuantity, _, err = orderBook.ProcessMarketOrder(side, quantity); err != nil {
+	if !r.Payload.IsMarket() {
+		if price, err = decimal.NewFromString(r.Payload.Price); err != nil {
 			log.Error(err)
 			return
 		}
+	} else if r.Payload.ProtectionPrice != "" {
+		// market orders do not trade beyond their protection price
+		if price, err = decimal.NewFromString(r.Payload.ProtectionPrice); err != nil {
+			log.Error(err)
+			return
+		}
+	}
+	// market orders without a protection price can walk the whole book
+	unbounded := r.Payload.IsMarket() && !price.IsPositive()
+	// fill or kill orders are cancelled if they cannot be filled entirely
+	if timeInForce == model.TimeInForceFOK && e.fillable(side, price, unbounded).LessThan(quantity) {
+		log.Debugf("order %s %s KILLED quantity %s", r.Payload.ID, r.Payload.Side, quantity)
+		m := cancellation(&r.Payload, quantity, model.StatusCancelled)
+		m.ID = matchID
+		e.matches <- m
+		return
+	}
+	// post only orders must not take liquidity
+	if r.Payload.PostOnly {
+		if best, ok := bestOpposite(e.book, side); ok && crosses(side, price, best) {
+			if price = repricePostOnly(side, best, e.tickSize()); !r.Payload.Reprice || !price.IsPositive() {
+				log.Debugf("order %s %s REJECTED would take liquidity at %s", r.Payload.ID, r.Payload.Side, best)
+				m := cancellation(&r.Payload, quantity, model.StatusRejected)
+				m.ID = matchID
+				e.matches <- m
+				return
+			}
+			log.Debugf("order %s %s REPRICED price %s", r.Payload.ID, r.Payload.Side, price)
+			m := cancellation(&r.Payload, quantity, model.StatusRepriced)
+			m.ID, m.Price = matchID, price
+			e.matches <- m
+		}
+	}
+	if r.Payload.IsMarket() {
+		log.Debugf("handling market %s order %s", r.Payload.Side, r.Payload.ID)
 	} else {
 		log.Debugf("handling limit %s order %s", r.Payload.Side, r.Payload.ID)
-		price, pErr := decimal.NewFromString(r.Payload.Price)
-		if pErr != nil {
-			log.Error(pErr)
-			return
+	}
+	var (
+		// matches of the makers, one for each maker order
+		trades  []*model.Match
+		byMaker = make(map[string]*model.Match)
+		// quantity and value traded by the taker
+		filled   = decimal.Zero
+		notional = decimal.Zero
+		left     = quantity
+	)
+	trade := func(order *ob.Order, size decimal.Decimal, status string) {
+		// iceberg orders are filled when the hidden quantity is exhausted
+		if e.hidden(order.ID()).IsPositive() {
+			status = model.StatusPartial
+		}
+		if m, ok := byMaker[order.ID()]; ok {
+			m.Size, m.Status = m.Size.Add(size), status
+		} else {
+			m = orderToMatch(matchID, order, status)
+			m.Size = size
+			byMaker[order.ID()] = m
+			trades = append(trades, m)
+		}
+		filled = filled.Add(size)
+		notional = notional.Add(order.Price().Mul(size))
+		e.lastPrice = decimal.NewNullDecimal(order.Price())
+	}
+	// the iceberg orders consumed by the taker are replenished and
+	// matched again until the taker is filled or no longer crosses the book,
+	// the taker stops at the orders of the same account
+	prevented := false
+	for left.IsPositive() {
+		self, ahead := e.selfTrade(r.From, side, price, unbounded)
+		if self != nil && ahead.IsZero() {
+			if left = e.preventSelfTrade(r, self, left); left.IsZero() {
+				prevented = true
+			}
+			continue
+		}
+		chunk := left
+		if self != nil && ahead.LessThan(left) {
+			chunk = ahead
+		}
+		if r.Payload.IsMarket() && !unbounded {
+			if chunk = decimal.Min(chunk, e.visible(side, price, false)); chunk.IsZero() {
+				break
+			}
+		}
+		var (
+			done            []*ob.Order
+			partial         *ob.Order
+			partialQuantity decimal.Decimal
+			chunkLeft       decimal.Decimal
+		)
+		if r.Payload.IsMarket() {
+			// market order
+			done, partial, partialQuantity, chunkLeft, err = e.book.ProcessMarketOrder(side, chunk)
+		} else {
+			// limit order
+			done, partial, partialQuantity, err = e.book.ProcessLimitOrder(side, r.Payload.ID, chunk, price)
 		}
-		// market order
-		if done, partial, partialQuantity, err = orderBook.ProcessLimitOrder(side, r.Payload.ID, quantity, price); err != nil {
+		if err != nil {
 			log.Error(err)
 			return
 		}
+		var consumed []string
+		for _, order := range done {
+			// the taker is reported below with its average price
+			if order.ID() == r.Payload.ID {
+				continue
+			}
+			trade(order, order.Quantity(), model.StatusFilled)
+			if e.hidden(order.ID()).IsPositive() {
+				consumed = append(consumed, order.ID())
+			}
+		}
+		if partial != nil && partial.ID() != r.Payload.ID {
+			trade(partial, partialQuantity, model.StatusPartial)
+		}
+		rest := e.book.Order(r.Payload.ID)
+		if rest != nil {
+			chunkLeft = rest.Quantity()
+		}
+		left = left.Sub(chunk).Add(chunkLeft)
+		if len(consumed) == 0 && self == nil {
+			break
+		}
+		// the taker must not rest against the replenished slices
+		if rest != nil {
+			e.book.CancelOrder(r.Payload.ID)
+		}
+		for _, id := range consumed {
+			e.replenish(id)
+		}
 	}
-	for _, order := range done {
-		m := orderToMatch(r.Payload.ID, order, model.StatusFilled)
-		log.Debugf("order %s %s FILLED price %s, quantity %s", m.OrderID, m.Side, m.Price, m.Size)
-		p.Matches <- m
+	// the trade is reported before the match that may close the maker order
+	for _, m := range trades {
+		e.trade(r, m)
+		log.Debugf("order %s %s %s price %s, quantity %s", m.OrderID, m.Side, strings.ToUpper(m.Status), m.Price, m.Size)
+		e.matches <- m
+		if m.Status == model.StatusFilled {
+			delete(e.resting, m.OrderID)
+		}
+	}
+	if filled.IsPositive() && !r.Payload.IsMarket() {
+		m := &model.Match{
+			ID:      matchID,
+			OrderID: r.Payload.ID,
+			Price:   notional.Div(filled),
+			Size:    filled,
+			Time:    time.Now().UTC(),
+			Side:    r.Payload.Side,
+			Status:  model.StatusFilled,
+		}
+		// the remainder of the order rests in the book or has been prevented
+		if left.IsPositive() || prevented {
+			m.Status = model.StatusPartial
+		}
+		log.Debugf("order %s %s %s price %s, quantity %s", m.OrderID, m.Side, strings.ToUpper(m.Status), m.Price, m.Size)
+		e.matches <- m
+	}
+	// market orders never rest in the book
+	if r.Payload.IsMarket() && left.IsPositive() {
+		log.Debugf("order %s %s CANCELLED quantity %s", r.Payload.ID, r.Payload.Side, left)
+		e.matches <- cancellation(&r.Payload, left, model.StatusCancelled)
+	}
+	// handle the remainder of a limit order
+	if rest := e.book.Order(r.Payload.ID); rest != nil {
+		switch timeInForce {
+		case model.TimeInForceIOC, model.TimeInForceFOK:
+			e.book.CancelOrder(r.Payload.ID)
+			m := orderToMatch(matchID, rest, model.StatusCancelled)
+			log.Debugf("order %s %s CANCELLED quantity %s", m.OrderID, m.Side, m.Size)
+			e.matches <- m
+			return
+		case model.TimeInForceGTD:
+			e.expiries[r.Payload.ID] = r.Payload.ExpiresAt
+		}
+		e.rest(r.Payload.ID, r.From)
+		e.resting[r.Payload.ID].request = r
+		e.hide(&r.Payload)
+	}
+}
 
+// trade reports the trade of a taker order against the maker of a match
+func (e *engine) trade(r *model.SignedRequest[model.Order], maker *model.Match) {
+	if e.trades == nil {
+		return
 	}
-	if partial != nil {
-		m := orderToMatch(r.Payload.ID, partial, model.StatusPartial)
-		m.Size = partialQuantity
-		log.Debugf("order %s %s PARTIAL price %s, quantity %s", m.OrderID, m.Side, m.Price, m.Size)
-		p.Matches <- m
+	e.tradeSequence++
+	t := &model.Trade{
+		Market:        e.market,
+		Sequence:      e.tradeSequence,
+		MakerOrderID:  maker.OrderID,
+		TakerOrderID:  r.Payload.ID,
+		Price:         maker.Price,
+		Size:          maker.Size,
+		AggressorSide: r.Payload.Side,
+		Time:          time.Now().UTC(),
+	}
+	log.Debugf("trade %d: maker %s taker %s %s price %s, quantity %s", t.Sequence, t.MakerOrderID, t.TakerOrderID, t.AggressorSide, t.Price, t.Size)
+	e.trades <- t
+}
+
+// expireOrders removes from the book (and the trigger book) the GTD orders
+// expired at the given time
+func (e *engine) expireOrders(now time.Time) {
+	var expired []string
+	for id, expiresAt := range e.expiries {
+		if !expiresAt.After(now) {
+			expired = append(expired, id)
+		}
+	}
+	// process the orders in a deterministic order
+	sort.Strings(expired)
+	for _, id := range expired {
+		delete(e.expiries, id)
+		if order := e.book.CancelOrder(id); order != nil {
+			m := orderToMatch(id, order, model.StatusExpired)
+			m.Size = m.Size.Add(e.hidden(id))
+			delete(e.icebergs, id)
+			delete(e.resting, id)
+			log.Debugf("order %s %s EXPIRED quantity %s", m.OrderID, m.Side, m.Size)
+			e.matches <- m
+		} else if stop := e.removeTrigger(id); stop != nil {
+			// the stop order has not been triggered yet
+			m := cancellation(&stop.Payload, stop.Payload.Size, model.StatusExpired)
+			log.Debugf("order %s %s EXPIRED quantity %s", m.OrderID, m.Side, m.Size)
+			e.matches <- m
+		}
+	}
+}
+
+// visible returns the quantity visible in the book for an order on
+// the given side, up to the limit price (if it's not a market order)
+func (e *engine) visible(side ob.Side, price decimal.Decimal, isMarket bool) decimal.Decimal {
+	asks, bids := e.book.Depth()
+	levels := bids
+	if side == ob.Buy {
+		levels = asks
+	}
+	total := decimal.Zero
+	for _, l := range levels {
+		if isMarket || crosses(side, price, l.Price) {
+			total = total.Add(l.Quantity)
+		}
+	}
+	return total
+}
+
+// fillable returns the quantity available in the book for an order on
+// the given side, up to the limit price (if it's not a market order),
+// including the hidden quantity of the iceberg orders
+func (e *engine) fillable(side ob.Side, price decimal.Decimal, isMarket bool) decimal.Decimal {
+	total := e.visible(side, price, isMarket)
+	for _, ice := range e.icebergs {
+		if ice.side != side && (isMarket || crosses(side, price, ice.price)) {
+			total = total.Add(ice.hidden)
+		}
+	}
+	return total
+}
+
+// tickSize returns the minimum price increment of the market
+func (e *engine) tickSize() decimal.Decimal {
+	if tick := e.rules.TickSize; tick.IsPositive() {
+		return tick
+	}
+	return defaultTickSize
+}
+
+// repricePostOnly returns the price one tick away from the best opposite price
+func repricePostOnly(side ob.Side, best, tickSize decimal.Decimal) decimal.Decimal {
+	if side == ob.Buy {
+		return best.Sub(tickSize)
+	}
+	return best.Add(tickSize)
+}
+
+// cancellation is the match that reports the quantity of an order that is
+// removed from the book without trading (or, if repriced, the new order price)
+func cancellation(o *model.Order, quantity decimal.Decimal, status string) *model.Match {
+	// the price of market orders is zero
+	price, _ := decimal.NewFromString(o.Price)
+	return &model.Match{
+		ID:      o.ID,
+		OrderID: o.ID,
+		Price:   price,
+		Size:    quantity,
+		Time:    time.Now().UTC(),
+		Side:    o.Side,
+		Status:  status,
 	}
 }
 
@@ -125,21 +551,39 @@ func orderToMatch(topID string, order *ob.Order, status string) *model.Match {
 	return m
 }
 
-func (p *Pool) GetOrderBook(market string) string {
-	x := p.markets[market]
-	a, b := x.Depth()
-	for _, o := range a {
-		log.Infof("ASK %s %s", o.Price, o.Quantity)
-	}
-	for _, o := range b {
-		log.Infof("BID %s %s", o.Price, o.Quantity)
+// GetWorstPrice returns the price of the last level of the book that a market order
+// of the given size would reach, it returns orderbook.ErrInsufficientQuantity
+// if the book cannot fill the order
+func (p *Pool) GetWorstPrice(market, side string, size decimal.Decimal) (price decimal.Decimal, err error) {
+	e, ok := p.engine(market)
+	if !ok {
+		err = model.ErrMarketNotFound
+		return
 	}
-	return p.markets[market].String()
+	e.do(func() {
+		asks, bids := e.book.Depth()
+		// walk the opposite side from the best price
+		levels := bids
+		if side != model.SideAsk {
+			levels = make([]*ob.PriceLevel, len(asks))
+			for i, l := range asks {
+				levels[len(asks)-1-i] = l
+			}
+		}
+		left := size
+		for _, l := range levels {
+			if price, left = l.Price, left.Sub(l.Quantity); !left.IsPositive() {
+				return
+			}
+		}
+		price, err = decimal.Zero, ob.ErrInsufficientQuantity
+	})
+	return
 }
 
 // GetQuote returns the best bid and ask prices for a given market
 func (p *Pool) GetQuote(market, side string, size decimal.Decimal) (price decimal.Decimal, err error) {
-	orderBook, ok := p.markets[market]
+	e, ok := p.engine(market)
 	if !ok {
 		err = model.ErrMarketNotFound
 		return
@@ -148,6 +592,8 @@ func (p *Pool) GetQuote(market, side string, size decimal.Decimal) (price decima
 	if side == model.SideAsk {
 		obSide = ob.Sell
 	}
-	price, err = orderBook.CalculateMarketPrice(obSide, size)
+	e.do(func() {
+		price, err = e.book.CalculateMarketPrice(obSide, size)
+	})
 	return
 }
@@ -0,0 +1,953 @@
+package clob_test
+
+import (
+	"authex/clob"
+	"authex/model"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+const _market = "0xd36cfda1a6607e8b79d0c9ea784346a6e21fad86"
+
+func limitOrder(id, side string, size int64, price string) *model.SignedRequest[model.Order] {
+	return &model.SignedRequest[model.Order]{
+		Payload: model.Order{
+			ID:     id,
+			Market: _market,
+			Side:   side,
+			Size:   decimal.NewFromInt(size),
+			Price:  price,
+		},
+	}
+}
+
+func TestPool_Restore(t *testing.T) {
+	tests := []struct {
+		name         string
+		orders       []*model.SignedRequest[model.Order]
+		wantRestored int
+		wantIssues   []string
+		// quote for a bid of size 1
+		wantQuote decimal.Decimal
+	}{
+		{
+			name: "ok",
+			orders: []*model.SignedRequest[model.Order]{
+				limitOrder("a1", model.SideAsk, 1, "101"),
+				limitOrder("a2", model.SideAsk, 1, "100"),
+				limitOrder("b1", model.SideBid, 1, "99"),
+			},
+			wantRestored: 3,
+			wantQuote:    decimal.NewFromInt(100),
+		},
+		{
+			name: "skip inconsistent orders",
+			orders: []*model.SignedRequest[model.Order]{
+				limitOrder("a1", model.SideAsk, 1, "100"),
+				limitOrder("a1", model.SideAsk, 1, "100"),
+				limitOrder("b1", model.SideBid, 1, "100"),
+				limitOrder("b2", model.SideBid, 0, "90"),
+				limitOrder("b3", model.SideBid, 1, ""),
+				{Payload: model.Order{ID: "x1", Market: "0x0", Side: model.SideBid, Size: decimal.NewFromInt(1), Price: "1"}},
+			},
+			wantRestored: 1,
+			wantIssues:   []string{"a1", "b1", "b2", "b3", "x1"},
+			wantQuote:    decimal.NewFromInt(100),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := clob.NewPool(make(chan *model.Match))
+			pool.OpenMarket(_market)
+			report := pool.Restore(tt.orders)
+			assert.Equal(t, tt.wantRestored, report.Restored)
+			assert.Equal(t, len(tt.wantIssues) == 0, report.IsConsistent())
+			var issues []string
+			for _, issue := range report.Issues {
+				issues = append(issues, issue.OrderID)
+			}
+			assert.Equal(t, tt.wantIssues, issues)
+			quote, err := pool.GetQuote(_market, model.SideBid, decimal.NewFromInt(1))
+			assert.NoError(t, err)
+			assert.True(t, tt.wantQuote.Equal(quote), "quote mismatch, got %s", quote)
+		})
+	}
+}
+
+func TestPool_TimeInForce(t *testing.T) {
+	now := time.Now().UTC()
+	withTIF := func(r *model.SignedRequest[model.Order], tif string) *model.SignedRequest[model.Order] {
+		r.Payload.TimeInForce = tif
+		r.Payload.RecordedAt = now
+		return r
+	}
+	gtd := withTIF(limitOrder("a1", model.SideAsk, 1, "100"), model.TimeInForceGTD)
+	gtd.Payload.ExpiresAt = now.Add(time.Minute)
+	late := limitOrder("b9", model.SideBid, 1, "100")
+	late.Payload.RecordedAt = now.Add(time.Hour)
+	protected := limitOrder("b1", model.SideBid, 2, "")
+	protected.Payload.ProtectionPrice = "105"
+
+	type status struct {
+		orderID string
+		status  string
+		size    int64
+	}
+	tests := []struct {
+		name   string
+		orders []*model.SignedRequest[model.Order]
+		want   []status
+	}{
+		{
+			name: "IOC remainder is cancelled",
+			orders: []*model.SignedRequest[model.Order]{
+				limitOrder("a1", model.SideAsk, 1, "100"),
+				withTIF(limitOrder("b1", model.SideBid, 3, "100"), model.TimeInForceIOC),
+			},
+			want: []status{
+				{"a1", model.StatusFilled, 1},
+				{"b1", model.StatusPartial, 1},
+				{"b1", model.StatusCancelled, 2},
+			},
+		},
+		{
+			name: "FOK is killed",
+			orders: []*model.SignedRequest[model.Order]{
+				limitOrder("a1", model.SideAsk, 1, "100"),
+				limitOrder("a2", model.SideAsk, 1, "101"),
+				withTIF(limitOrder("b1", model.SideBid, 2, "100"), model.TimeInForceFOK),
+			},
+			want: []status{
+				{"b1", model.StatusCancelled, 2},
+			},
+		},
+		{
+			name: "FOK is filled",
+			orders: []*model.SignedRequest[model.Order]{
+				limitOrder("a1", model.SideAsk, 1, "100"),
+				limitOrder("a2", model.SideAsk, 1, "101"),
+				withTIF(limitOrder("b1", model.SideBid, 2, "101"), model.TimeInForceFOK),
+			},
+			want: []status{
+				{"a1", model.StatusFilled, 1},
+				{"a2", model.StatusFilled, 1},
+				{"b1", model.StatusFilled, 2},
+			},
+		},
+		{
+			name: "market remainder is cancelled",
+			orders: []*model.SignedRequest[model.Order]{
+				limitOrder("a1", model.SideAsk, 1, "100"),
+				limitOrder("b1", model.SideBid, 2, ""),
+			},
+			want: []status{
+				{"a1", model.StatusFilled, 1},
+				{"b1", model.StatusCancelled, 1},
+			},
+		},
+		{
+			name: "market stops at the protection price",
+			orders: []*model.SignedRequest[model.Order]{
+				limitOrder("a1", model.SideAsk, 1, "100"),
+				limitOrder("a2", model.SideAsk, 1, "110"),
+				protected,
+			},
+			want: []status{
+				{"a1", model.StatusFilled, 1},
+				{"b1", model.StatusCancelled, 1},
+			},
+		},
+		{
+			name: "GTD expires",
+			orders: []*model.SignedRequest[model.Order]{
+				gtd,
+				late,
+			},
+			want: []status{
+				{"a1", model.StatusExpired, 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []status
+			for _, m := range replay(tt.orders) {
+				got = append(got, status{m.OrderID, m.Status, m.Size.IntPart()})
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPool_GetWorstPrice(t *testing.T) {
+	pool := clob.NewPool(make(chan *model.Match))
+	pool.OpenMarket(_market)
+	report := pool.Restore([]*model.SignedRequest[model.Order]{
+		limitOrder("a1", model.SideAsk, 1, "100"),
+		limitOrder("a2", model.SideAsk, 2, "110"),
+		limitOrder("b1", model.SideBid, 1, "90"),
+		limitOrder("b2", model.SideBid, 2, "80"),
+	})
+	assert.True(t, report.IsConsistent())
+	tests := []struct {
+		name    string
+		side    string
+		size    int64
+		want    string
+		wantErr bool
+	}{
+		{"bid within the best level", model.SideBid, 1, "100", false},
+		{"bid walks the asks", model.SideBid, 2, "110", false},
+		{"ask walks the bids", model.SideAsk, 3, "80", false},
+		{"book too thin", model.SideAsk, 4, "0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pool.GetWorstPrice(_market, tt.side, decimal.NewFromInt(tt.size))
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, got.String())
+		})
+	}
+}
+
+func TestPool_PostOnly(t *testing.T) {
+	postOnly := func(r *model.SignedRequest[model.Order], reprice bool) *model.SignedRequest[model.Order] {
+		r.Payload.PostOnly = true
+		r.Payload.Reprice = reprice
+		return r
+	}
+	type status struct {
+		orderID string
+		status  string
+		price   int64
+	}
+	tests := []struct {
+		name   string
+		orders []*model.SignedRequest[model.Order]
+		want   []status
+	}{
+		{
+			name: "rests when not crossing",
+			orders: []*model.SignedRequest[model.Order]{
+				limitOrder("a1", model.SideAsk, 1, "100"),
+				postOnly(limitOrder("b1", model.SideBid, 1, "99"), false),
+			},
+		},
+		{
+			name: "rejected when crossing",
+			orders: []*model.SignedRequest[model.Order]{
+				limitOrder("a1", model.SideAsk, 1, "100"),
+				postOnly(limitOrder("b1", model.SideBid, 1, "100"), false),
+			},
+			want: []status{
+				{"b1", model.StatusRejected, 100},
+			},
+		},
+		{
+			name: "repriced when crossing",
+			orders: []*model.SignedRequest[model.Order]{
+				limitOrder("b1", model.SideBid, 1, "100"),
+				postOnly(limitOrder("a1", model.SideAsk, 1, "90"), true),
+				// the repriced order rests at 101
+				limitOrder("b2", model.SideBid, 1, "101"),
+			},
+			want: []status{
+				{"a1", model.StatusRepriced, 101},
+				{"a1", model.StatusFilled, 101},
+				{"b2", model.StatusFilled, 101},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []status
+			for _, m := range replay(tt.orders) {
+				got = append(got, status{m.OrderID, m.Status, m.Price.IntPart()})
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPool_Stop(t *testing.T) {
+	now := time.Now().UTC()
+	stop := func(r *model.SignedRequest[model.Order], stopPrice string) *model.SignedRequest[model.Order] {
+		r.Payload.StopPrice = stopPrice
+		r.Payload.RecordedAt = now
+		return r
+	}
+	gtd := stop(limitOrder("s1", model.SideBid, 1, "100"), "100")
+	gtd.Payload.TimeInForce, gtd.Payload.ExpiresAt = model.TimeInForceGTD, now.Add(time.Minute)
+	late := limitOrder("b9", model.SideBid, 1, "90")
+	late.Payload.RecordedAt = now.Add(time.Hour)
+	cancel := &model.SignedRequest[model.Order]{Payload: model.Order{ID: "s1", Market: _market, Side: model.CancelOrder}}
+
+	type status struct {
+		orderID string
+		status  string
+	}
+	tests := []struct {
+		name   string
+		orders []*model.SignedRequest[model.Order]
+		want   []status
+	}{
+		{
+			name: "bid stop market is triggered",
+			orders: []*model.SignedRequest[model.Order]{
+				limitOrder("a1", model.SideAsk, 1, "100"),
+				limitOrder("a2", model.SideAsk, 1, "101"),
+				stop(limitOrder("s1", model.SideBid, 1, ""), "100"),
+				limitOrder("b1", model.SideBid, 1, "100"),
+			},
+			want: []status{
+				{"a1", model.StatusFilled},
+				{"b1", model.StatusFilled},
+				{"s1", model.StatusTriggered},
+				{"a2", model.StatusFilled},
+			},
+		},
+		{
+			name: "ask stop limit is not triggered above the stop price",
+			orders: []*model.SignedRequest[model.Order]{
+				limitOrder("a1", model.SideAsk, 1, "100"),
+				stop(limitOrder("s1", model.SideAsk, 1, "90"), "95"),
+				limitOrder("b1", model.SideBid, 1, "100"),
+			},
+			want: []status{
+				{"a1", model.StatusFilled},
+				{"b1", model.StatusFilled},
+			},
+		},
+		{
+			name: "ask stop limit is triggered and rests",
+			orders: []*model.SignedRequest[model.Order]{
+				limitOrder("b1", model.SideBid, 1, "95"),
+				stop(limitOrder("s1", model.SideAsk, 1, "96"), "95"),
+				limitOrder("a1", model.SideAsk, 1, "95"),
+				limitOrder("b2", model.SideBid, 1, "96"),
+			},
+			want: []status{
+				{"b1", model.StatusFilled},
+				{"a1", model.StatusFilled},
+				{"s1", model.StatusTriggered},
+				{"s1", model.StatusFilled},
+				{"b2", model.StatusFilled},
+			},
+		},
+		{
+			name: "cancelled stop is not triggered",
+			orders: []*model.SignedRequest[model.Order]{
+				stop(limitOrder("s1", model.SideAsk, 1, "99"), "100"),
+				cancel,
+				limitOrder("b1", model.SideBid, 1, "100"),
+				limitOrder("a1", model.SideAsk, 1, "100"),
+			},
+			want: []status{
+				{"s1", model.StatusCancelled},
+				{"b1", model.StatusFilled},
+				{"a1", model.StatusFilled},
+			},
+		},
+		{
+			name:   "GTD stop expires",
+			orders: []*model.SignedRequest[model.Order]{gtd, late},
+			want: []status{
+				{"s1", model.StatusExpired},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []status
+			for _, m := range replay(tt.orders) {
+				got = append(got, status{m.OrderID, m.Status})
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPool_Iceberg(t *testing.T) {
+	iceberg := func(id, side string, size, display int64, price string) *model.SignedRequest[model.Order] {
+		r := limitOrder(id, side, size, price)
+		r.Payload.DisplaySize = decimal.NewFromInt(display)
+		return r
+	}
+
+	t.Run("only the display size is visible", func(t *testing.T) {
+		pool := clob.NewPool(make(chan *model.Match))
+		pool.OpenMarket(_market)
+		report := pool.Restore([]*model.SignedRequest[model.Order]{iceberg("i1", model.SideAsk, 5, 2, "100")})
+		assert.True(t, report.IsConsistent())
+		_, err := pool.GetQuote(_market, model.SideBid, decimal.NewFromInt(2))
+		assert.NoError(t, err)
+		_, err = pool.GetQuote(_market, model.SideBid, decimal.NewFromInt(3))
+		assert.Error(t, err)
+	})
+
+	type status struct {
+		orderID string
+		status  string
+		size    int64
+	}
+	tests := []struct {
+		name   string
+		orders []*model.SignedRequest[model.Order]
+		want   []status
+	}{
+		{
+			name: "replenished slices lose time priority",
+			orders: []*model.SignedRequest[model.Order]{
+				iceberg("i1", model.SideAsk, 5, 2, "100"),
+				limitOrder("a1", model.SideAsk, 1, "100"),
+				limitOrder("b1", model.SideBid, 3, "100"),
+			},
+			want: []status{
+				{"i1", model.StatusPartial, 2},
+				{"a1", model.StatusFilled, 1},
+				{"b1", model.StatusFilled, 3},
+			},
+		},
+		{
+			name: "taker consumes the hidden quantity",
+			orders: []*model.SignedRequest[model.Order]{
+				iceberg("i1", model.SideAsk, 5, 2, "100"),
+				limitOrder("b1", model.SideBid, 6, "100"),
+			},
+			want: []status{
+				{"i1", model.StatusFilled, 5},
+				{"b1", model.StatusPartial, 5},
+			},
+		},
+		{
+			name: "fill or kill includes the hidden quantity",
+			orders: []*model.SignedRequest[model.Order]{
+				iceberg("i1", model.SideAsk, 5, 2, "100"),
+				{Payload: model.Order{ID: "b1", Market: _market, Side: model.SideBid, Size: decimal.NewFromInt(4), Price: "100", TimeInForce: model.TimeInForceFOK}},
+			},
+			want: []status{
+				{"i1", model.StatusPartial, 4},
+				{"b1", model.StatusFilled, 4},
+			},
+		},
+		{
+			name: "iceberg taker rests with the display size",
+			orders: []*model.SignedRequest[model.Order]{
+				limitOrder("a1", model.SideAsk, 1, "100"),
+				iceberg("i1", model.SideBid, 5, 2, "100"),
+				limitOrder("a2", model.SideAsk, 3, "100"),
+			},
+			want: []status{
+				{"a1", model.StatusFilled, 1},
+				{"i1", model.StatusPartial, 1},
+				{"i1", model.StatusPartial, 3},
+				{"a2", model.StatusFilled, 3},
+			},
+		},
+		{
+			name: "cancel releases the hidden quantity",
+			orders: []*model.SignedRequest[model.Order]{
+				iceberg("i1", model.SideAsk, 5, 2, "100"),
+				limitOrder("b1", model.SideBid, 1, "100"),
+				{Payload: model.Order{ID: "i1", Market: _market, Side: model.CancelOrder}},
+			},
+			want: []status{
+				{"i1", model.StatusPartial, 1},
+				{"b1", model.StatusFilled, 1},
+				{"i1", model.StatusCancelled, 4},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []status
+			for _, m := range replay(tt.orders) {
+				got = append(got, status{m.OrderID, m.Status, m.Size.IntPart()})
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPool_SelfTradePrevention(t *testing.T) {
+	owned := func(r *model.SignedRequest[model.Order], from, mode string) *model.SignedRequest[model.Order] {
+		r.From = from
+		r.Payload.SelfTradePrevention = mode
+		return r
+	}
+	// orders of another account ahead of the resting order of the taker account
+	book := func(size int64) []*model.SignedRequest[model.Order] {
+		return []*model.SignedRequest[model.Order]{
+			owned(limitOrder("a0", model.SideAsk, 1, "99"), "0xB", ""),
+			owned(limitOrder("a1", model.SideAsk, size, "100"), "0xA", ""),
+		}
+	}
+	type status struct {
+		orderID string
+		status  string
+		size    int64
+	}
+	tests := []struct {
+		name   string
+		orders []*model.SignedRequest[model.Order]
+		want   []status
+	}{
+		{
+			name:   "cancel newest by default",
+			orders: append(book(1), owned(limitOrder("b1", model.SideBid, 3, "100"), "0xA", "")),
+			want: []status{
+				{"b1", model.StatusPrevented, 2},
+				{"a0", model.StatusFilled, 1},
+				{"b1", model.StatusPartial, 1},
+			},
+		},
+		{
+			name:   "cancel oldest",
+			orders: append(book(1), owned(limitOrder("b1", model.SideBid, 3, "100"), "0xA", model.SelfTradeCancelOldest)),
+			want: []status{
+				{"a1", model.StatusPrevented, 1},
+				{"a0", model.StatusFilled, 1},
+				{"b1", model.StatusPartial, 1},
+			},
+		},
+		{
+			name:   "cancel both",
+			orders: append(book(1), owned(limitOrder("b1", model.SideBid, 3, "100"), "0xA", model.SelfTradeCancelBoth)),
+			want: []status{
+				{"a1", model.StatusPrevented, 1},
+				{"b1", model.StatusPrevented, 2},
+				{"a0", model.StatusFilled, 1},
+				{"b1", model.StatusPartial, 1},
+			},
+		},
+		{
+			name:   "decrement the taker",
+			orders: append(book(1), owned(limitOrder("b1", model.SideBid, 3, "100"), "0xA", model.SelfTradeDecrement)),
+			want: []status{
+				{"a1", model.StatusPrevented, 1},
+				{"b1", model.StatusDecremented, 1},
+				{"a0", model.StatusFilled, 1},
+				{"b1", model.StatusPartial, 1},
+			},
+		},
+		{
+			name:   "decrement the resting order",
+			orders: append(book(3), owned(limitOrder("b1", model.SideBid, 2, "100"), "0xA", model.SelfTradeDecrement)),
+			want: []status{
+				{"a1", model.StatusDecremented, 1},
+				{"b1", model.StatusPrevented, 1},
+				{"a0", model.StatusFilled, 1},
+				{"b1", model.StatusPartial, 1},
+			},
+		},
+		{
+			name: "other accounts trade",
+			orders: []*model.SignedRequest[model.Order]{
+				owned(limitOrder("a1", model.SideAsk, 1, "100"), "0xA", ""),
+				owned(limitOrder("b1", model.SideBid, 1, "100"), "0xB", ""),
+			},
+			want: []status{
+				{"a1", model.StatusFilled, 1},
+				{"b1", model.StatusFilled, 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []status
+			for _, m := range replay(tt.orders) {
+				got = append(got, status{m.OrderID, m.Status, m.Size.IntPart()})
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPool_GetDepth(t *testing.T) {
+	pool := clob.NewPool(make(chan *model.Match))
+	pool.OpenMarket(_market)
+	iceberg := limitOrder("a4", model.SideAsk, 10, "104")
+	iceberg.Payload.DisplaySize = decimal.NewFromInt(2)
+	report := pool.Restore([]*model.SignedRequest[model.Order]{
+		limitOrder("a1", model.SideAsk, 1, "101"),
+		limitOrder("a2", model.SideAsk, 2, "101"),
+		limitOrder("a3", model.SideAsk, 3, "103"),
+		iceberg,
+		limitOrder("b1", model.SideBid, 1, "99"),
+		limitOrder("b2", model.SideBid, 2, "97"),
+		limitOrder("b3", model.SideBid, 3, "96"),
+	})
+	assert.True(t, report.IsConsistent())
+
+	level := func(price string, size int64, orders int) model.PriceLevel {
+		return model.PriceLevel{Price: decimal.RequireFromString(price), Size: decimal.NewFromInt(size), Orders: orders}
+	}
+	tests := []struct {
+		name     string
+		limit    int
+		grouping string
+		asks     []model.PriceLevel
+		bids     []model.PriceLevel
+	}{
+		{
+			name: "all levels",
+			asks: []model.PriceLevel{level("101", 3, 2), level("103", 3, 1), level("104", 2, 1)},
+			bids: []model.PriceLevel{level("99", 1, 1), level("97", 2, 1), level("96", 3, 1)},
+		},
+		{
+			name:  "limited levels",
+			limit: 2,
+			asks:  []model.PriceLevel{level("101", 3, 2), level("103", 3, 1)},
+			bids:  []model.PriceLevel{level("99", 1, 1), level("97", 2, 1)},
+		},
+		{
+			name:     "grouped levels",
+			grouping: "5",
+			asks:     []model.PriceLevel{level("105", 8, 4)},
+			bids:     []model.PriceLevel{level("95", 6, 3)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grouping := decimal.Zero
+			if tt.grouping != "" {
+				grouping = decimal.RequireFromString(tt.grouping)
+			}
+			depth, err := pool.GetDepth(_market, tt.limit, grouping)
+			assert.NoError(t, err)
+			assert.Equal(t, _market, depth.Market)
+			assert.Equal(t, len(tt.asks), len(depth.Asks))
+			for i := range tt.asks {
+				assert.True(t, tt.asks[i].Price.Equal(depth.Asks[i].Price), "ask %d price %s", i, depth.Asks[i].Price)
+				assert.True(t, tt.asks[i].Size.Equal(depth.Asks[i].Size), "ask %d size %s", i, depth.Asks[i].Size)
+				assert.Equal(t, tt.asks[i].Orders, depth.Asks[i].Orders)
+			}
+			assert.Equal(t, len(tt.bids), len(depth.Bids))
+			for i := range tt.bids {
+				assert.True(t, tt.bids[i].Price.Equal(depth.Bids[i].Price), "bid %d price %s", i, depth.Bids[i].Price)
+				assert.True(t, tt.bids[i].Size.Equal(depth.Bids[i].Size), "bid %d size %s", i, depth.Bids[i].Size)
+				assert.Equal(t, tt.bids[i].Orders, depth.Bids[i].Orders)
+			}
+		})
+	}
+
+	_, err := pool.GetDepth("unknown", 0, decimal.Zero)
+	assert.ErrorIs(t, err, model.ErrMarketNotFound)
+}
+
+func TestPool_Markets(t *testing.T) {
+	const other = "0x4bc2f9cb17bca9ad1cd1bb8e9b1ad3b4bcd1f8d2"
+	matches := make(chan *model.Match, 100)
+	pool := clob.NewPool(matches)
+	pool.OpenMarket(_market)
+	done := make(chan struct{})
+	go func() {
+		pool.Run()
+		close(done)
+	}()
+	// markets opened while running get their own engine
+	pool.OpenMarket(other)
+	inMarket := func(r *model.SignedRequest[model.Order], market string) *model.SignedRequest[model.Order] {
+		r.Payload.Market = market
+		return r
+	}
+	for _, r := range []*model.SignedRequest[model.Order]{
+		limitOrder("a1", model.SideAsk, 2, "100"),
+		inMarket(limitOrder("a2", model.SideAsk, 1, "50"), other),
+		limitOrder("b1", model.SideBid, 1, "100"),
+		inMarket(limitOrder("b2", model.SideBid, 1, "50"), other),
+	} {
+		assert.NoError(t, pool.Submit(r))
+	}
+	assert.ErrorIs(t, pool.Submit(inMarket(limitOrder("x1", model.SideBid, 1, "1"), "unknown")), model.ErrMarketNotFound)
+	// queries are answered by the engines while running
+	assert.Eventually(t, func() bool {
+		depth, err := pool.GetDepth(other, 0, decimal.Zero)
+		return err == nil && len(depth.Asks) == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		price, err := pool.GetQuote(_market, model.SideBid, decimal.NewFromInt(1))
+		return err == nil && price.Equal(decimal.NewFromInt(100))
+	}, time.Second, 10*time.Millisecond)
+
+	pool.Close()
+	<-done
+	assert.ErrorIs(t, pool.Submit(limitOrder("x2", model.SideBid, 1, "1")), clob.ErrPoolClosed)
+	close(matches)
+	statuses := make(map[string]string)
+	for m := range matches {
+		statuses[m.OrderID] = m.Status
+	}
+	assert.Equal(t, map[string]string{
+		"a1": model.StatusPartial,
+		"b1": model.StatusFilled,
+		"a2": model.StatusFilled,
+		"b2": model.StatusFilled,
+	}, statuses)
+}
+
+func TestPool_Trades(t *testing.T) {
+	trades := make(chan *model.Trade, 100)
+	pool := clob.NewPool(make(chan *model.Match, 100)).WithTrades(trades)
+	pool.OpenMarket(_market)
+	pool.SetTradeSequence(_market, 10)
+	pool.Replay([]*model.SignedRequest[model.Order]{
+		limitOrder("a1", model.SideAsk, 2, "100"),
+		limitOrder("a2", model.SideAsk, 2, "101"),
+		limitOrder("b1", model.SideBid, 3, "101"),
+		limitOrder("b2", model.SideBid, 1, ""),
+		limitOrder("a3", model.SideAsk, 1, "99"),
+	})
+	close(trades)
+
+	type trade struct {
+		sequence     uint64
+		maker, taker string
+		price        string
+		size         int64
+		side         string
+	}
+	want := []trade{
+		{11, "a1", "b1", "100", 2, model.SideBid},
+		{12, "a2", "b1", "101", 1, model.SideBid},
+		{13, "a2", "b2", "101", 1, model.SideBid},
+	}
+	got := make([]trade, 0)
+	for tr := range trades {
+		assert.Equal(t, _market, tr.Market)
+		got = append(got, trade{tr.Sequence, tr.MakerOrderID, tr.TakerOrderID, tr.Price.String(), tr.Size.IntPart(), tr.AggressorSide})
+	}
+	assert.Equal(t, want, got)
+}
+
+func TestPool_Amend(t *testing.T) {
+	amend := func(id, orderID, price string, size int64) *model.SignedRequest[model.Order] {
+		return &model.SignedRequest[model.Order]{
+			Payload: model.Order{ID: id, Amends: orderID, Market: _market, Side: model.AmendOrder, Price: price, Size: decimal.NewFromInt(size)},
+		}
+	}
+	stop := limitOrder("s1", model.SideBid, 1, "100")
+	stop.Payload.StopPrice = "100"
+
+	type status struct {
+		id      string
+		orderID string
+		status  string
+		size    int64
+	}
+	tests := []struct {
+		name   string
+		orders []*model.SignedRequest[model.Order]
+		want   []status
+	}{
+		{
+			name: "size reduction keeps the time priority",
+			orders: []*model.SignedRequest[model.Order]{
+				limitOrder("a1", model.SideAsk, 2, "100"),
+				limitOrder("a2", model.SideAsk, 2, "100"),
+				amend("m1", "a1", "", 1),
+				limitOrder("b1", model.SideBid, 2, "100"),
+			},
+			want: []status{
+				{"m1", "a1", model.StatusAmended, 1},
+				{"b1", "a1", model.StatusFilled, 1},
+				{"b1", "a2", model.StatusPartial, 1},
+				{"b1", "b1", model.StatusFilled, 2},
+			},
+		},
+		{
+			name: "size increase loses the time priority",
+			orders: []*model.SignedRequest[model.Order]{
+				limitOrder("a1", model.SideAsk, 2, "100"),
+				limitOrder("a2", model.SideAsk, 2, "100"),
+				amend("m1", "a1", "", 3),
+				limitOrder("b1", model.SideBid, 2, "100"),
+			},
+			want: []status{
+				{"m1", "a1", model.StatusAmended, 3},
+				{"b1", "a2", model.StatusFilled, 2},
+				{"b1", "b1", model.StatusFilled, 2},
+			},
+		},
+		{
+			name: "iceberg reduces the hidden quantity first",
+			orders: []*model.SignedRequest[model.Order]{
+				func() *model.SignedRequest[model.Order] {
+					r := limitOrder("a1", model.SideAsk, 10, "100")
+					r.Payload.DisplaySize = decimal.NewFromInt(2)
+					return r
+				}(),
+				limitOrder("a2", model.SideAsk, 2, "100"),
+				amend("m1", "a1", "", 3),
+				limitOrder("b1", model.SideBid, 4, "100"),
+			},
+			want: []status{
+				{"m1", "a1", model.StatusAmended, 3},
+				{"b1", "a1", model.StatusPartial, 2},
+				{"b1", "a2", model.StatusFilled, 2},
+				{"b1", "b1", model.StatusFilled, 4},
+			},
+		},
+		{
+			name: "price change can trade",
+			orders: []*model.SignedRequest[model.Order]{
+				limitOrder("a1", model.SideAsk, 1, "101"),
+				limitOrder("b1", model.SideBid, 2, "100"),
+				amend("m1", "b1", "101", 0),
+			},
+			want: []status{
+				{"m1", "b1", model.StatusAmended, 2},
+				{"m1", "a1", model.StatusFilled, 1},
+				{"m1", "b1", model.StatusPartial, 1},
+			},
+		},
+		{
+			name: "stop order is amended",
+			orders: []*model.SignedRequest[model.Order]{
+				stop,
+				amend("m1", "s1", "", 3),
+			},
+			want: []status{
+				{"m1", "s1", model.StatusAmended, 3},
+			},
+		},
+		{
+			name: "closed order is not amended",
+			orders: []*model.SignedRequest[model.Order]{
+				limitOrder("a1", model.SideAsk, 1, "100"),
+				limitOrder("b1", model.SideBid, 1, "100"),
+				amend("m1", "a1", "", 1),
+			},
+			want: []status{
+				{"b1", "a1", model.StatusFilled, 1},
+				{"b1", "b1", model.StatusFilled, 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []status
+			for _, m := range replay(tt.orders) {
+				got = append(got, status{m.ID, m.OrderID, m.Status, m.Size.IntPart()})
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPool_CancelAll(t *testing.T) {
+	owned := func(r *model.SignedRequest[model.Order], owner string) *model.SignedRequest[model.Order] {
+		r.From = owner
+		return r
+	}
+	orders := func() []*model.SignedRequest[model.Order] {
+		stop := owned(limitOrder("s1", model.SideBid, 1, "105"), "alice")
+		stop.Payload.StopPrice = "105"
+		return []*model.SignedRequest[model.Order]{
+			owned(limitOrder("a1", model.SideAsk, 1, "101"), "bob"),
+			owned(limitOrder("a2", model.SideAsk, 1, "102"), "alice"),
+			owned(limitOrder("b1", model.SideBid, 1, "99"), "alice"),
+			owned(limitOrder("b2", model.SideBid, 1, "98"), "bob"),
+			owned(limitOrder("a3", model.SideAsk, 1, "101"), "alice"),
+			stop,
+		}
+	}
+	tests := []struct {
+		name    string
+		owner   string
+		market  string
+		side    string
+		want    []string
+		wantErr bool
+	}{
+		{name: "all the orders of an account", owner: "alice", want: []string{"a2", "b1", "a3", "s1"}},
+		{name: "one side", owner: "alice", market: _market, side: model.SideAsk, want: []string{"a2", "a3"}},
+		{name: "all the orders of a market", market: _market, want: []string{"a1", "a2", "b1", "b2", "a3", "s1"}},
+		{name: "unknown account", owner: "carol", want: []string{}},
+		{name: "unknown market", owner: "alice", market: "0x0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matches := make(chan *model.Match, 100)
+			pool := clob.NewPool(matches)
+			pool.OpenMarket(_market)
+			pool.Restore(orders())
+			got, err := pool.CancelAll(tt.owner, tt.market, tt.side, "")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			// the cancelled orders are reported and removed from the book
+			assert.Len(t, matches, len(tt.want))
+			for range tt.want {
+				assert.Equal(t, model.StatusCancelled, (<-matches).Status)
+			}
+			_, err = pool.CancelAll(tt.owner, tt.market, tt.side, "")
+			assert.NoError(t, err)
+			assert.Empty(t, matches)
+		})
+	}
+}
+
+func TestPool_Heartbeat(t *testing.T) {
+	start := func() (*clob.Pool, chan *model.Match) {
+		matches := make(chan *model.Match, 100)
+		pool := clob.NewPool(matches)
+		pool.OpenMarket(_market)
+		alice := limitOrder("a1", model.SideAsk, 1, "101")
+		alice.From = "alice"
+		bob := limitOrder("b1", model.SideBid, 1, "99")
+		bob.From = "bob"
+		pool.Restore([]*model.SignedRequest[model.Order]{alice, bob})
+		go pool.Run()
+		return pool, matches
+	}
+
+	t.Run("expired switch cancels the orders", func(t *testing.T) {
+		pool, matches := start()
+		defer pool.Close()
+		_, err := pool.Heartbeat("alice", 10*time.Millisecond)
+		assert.NoError(t, err)
+		select {
+		case m := <-matches:
+			assert.Equal(t, "a1", m.OrderID)
+			assert.Equal(t, model.StatusCancelled, m.Status)
+			assert.Equal(t, model.ReasonHeartbeat, m.Reason)
+		case <-time.After(time.Second):
+			t.Fatal("orders not cancelled")
+		}
+	})
+	t.Run("heartbeat re-arms the switch", func(t *testing.T) {
+		pool, matches := start()
+		defer pool.Close()
+		_, err := pool.Heartbeat("alice", 10*time.Millisecond)
+		assert.NoError(t, err)
+		expiresAt, err := pool.Heartbeat("alice", time.Hour)
+		assert.NoError(t, err)
+		assert.True(t, expiresAt.After(time.Now()))
+		time.Sleep(50 * time.Millisecond)
+		assert.Empty(t, matches)
+	})
+	t.Run("zero timeout disarms the switch", func(t *testing.T) {
+		pool, matches := start()
+		defer pool.Close()
+		_, err := pool.Heartbeat("alice", 10*time.Millisecond)
+		assert.NoError(t, err)
+		expiresAt, err := pool.Heartbeat("alice", 0)
+		assert.NoError(t, err)
+		assert.True(t, expiresAt.IsZero())
+		time.Sleep(50 * time.Millisecond)
+		assert.Empty(t, matches)
+	})
+	t.Run("closed pool", func(t *testing.T) {
+		pool, _ := start()
+		pool.Close()
+		_, err := pool.Heartbeat("alice", time.Minute)
+		assert.ErrorIs(t, err, clob.ErrPoolClosed)
+	})
+}
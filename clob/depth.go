@@ -0,0 +1,84 @@
+package clob
+
+import (
+	"sort"
+
+	"authex/model"
+
+	ob "github.com/i25959341/orderbook"
+	"github.com/shopspring/decimal"
+)
+
+// GetDepth returns the aggregated price levels of a market, best prices first.
+// The limit is the maximum number of levels per side, zero means no limit.
+// A positive grouping merges the price levels into buckets of that size,
+// bids are rounded down and asks are rounded up to the bucket price.
+// Only the visible quantity of the iceberg orders is reported.
+func (p *Pool) GetDepth(market string, limit int, grouping decimal.Decimal) (depth *model.MarketDepth, err error) {
+	e, ok := p.engine(market)
+	if !ok {
+		return nil, model.ErrMarketNotFound
+	}
+	e.do(func() {
+		depth = e.depth(limit, grouping)
+	})
+	return
+}
+
+// depth returns the aggregated price levels of the book
+func (e *engine) depth(limit int, grouping decimal.Decimal) *model.MarketDepth {
+	// count the orders in each price level
+	counts := map[ob.Side]map[string]int{ob.Buy: {}, ob.Sell: {}}
+	for id := range e.resting {
+		if o := e.book.Order(id); o != nil {
+			counts[o.Side()][o.Price().String()]++
+		}
+	}
+	asks, bids := e.book.Depth()
+	return &model.MarketDepth{
+		Market: e.market,
+		Asks:   levels(asks, counts[ob.Sell], ob.Sell, limit, grouping),
+		Bids:   levels(bids, counts[ob.Buy], ob.Buy, limit, grouping),
+	}
+}
+
+// levels aggregates the price levels of one side of the book
+func levels(depth []*ob.PriceLevel, counts map[string]int, side ob.Side, limit int, grouping decimal.Decimal) []model.PriceLevel {
+	grouped := make(map[string]*model.PriceLevel)
+	for _, l := range depth {
+		price := group(side, l.Price, grouping)
+		pl, ok := grouped[price.String()]
+		if !ok {
+			pl = &model.PriceLevel{Price: price}
+			grouped[price.String()] = pl
+		}
+		pl.Size = pl.Size.Add(l.Quantity)
+		pl.Orders += counts[l.Price.String()]
+	}
+	out := make([]model.PriceLevel, 0, len(grouped))
+	for _, pl := range grouped {
+		out = append(out, *pl)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if side == ob.Buy {
+			return out[i].Price.GreaterThan(out[j].Price)
+		}
+		return out[i].Price.LessThan(out[j].Price)
+	})
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// group returns the price of the bucket a price belongs to
+func group(side ob.Side, price, grouping decimal.Decimal) decimal.Decimal {
+	if !grouping.IsPositive() {
+		return price
+	}
+	buckets := price.Div(grouping)
+	if side == ob.Buy {
+		return buckets.Floor().Mul(grouping)
+	}
+	return buckets.Ceil().Mul(grouping)
+}
@@ -0,0 +1,182 @@
+package clob
+
+import (
+	"sync/atomic"
+	"time"
+
+	"authex/model"
+
+	ob "github.com/i25959341/orderbook"
+	"github.com/labstack/gommon/log"
+	"github.com/shopspring/decimal"
+)
+
+// inboxSize is the number of requests buffered for each market
+const inboxSize = 1024
+
+// engine matches the orders of a single market, the state of the market
+// is owned by the engine goroutine once it is running
+type engine struct {
+	// market address
+	market string
+	// order book of the market
+	book *ob.OrderBook
+	// matching rules of the market
+	rules model.MarketRules
+	// incoming orders
+	inbox chan *model.SignedRequest[model.Order]
+	// queries to be answered by the engine goroutine
+	queries chan func()
+	// order matches, shared by all the markets
+	matches chan *model.Match
+	// trades between the orders, optional and shared by all the markets
+	trades chan *model.Trade
+	// sequence of the trades of the market
+	tradeSequence uint64
+	// journal of the accepted requests, optional and shared by all the markets
+	journal *Journal
+	// GTD orders resting in the book, indexed by order ID
+	expiries map[string]time.Time
+	// stop orders waiting to be triggered, in the order they have been received
+	triggers []*model.SignedRequest[model.Order]
+	// last traded price
+	lastPrice decimal.NullDecimal
+	// iceberg orders resting in the book, indexed by order ID
+	icebergs map[string]*iceberg
+	// orders resting in the book, indexed by order ID
+	resting map[string]*resting
+	// sequence of the orders placed in the book
+	sequence uint64
+	// running is set while the engine goroutine is running
+	running atomic.Bool
+	// stopped is closed when the engine goroutine exits
+	stopped chan struct{}
+}
+
+func newEngine(market string, matches chan *model.Match, trades chan *model.Trade, journal *Journal) *engine {
+	return &engine{
+		market:   market,
+		book:     ob.NewOrderBook(),
+		inbox:    make(chan *model.SignedRequest[model.Order], inboxSize),
+		queries:  make(chan func()),
+		matches:  matches,
+		trades:   trades,
+		journal:  journal,
+		expiries: make(map[string]time.Time),
+		icebergs: make(map[string]*iceberg),
+		resting:  make(map[string]*resting),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// run processes the requests and the queries of the market until quit is closed,
+// the requests already in the inbox are processed before returning
+func (e *engine) run(quit <-chan struct{}) {
+	defer func() {
+		e.running.Store(false)
+		close(e.stopped)
+	}()
+	ticker := time.NewTicker(expirationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			e.expireOrders(now.UTC())
+		case query := <-e.queries:
+			query()
+		case order := <-e.inbox:
+			e.accept(order)
+		case <-quit:
+			for {
+				select {
+				case order := <-e.inbox:
+					e.accept(order)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// accept records a request in the journal and processes it
+func (e *engine) accept(order *model.SignedRequest[model.Order]) {
+	if !e.record(order) {
+		return
+	}
+	e.expireOrders(processingTime(order))
+	e.handleOrder(order)
+}
+
+// record appends a request to the journal (if any), it returns false
+// if the request cannot be recovered and must not be processed
+func (e *engine) record(order *model.SignedRequest[model.Order]) bool {
+	if e.journal == nil {
+		return true
+	}
+	j, err := e.journal.Append(order)
+	if err != nil {
+		log.Errorf("order %s rejected: %v", order.Payload.ID, err)
+		return false
+	}
+	log.Debugf("order %s journaled with sequence %d", order.Payload.ID, j.Sequence)
+	return true
+}
+
+// cancel removes an order from the book (or the trigger book) and reports the
+// cancelled quantity, the reason is set when the exchange cancels the order
+func (e *engine) cancel(orderID, reason string) {
+	var m *model.Match
+	if stop := e.removeTrigger(orderID); stop != nil {
+		m = cancellation(&stop.Payload, stop.Payload.Size, model.StatusCancelled)
+	} else if order := e.book.CancelOrder(orderID); order != nil {
+		m = orderToMatch(orderID, order, model.StatusCancelled)
+		m.Size = m.Size.Add(e.hidden(orderID))
+	}
+	delete(e.expiries, orderID)
+	delete(e.icebergs, orderID)
+	delete(e.resting, orderID)
+	if m == nil {
+		return
+	}
+	m.Reason = reason
+	log.Debugf("order %s %s CANCELLED quantity %s", m.OrderID, m.Side, m.Size)
+	e.matches <- m
+}
+
+// do runs f in the engine goroutine and waits for it to complete,
+// f runs in the calling goroutine if the engine is not running
+func (e *engine) do(f func()) {
+	if !e.running.Load() {
+		f()
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case e.queries <- func() { f(); close(done) }:
+		<-done
+	case <-e.stopped:
+		f()
+	}
+}
+
+func (e *engine) handleOrder(r *model.SignedRequest[model.Order]) {
+	// if it is a cancel order, cancel it and release the remaining quantity
+	if r.Payload.Side == model.CancelOrder {
+		e.cancel(r.Payload.ID, "")
+		return
+	}
+	// an amended order can trade and trigger the stop orders
+	if r.Payload.Side == model.AmendOrder {
+		e.amend(r)
+		e.releaseTriggered()
+		return
+	}
+	// stop orders are held until the last traded price reaches the stop price
+	if r.Payload.IsStop() {
+		e.addTrigger(r)
+	} else {
+		e.processOrder(r)
+	}
+	e.releaseTriggered()
+}
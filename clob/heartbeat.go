@@ -0,0 +1,69 @@
+package clob
+
+import (
+	"time"
+
+	"authex/model"
+
+	"github.com/labstack/gommon/log"
+)
+
+// heartbeat is the dead man's switch of an account
+type heartbeat struct {
+	timer *time.Timer
+}
+
+// Heartbeat arms (or re-arms) the dead man's switch of an account: if no other heartbeat
+// arrives before the timeout, all the open orders of the account are cancelled.
+// A zero timeout disarms the switch. It returns the time the switch expires at.
+func (p *Pool) Heartbeat(owner string, timeout time.Duration) (expiresAt time.Time, err error) {
+	select {
+	case <-p.quit:
+		return expiresAt, ErrPoolClosed
+	default:
+	}
+	p.heartbeatsMu.Lock()
+	defer p.heartbeatsMu.Unlock()
+	if hb, ok := p.heartbeats[owner]; ok {
+		hb.timer.Stop()
+		delete(p.heartbeats, owner)
+	}
+	if timeout <= 0 {
+		log.Debugf("heartbeat of %s disarmed", owner)
+		return
+	}
+	hb := new(heartbeat)
+	hb.timer = time.AfterFunc(timeout, func() { p.expireHeartbeat(owner, hb) })
+	p.heartbeats[owner] = hb
+	expiresAt = time.Now().Add(timeout).UTC()
+	log.Debugf("heartbeat of %s armed until %s", owner, expiresAt)
+	return
+}
+
+// expireHeartbeat cancels the orders of an account whose switch
+// expired, unless the switch has been re-armed meanwhile
+func (p *Pool) expireHeartbeat(owner string, hb *heartbeat) {
+	p.heartbeatsMu.Lock()
+	if p.heartbeats[owner] != hb {
+		p.heartbeatsMu.Unlock()
+		return
+	}
+	delete(p.heartbeats, owner)
+	p.heartbeatsMu.Unlock()
+	cancelled, err := p.CancelAll(owner, "", "", model.ReasonHeartbeat)
+	if err != nil {
+		log.Errorf("heartbeat of %s expired, error cancelling the orders: %v", owner, err)
+		return
+	}
+	log.Infof("heartbeat of %s expired, %d orders cancelled", owner, len(cancelled))
+}
+
+// disarmAll disarms the switches of all the accounts
+func (p *Pool) disarmAll() {
+	p.heartbeatsMu.Lock()
+	defer p.heartbeatsMu.Unlock()
+	for owner, hb := range p.heartbeats {
+		hb.timer.Stop()
+		delete(p.heartbeats, owner)
+	}
+}
@@ -0,0 +1,71 @@
+package clob
+
+import (
+	"authex/model"
+
+	ob "github.com/i25959341/orderbook"
+	"github.com/labstack/gommon/log"
+	"github.com/shopspring/decimal"
+)
+
+// iceberg tracks the hidden quantity of an iceberg order, only a slice
+// of the display size rests in the order book at any time
+type iceberg struct {
+	side    ob.Side
+	price   decimal.Decimal
+	display decimal.Decimal
+	hidden  decimal.Decimal
+}
+
+// hide leaves in the book only the display size of a resting iceberg order,
+// the rest of the quantity is hidden and replenished as the order fills
+func (e *engine) hide(o *model.Order) {
+	if !o.IsIceberg() {
+		return
+	}
+	display := o.DisplaySize
+	rest := e.book.Order(o.ID)
+	if rest == nil || rest.Quantity().LessThanOrEqual(display) {
+		return
+	}
+	e.book.CancelOrder(o.ID)
+	if _, _, _, err := e.book.ProcessLimitOrder(rest.Side(), o.ID, display, rest.Price()); err != nil {
+		log.Error(err)
+		return
+	}
+	e.rest(o.ID, "")
+	e.icebergs[o.ID] = &iceberg{
+		side:    rest.Side(),
+		price:   rest.Price(),
+		display: display,
+		hidden:  rest.Quantity().Sub(display),
+	}
+	log.Debugf("order %s %s HIDDEN quantity %s", o.ID, o.Side, rest.Quantity().Sub(display))
+}
+
+// hidden returns the hidden quantity of an order, zero if it's not an iceberg order
+func (e *engine) hidden(orderID string) decimal.Decimal {
+	if ice, ok := e.icebergs[orderID]; ok {
+		return ice.hidden
+	}
+	return decimal.Zero
+}
+
+// replenish places a new slice of an iceberg order whose visible slice
+// has been consumed, the new slice loses the time priority
+func (e *engine) replenish(orderID string) {
+	ice, ok := e.icebergs[orderID]
+	if !ok {
+		return
+	}
+	slice := decimal.Min(ice.display, ice.hidden)
+	if ice.hidden = ice.hidden.Sub(slice); !ice.hidden.IsPositive() {
+		delete(e.icebergs, orderID)
+	}
+	if _, _, _, err := e.book.ProcessLimitOrder(ice.side, orderID, slice, ice.price); err != nil {
+		log.Error(err)
+		return
+	}
+	e.rest(orderID, "")
+	log.Debugf("order %s REPLENISHED quantity %s", orderID, slice)
+}
@@ -0,0 +1,252 @@
+package clob
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"authex/model"
+
+	"github.com/labstack/gommon/log"
+	"github.com/shopspring/decimal"
+)
+
+var (
+	// ErrJournalCorrupted is returned when the journal cannot be decoded
+	ErrJournalCorrupted = errors.New("journal corrupted")
+	// ErrJournalWrite is returned when an entry cannot be persisted
+	ErrJournalWrite = errors.New("journal write error")
+)
+
+// JournalEntry is a request accepted by the pool
+type JournalEntry struct {
+	// Sequence is the sequence number of the entry, starting from 1
+	Sequence uint64 `json:"seq"`
+	// RecordedAt is the time the entry was written
+	RecordedAt time.Time `json:"recorded_at"`
+	// From is the address of the request sender
+	From string `json:"from,omitempty"`
+	// Signature is the signature of the request
+	Signature string `json:"signature,omitempty"`
+	// Order is the request payload
+	Order model.Order `json:"order"`
+	// Snapshot is the state of the order books when the journal was compacted,
+	// only the first entry of a compacted journal has a snapshot
+	Snapshot *JournalSnapshot `json:"snapshot,omitempty"`
+}
+
+// JournalSnapshot is the state of the order books, the orders are
+// recorded with their open size, in the order of their time priority
+type JournalSnapshot struct {
+	// Markets is the state of the markets, indexed by market address
+	Markets map[string]MarketSnapshot `json:"markets"`
+	// Orders are the orders resting in the books and the stop orders
+	// waiting to be triggered
+	Orders []*model.SignedRequest[model.Order] `json:"orders"`
+}
+
+// MarketSnapshot is the state of a market
+type MarketSnapshot struct {
+	// TradeSequence is the sequence number of the last trade
+	TradeSequence uint64 `json:"trade_sequence"`
+	// LastPrice is the last traded price
+	LastPrice decimal.NullDecimal `json:"last_price"`
+}
+
+// Request returns the signed request recorded in the entry
+func (e *JournalEntry) Request() *model.SignedRequest[model.Order] {
+	return &model.SignedRequest[model.Order]{
+		Signature: e.Signature,
+		From:      e.From,
+		Payload:   e.Order,
+	}
+}
+
+// Journal is an append-only, sequence numbered log of the requests
+// processed by the pool. Every entry is flushed to disk before
+// the request is matched, so the order books can be rebuilt after a crash.
+// The journal is safe for concurrent use, it is shared by the market engines.
+type Journal struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	size     int64
+	sequence uint64
+	entries  []*JournalEntry
+}
+
+// OpenJournal opens (or creates) the journal at the given path.
+// A truncated trailing entry, left by a crash during a write, is discarded.
+func OpenJournal(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	entries, size, err := readEntries(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// drop the partial write, if any
+	if err = file.Truncate(size); err != nil {
+		file.Close()
+		return nil, errors.Join(ErrJournalWrite, err)
+	}
+	if _, err = file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, errors.Join(ErrJournalWrite, err)
+	}
+	j := &Journal{
+		path:    path,
+		file:    file,
+		size:    size,
+		entries: entries,
+	}
+	if len(entries) > 0 {
+		j.sequence = entries[len(entries)-1].Sequence
+	}
+	return j, nil
+}
+
+// ReadJournal reads all the entries of the journal at the given path
+func ReadJournal(path string) ([]*JournalEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries, _, err := readEntries(file)
+	return entries, err
+}
+
+// readEntries decodes the entries from r, returning the entries and
+// the size in bytes of the valid portion of the journal
+func readEntries(r io.Reader) (entries []*JournalEntry, size int64, err error) {
+	reader := bufio.NewReader(r)
+	entries = make([]*JournalEntry, 0)
+	for {
+		line, rErr := reader.ReadBytes('\n')
+		if rErr != nil && !errors.Is(rErr, io.EOF) {
+			err = rErr
+			return
+		}
+		if len(line) == 0 {
+			return
+		}
+		// a line without the terminator is a partial write
+		if line[len(line)-1] != '\n' {
+			log.Warnf("discarding truncated journal entry after sequence %d", len(entries))
+			return
+		}
+		e := new(JournalEntry)
+		if err = json.Unmarshal(bytes.TrimSpace(line), e); err != nil {
+			err = errors.Join(ErrJournalCorrupted, err)
+			return
+		}
+		if e.Sequence != uint64(len(entries))+1 {
+			err = fmt.Errorf("%w: expected sequence %d, got %d", ErrJournalCorrupted, len(entries)+1, e.Sequence)
+			return
+		}
+		entries = append(entries, e)
+		size += int64(len(line))
+	}
+}
+
+// Entries returns the entries that were in the journal when it was opened
+func (j *Journal) Entries() []*JournalEntry {
+	return j.entries
+}
+
+// Sequence returns the sequence number of the last entry
+func (j *Journal) Sequence() uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.sequence
+}
+
+// Append writes the request to the journal and flushes it to disk
+func (j *Journal) Append(r *model.SignedRequest[model.Order]) (*JournalEntry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e := &JournalEntry{
+		Sequence:   j.sequence + 1,
+		RecordedAt: time.Now().UTC(),
+		From:       r.From,
+		Signature:  r.Signature,
+		Order:      r.Payload,
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, errors.Join(ErrJournalWrite, err)
+	}
+	data = append(data, '\n')
+	if _, err = j.file.Write(data); err != nil {
+		return nil, errors.Join(ErrJournalWrite, err, j.rewind())
+	}
+	if err = j.file.Sync(); err != nil {
+		return nil, errors.Join(ErrJournalWrite, err, j.rewind())
+	}
+	j.size += int64(len(data))
+	j.sequence = e.Sequence
+	return e, nil
+}
+
+// Compact replaces the entries of the journal with a snapshot of the order books.
+// The snapshot is written to a new file that is renamed over the journal,
+// so a crash leaves either the old or the compacted journal on disk.
+func (j *Journal) Compact(s *JournalSnapshot) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e := &JournalEntry{
+		Sequence:   1,
+		RecordedAt: time.Now().UTC(),
+		Snapshot:   s,
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.Join(ErrJournalWrite, err)
+	}
+	data = append(data, '\n')
+	tmp := j.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return errors.Join(ErrJournalWrite, err)
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return errors.Join(ErrJournalWrite, err)
+	}
+	j.file.Close()
+	j.file = file
+	j.size = int64(len(data))
+	j.sequence = e.Sequence
+	return nil
+}
+
+// rewind discards a failed write, so the next entry is not appended
+// to a partial one
+func (j *Journal) rewind() error {
+	if err := j.file.Truncate(j.size); err != nil {
+		return err
+	}
+	_, err := j.file.Seek(j.size, io.SeekStart)
+	return err
+}
+
+// Close the journal file
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
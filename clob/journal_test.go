@@ -0,0 +1,169 @@
+package clob_test
+
+import (
+	"authex/clob"
+	"authex/model"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournal_Append(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+
+	journal, err := clob.OpenJournal(path)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), journal.Sequence())
+	for _, o := range []*model.SignedRequest[model.Order]{
+		limitOrder("a1", model.SideAsk, 1, "100"),
+		limitOrder("b1", model.SideBid, 1, "99"),
+	} {
+		_, err = journal.Append(o)
+		require.NoError(t, err)
+	}
+	require.NoError(t, journal.Close())
+
+	// simulate a crash during a write
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"seq":3,"order":{"id":`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	journal, err = clob.OpenJournal(path)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), journal.Sequence())
+	e, err := journal.Append(limitOrder("b2", model.SideBid, 1, "98"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), e.Sequence)
+	require.NoError(t, journal.Close())
+
+	entries, err := clob.ReadJournal(path)
+	require.NoError(t, err)
+	var ids []string
+	for _, e := range entries {
+		ids = append(ids, e.Order.ID)
+	}
+	assert.Equal(t, []string{"a1", "b1", "b2"}, ids)
+}
+
+func TestJournal_Corrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	err := os.WriteFile(path, []byte("{\"seq\":1}\n{\"seq\":3}\n"), 0o600)
+	require.NoError(t, err)
+	_, err = clob.OpenJournal(path)
+	assert.ErrorIs(t, err, clob.ErrJournalCorrupted)
+}
+
+func TestPool_Recover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	journal, err := clob.OpenJournal(path)
+	require.NoError(t, err)
+
+	// process the orders with a journal
+	matches := make(chan *model.Match, 100)
+	pool := clob.NewPool(matches).WithJournal(journal)
+	pool.OpenMarket(_market)
+	done := make(chan struct{})
+	go func() {
+		pool.Run()
+		close(done)
+	}()
+	for _, o := range []*model.SignedRequest[model.Order]{
+		limitOrder("a1", model.SideAsk, 2, "100"),
+		limitOrder("a2", model.SideAsk, 1, "101"),
+		limitOrder("b1", model.SideBid, 1, "100"),
+		{Payload: model.Order{ID: "a2", Market: _market, Side: model.CancelOrder}},
+		limitOrder("b2", model.SideBid, 1, "90"),
+	} {
+		require.NoError(t, pool.Submit(o))
+	}
+	pool.Close()
+	<-done
+	require.NoError(t, journal.Close())
+	wantQuote, err := pool.GetQuote(_market, model.SideBid, decimal.NewFromInt(1))
+	require.NoError(t, err)
+
+	// rebuild the books from the journal
+	journal, err = clob.OpenJournal(path)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), journal.Sequence())
+	recovered := clob.NewPool(make(chan *model.Match, 100))
+	recovered.OpenMarket(_market)
+	recovered.Recover(journal.Entries())
+
+	quote, err := recovered.GetQuote(_market, model.SideBid, decimal.NewFromInt(1))
+	require.NoError(t, err)
+	assert.True(t, wantQuote.Equal(quote), "quote mismatch, got %s want %s", quote, wantQuote)
+	// a2 was cancelled, only one ask left
+	_, err = recovered.GetQuote(_market, model.SideBid, decimal.NewFromInt(2))
+	assert.Error(t, err)
+	quote, err = recovered.GetQuote(_market, model.SideAsk, decimal.NewFromInt(1))
+	require.NoError(t, err)
+	assert.True(t, decimal.NewFromInt(90).Equal(quote), "quote mismatch, got %s", quote)
+}
+
+func TestPool_Compact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	journal, err := clob.OpenJournal(path)
+	require.NoError(t, err)
+
+	// run the pool with a journal, the orders trade once
+	pool := clob.NewPool(make(chan *model.Match, 100)).WithTrades(make(chan *model.Trade, 100)).WithJournal(journal)
+	pool.OpenMarket(_market)
+	done := make(chan struct{})
+	go func() {
+		pool.Run()
+		close(done)
+	}()
+	for _, o := range []*model.SignedRequest[model.Order]{
+		limitOrder("a1", model.SideAsk, 3, "100"),
+		limitOrder("b1", model.SideBid, 1, "100"),
+		limitOrder("a2", model.SideAsk, 1, "101"),
+	} {
+		require.NoError(t, pool.Submit(o))
+	}
+	pool.Close()
+	<-done
+	require.NoError(t, journal.Close())
+
+	// recover and compact the journal
+	journal, err = clob.OpenJournal(path)
+	require.NoError(t, err)
+	recovered := clob.NewPool(make(chan *model.Match, 100)).WithTrades(make(chan *model.Trade, 100)).WithJournal(journal)
+	recovered.Recover(journal.Entries())
+	assert.Equal(t, uint64(1), recovered.TradeSequence(_market))
+	require.NoError(t, recovered.Compact())
+	assert.Equal(t, uint64(1), journal.Sequence())
+	_, err = journal.Append(limitOrder("b2", model.SideBid, 3, "101"))
+	require.NoError(t, err)
+	require.NoError(t, journal.Close())
+
+	// the books are restored from the snapshot, then the new order is replayed
+	entries, err := clob.ReadJournal(path)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.NotNil(t, entries[0].Snapshot)
+	assert.Len(t, entries[0].Snapshot.Orders, 2)
+
+	trades := make(chan *model.Trade, 100)
+	restored := clob.NewPool(make(chan *model.Match, 100)).WithTrades(trades)
+	restored.Recover(entries)
+	close(trades)
+	type trade struct {
+		sequence uint64
+		maker    string
+		size     int64
+	}
+	got := make([]trade, 0)
+	for tr := range trades {
+		got = append(got, trade{tr.Sequence, tr.MakerOrderID, tr.Size.IntPart()})
+	}
+	// a1 keeps its open size and the numbering continues from the snapshot
+	assert.Equal(t, []trade{{2, "a1", 2}, {3, "a2", 1}}, got)
+	assert.Equal(t, uint64(3), restored.TradeSequence(_market))
+}
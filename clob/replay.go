@@ -0,0 +1,82 @@
+package clob
+
+import (
+	"fmt"
+	"sort"
+
+	"authex/model"
+)
+
+// Match differences
+const (
+	// DiffMissing is a match that is recorded but not produced by the replay
+	DiffMissing = "missing"
+	// DiffUnexpected is a match produced by the replay but not recorded
+	DiffUnexpected = "unexpected"
+	// DiffMismatch is a match that differs between the replay and the record
+	DiffMismatch = "mismatch"
+)
+
+// MatchDiff is a difference between a recorded and a replayed match
+type MatchDiff struct {
+	Kind     string       `json:"kind"`
+	Recorded *model.Match `json:"recorded,omitempty"`
+	Replayed *model.Match `json:"replayed,omitempty"`
+}
+
+func (md MatchDiff) String() string {
+	m := md.Replayed
+	if m == nil {
+		m = md.Recorded
+	}
+	return fmt.Sprintf("%s match %s for order %s", md.Kind, m.ID, m.OrderID)
+}
+
+func matchKey(m *model.Match) string {
+	return fmt.Sprint(m.ID, "/", m.OrderID, "/", m.Status)
+}
+
+// sameMatch compares two matches ignoring the time, that depends
+// on when the orders have been processed
+func sameMatch(a, b *model.Match) bool {
+	return a.Price.Equal(b.Price) &&
+		a.Size.Equal(b.Size) &&
+		a.Side == b.Side &&
+		a.Status == b.Status
+}
+
+// DiffMatches compares the recorded matches with the replayed ones,
+// the differences are sorted by match ID and order ID
+func DiffMatches(recorded, replayed []*model.Match) []MatchDiff {
+	index := make(map[string]*model.Match, len(recorded))
+	for _, m := range recorded {
+		index[matchKey(m)] = m
+	}
+	diffs := make([]MatchDiff, 0)
+	for _, m := range replayed {
+		key := matchKey(m)
+		r, ok := index[key]
+		if !ok {
+			diffs = append(diffs, MatchDiff{Kind: DiffUnexpected, Replayed: m})
+			continue
+		}
+		delete(index, key)
+		if !sameMatch(r, m) {
+			diffs = append(diffs, MatchDiff{Kind: DiffMismatch, Recorded: r, Replayed: m})
+		}
+	}
+	for _, m := range index {
+		diffs = append(diffs, MatchDiff{Kind: DiffMissing, Recorded: m})
+	}
+	sort.SliceStable(diffs, func(i, j int) bool {
+		a, b := diffs[i].Replayed, diffs[j].Replayed
+		if a == nil {
+			a = diffs[i].Recorded
+		}
+		if b == nil {
+			b = diffs[j].Recorded
+		}
+		return matchKey(a) < matchKey(b)
+	})
+	return diffs
+}
@@ -0,0 +1,75 @@
+package clob_test
+
+import (
+	"authex/clob"
+	"authex/model"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+// replay processes the requests in a new pool and returns the matches
+func replay(requests []*model.SignedRequest[model.Order]) []*model.Match {
+	matches := make(chan *model.Match)
+	pool := clob.NewPool(matches)
+	pool.OpenMarket(_market)
+	replayed := make([]*model.Match, 0)
+	done := make(chan struct{})
+	go func() {
+		for m := range matches {
+			replayed = append(replayed, m)
+		}
+		close(done)
+	}()
+	pool.Replay(requests)
+	close(matches)
+	<-done
+	return replayed
+}
+
+func TestPool_Replay(t *testing.T) {
+	requests := []*model.SignedRequest[model.Order]{
+		limitOrder("a1", model.SideAsk, 2, "100"),
+		limitOrder("a2", model.SideAsk, 3, "101"),
+		limitOrder("b1", model.SideBid, 1, "100"),
+		limitOrder("b2", model.SideBid, 3, "101"),
+		limitOrder("b3", model.SideBid, 2, ""),
+	}
+	recorded := replay(requests)
+	assert.NotEmpty(t, recorded)
+	// the engine is deterministic
+	assert.Empty(t, clob.DiffMatches(recorded, replay(requests)))
+}
+
+func TestDiffMatches(t *testing.T) {
+	match := func(id, orderID string, size int64) *model.Match {
+		return &model.Match{
+			ID:      id,
+			OrderID: orderID,
+			Price:   decimal.NewFromInt(100),
+			Size:    decimal.NewFromInt(size),
+			Side:    model.SideAsk,
+			Status:  model.StatusFilled,
+		}
+	}
+	recorded := []*model.Match{
+		match("b1", "a1", 1),
+		match("b2", "a1", 1),
+		match("b3", "a2", 1),
+	}
+	replayed := []*model.Match{
+		match("b1", "a1", 1),
+		match("b2", "a1", 2),
+		match("b4", "a2", 1),
+	}
+	var kinds []string
+	for _, d := range clob.DiffMatches(recorded, replayed) {
+		kinds = append(kinds, d.String())
+	}
+	assert.Equal(t, []string{
+		"mismatch match b2 for order a1",
+		"missing match b3 for order a2",
+		"unexpected match b4 for order a2",
+	}, kinds)
+}
@@ -0,0 +1,162 @@
+package clob
+
+import (
+	"fmt"
+
+	"authex/model"
+
+	ob "github.com/i25959341/orderbook"
+	"github.com/labstack/gommon/log"
+	"github.com/shopspring/decimal"
+)
+
+// RestoreIssue describes an order that could not be restored in the order book
+type RestoreIssue struct {
+	OrderID string
+	Market  string
+	Reason  string
+}
+
+func (ri RestoreIssue) String() string {
+	return fmt.Sprintf("order %s (market %s): %s", ri.OrderID, ri.Market, ri.Reason)
+}
+
+// RestoreReport is the consistency report of a restore operation
+type RestoreReport struct {
+	// Restored is the number of orders restored in the order books
+	Restored int
+	// Markets is the number of orders restored, indexed by market
+	Markets map[string]int
+	// Issues lists the orders that have been skipped
+	Issues []RestoreIssue
+}
+
+// IsConsistent returns true if all the orders have been restored
+func (rr *RestoreReport) IsConsistent() bool {
+	return len(rr.Issues) == 0
+}
+
+func (rr *RestoreReport) skip(o *model.Order, reason string) {
+	rr.Issues = append(rr.Issues, RestoreIssue{OrderID: o.ID, Market: o.Market, Reason: reason})
+}
+
+// Restore inserts the resting orders in the order books of their market,
+// the orders must be sorted by time priority and their size must be the
+// remaining (unfilled) size of the order.
+// Restore does not produce matches: an order that would cross the book
+// is reported as an issue and skipped, while IOC and FOK orders are
+// cancelled. Stop orders are held in the trigger book until the
+// next trade. If the pool has a journal the restored orders are recorded in it.
+// It must be called before Run.
+func (p *Pool) Restore(orders []*model.SignedRequest[model.Order]) *RestoreReport {
+	report := &RestoreReport{
+		Markets: make(map[string]int),
+	}
+	for _, r := range orders {
+		e, ok := p.engine(r.Payload.Market)
+		if !ok {
+			report.skip(&r.Payload, "market is not open")
+			continue
+		}
+		e.restore(r, report)
+	}
+	return report
+}
+
+// restore inserts a resting order in the book, the issues are recorded in the report
+func (e *engine) restore(r *model.SignedRequest[model.Order], report *RestoreReport) {
+	o := &r.Payload
+	if e.book.Order(o.ID) != nil {
+		report.skip(o, "duplicated order")
+		return
+	}
+	if !o.Size.IsPositive() {
+		report.skip(o, "no remaining size")
+		return
+	}
+	// stop orders that have not been triggered go back to the trigger book
+	if o.IsStop() {
+		e.addTrigger(r)
+		if e.journal != nil {
+			if _, err := e.journal.Append(r); err != nil {
+				e.removeTrigger(o.ID)
+				delete(e.expiries, o.ID)
+				report.skip(o, err.Error())
+				return
+			}
+		}
+		report.Restored++
+		report.Markets[o.Market]++
+		log.Debugf("restored %s stop order %s, stop price %s", o.Side, o.ID, o.StopPrice)
+		return
+	}
+	price, err := decimal.NewFromString(o.Price)
+	if err != nil || !price.IsPositive() {
+		report.skip(o, fmt.Sprintf("invalid limit price %q", o.Price))
+		return
+	}
+	// immediate orders must not rest in the book, release them
+	if tif := o.GetTimeInForce(); tif == model.TimeInForceIOC || tif == model.TimeInForceFOK {
+		e.matches <- cancellation(o, o.Size, model.StatusCancelled)
+		report.skip(o, fmt.Sprintf("%s order cancelled", tif))
+		return
+	}
+	side := ob.Buy
+	if o.Side == model.SideAsk {
+		side = ob.Sell
+	}
+	if best, ok := bestOpposite(e.book, side); ok && crosses(side, price, best) {
+		report.skip(o, fmt.Sprintf("price %s crosses the book at %s", price, best))
+		return
+	}
+	quantity := o.Size
+	if _, _, _, err = e.book.ProcessLimitOrder(side, o.ID, quantity, price); err != nil {
+		report.skip(o, err.Error())
+		return
+	}
+	e.rest(o.ID, r.From)
+	e.resting[o.ID].request = r
+	e.hide(o)
+	// record the restored order so that it can be recovered from the journal
+	if e.journal != nil {
+		if _, err = e.journal.Append(r); err != nil {
+			e.book.CancelOrder(o.ID)
+			delete(e.icebergs, o.ID)
+			delete(e.resting, o.ID)
+			report.skip(o, err.Error())
+			return
+		}
+	}
+	if o.GetTimeInForce() == model.TimeInForceGTD {
+		e.expiries[o.ID] = o.ExpiresAt
+	}
+	report.Restored++
+	report.Markets[o.Market]++
+	log.Debugf("restored %s order %s, price %s, quantity %s", o.Side, o.ID, price, quantity)
+}
+
+// bestOpposite returns the best price on the opposite side of the book
+// for an order on the given side
+func bestOpposite(orderBook *ob.OrderBook, side ob.Side) (price decimal.Decimal, ok bool) {
+	asks, bids := orderBook.Depth()
+	if side == ob.Buy {
+		// asks are sorted from the highest to the lowest price
+		if len(asks) == 0 {
+			return
+		}
+		return asks[len(asks)-1].Price, true
+	}
+	if len(bids) == 0 {
+		return
+	}
+	return bids[0].Price, true
+}
+
+// crosses returns true if a limit order at price would match
+// against the best price on the opposite side
+func crosses(side ob.Side, price, best decimal.Decimal) bool {
+	if side == ob.Buy {
+		return price.GreaterThanOrEqual(best)
+	}
+	return price.LessThanOrEqual(best)
+}
@@ -0,0 +1,161 @@
+package clob
+
+import (
+	"authex/model"
+
+	ob "github.com/i25959341/orderbook"
+	"github.com/labstack/gommon/log"
+	"github.com/shopspring/decimal"
+)
+
+// resting tracks the owner and the time priority of an order in the book
+type resting struct {
+	owner    string
+	sequence uint64
+	// request that placed the order in the book
+	request *model.SignedRequest[model.Order]
+}
+
+// rest records that an order has been placed at the end of its price level,
+// the owner of an order that is placed again is preserved
+func (e *engine) rest(orderID, owner string) {
+	e.sequence++
+	if r, ok := e.resting[orderID]; ok {
+		r.sequence = e.sequence
+		return
+	}
+	e.resting[orderID] = &resting{owner: owner, sequence: e.sequence}
+}
+
+// selfTradePrevention returns the self-trade prevention mode of an order
+func (e *engine) selfTradePrevention(o *model.Order) string {
+	if o.SelfTradePrevention != "" {
+		return o.SelfTradePrevention
+	}
+	if mode := e.rules.SelfTradePrevention; mode != "" {
+		return mode
+	}
+	return model.SelfTradeCancelNewest
+}
+
+// selfTrade returns the first order of the owner that an order on the given side
+// would match, and the quantity of the orders ahead of it in the book
+func (e *engine) selfTrade(owner string, side ob.Side, price decimal.Decimal, isMarket bool) (self *ob.Order, ahead decimal.Decimal) {
+	if owner == "" {
+		return
+	}
+	var sequence uint64
+	for id, r := range e.resting {
+		if r.owner != owner {
+			continue
+		}
+		o := e.book.Order(id)
+		if o == nil || o.Side() == side || !(isMarket || crosses(side, price, o.Price())) {
+			continue
+		}
+		if self == nil || better(side, o.Price(), self.Price()) || (o.Price().Equal(self.Price()) && r.sequence < sequence) {
+			self, sequence = o, r.sequence
+		}
+	}
+	if self == nil {
+		return
+	}
+	asks, bids := e.book.Depth()
+	levels := bids
+	if side == ob.Buy {
+		levels = asks
+	}
+	for _, l := range levels {
+		if better(side, l.Price, self.Price()) {
+			ahead = ahead.Add(l.Quantity)
+		}
+	}
+	// orders at the same price placed before
+	for id, r := range e.resting {
+		if r.sequence >= sequence {
+			continue
+		}
+		if o := e.book.Order(id); o != nil && o.Side() == self.Side() && o.Price().Equal(self.Price()) {
+			ahead = ahead.Add(o.Quantity())
+		}
+	}
+	return
+}
+
+// better returns true if the price a is matched before the price b
+// by an order on the given side
+func better(side ob.Side, a, b decimal.Decimal) bool {
+	if side == ob.Buy {
+		return a.LessThan(b)
+	}
+	return a.GreaterThan(b)
+}
+
+// preventSelfTrade applies the self-trade prevention mode of the taker when it
+// reaches an order of the same owner, it returns the quantity left to the taker.
+// The matches report the counterparty order ID as ID.
+func (e *engine) preventSelfTrade(r *model.SignedRequest[model.Order], self *ob.Order, left decimal.Decimal) decimal.Decimal {
+	mode := e.selfTradePrevention(&r.Payload)
+	total := self.Quantity().Add(e.hidden(self.ID()))
+	log.Debugf("order %s %s SELF-TRADE with %s, mode %s", r.Payload.ID, r.Payload.Side, self.ID(), mode)
+	switch mode {
+	case model.SelfTradeCancelOldest:
+		e.removeResting(r.Payload.ID, self, total, model.StatusPrevented)
+		return left
+	case model.SelfTradeCancelBoth:
+		e.removeResting(r.Payload.ID, self, total, model.StatusPrevented)
+	case model.SelfTradeDecrement:
+		if total.LessThanOrEqual(left) {
+			e.removeResting(r.Payload.ID, self, total, model.StatusPrevented)
+			if total.LessThan(left) {
+				m := cancellation(&r.Payload, total, model.StatusDecremented)
+				m.ID = self.ID()
+				e.matches <- m
+				return left.Sub(total)
+			}
+			break
+		}
+		e.decrement(self, left)
+		m := orderToMatch(r.Payload.ID, self, model.StatusDecremented)
+		m.Size = left
+		e.matches <- m
+	}
+	m := cancellation(&r.Payload, left, model.StatusPrevented)
+	m.ID = self.ID()
+	e.matches <- m
+	return decimal.Zero
+}
+
+// removeResting cancels a resting order, including its hidden quantity
+func (e *engine) removeResting(takerID string, order *ob.Order, total decimal.Decimal, status string) {
+	e.book.CancelOrder(order.ID())
+	delete(e.icebergs, order.ID())
+	delete(e.expiries, order.ID())
+	delete(e.resting, order.ID())
+	m := orderToMatch(takerID, order, status)
+	m.Size = total
+	e.matches <- m
+}
+
+// decrement reduces the size of a resting order, the hidden quantity of
+// iceberg orders is reduced first. An order whose visible quantity is
+// reduced is placed again in the book, losing its time priority.
+func (e *engine) decrement(order *ob.Order, quantity decimal.Decimal) {
+	if ice, ok := e.icebergs[order.ID()]; ok {
+		if ice.hidden.GreaterThan(quantity) {
+			ice.hidden = ice.hidden.Sub(quantity)
+			return
+		}
+		quantity = quantity.Sub(ice.hidden)
+		delete(e.icebergs, order.ID())
+		if quantity.IsZero() {
+			return
+		}
+	}
+	e.book.CancelOrder(order.ID())
+	if _, _, _, err := e.book.ProcessLimitOrder(order.Side(), order.ID(), order.Quantity().Sub(quantity), order.Price()); err != nil {
+		log.Error(err)
+		return
+	}
+	e.rest(order.ID(), "")
+}
@@ -0,0 +1,105 @@
+package clob
+
+import (
+	"sort"
+
+	"authex/model"
+
+	"github.com/labstack/gommon/log"
+)
+
+// Snapshot returns the state of the order books: the orders resting in the books,
+// with their open size and in the order of their time priority, the stop orders
+// waiting to be triggered, the last traded price and the trade sequence of the markets
+func (p *Pool) Snapshot() *JournalSnapshot {
+	p.mu.RLock()
+	markets := make([]string, 0, len(p.engines))
+	for market := range p.engines {
+		markets = append(markets, market)
+	}
+	p.mu.RUnlock()
+	sort.Strings(markets)
+
+	s := &JournalSnapshot{
+		Markets: make(map[string]MarketSnapshot, len(markets)),
+		Orders:  make([]*model.SignedRequest[model.Order], 0),
+	}
+	for _, market := range markets {
+		e, _ := p.engine(market)
+		e.do(func() {
+			s.Markets[market] = MarketSnapshot{
+				TradeSequence: e.tradeSequence,
+				LastPrice:     e.lastPrice,
+			}
+			s.Orders = append(s.Orders, e.snapshot()...)
+		})
+	}
+	return s
+}
+
+// snapshot returns the orders of the market, the resting orders are
+// recorded at their book price and open size
+func (e *engine) snapshot() []*model.SignedRequest[model.Order] {
+	ids := make([]string, 0, len(e.resting))
+	for id, r := range e.resting {
+		if r.request != nil && e.book.Order(id) != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return e.resting[ids[i]].sequence < e.resting[ids[j]].sequence
+	})
+	orders := make([]*model.SignedRequest[model.Order], 0, len(ids)+len(e.triggers))
+	for _, id := range ids {
+		order := e.book.Order(id)
+		r := *e.resting[id].request
+		r.Payload.Price = order.Price().String()
+		r.Payload.Size = order.Quantity().Add(e.hidden(id))
+		// a triggered stop order rests as a limit order
+		r.Payload.StopPrice = ""
+		orders = append(orders, &r)
+	}
+	return append(orders, e.triggers...)
+}
+
+// applySnapshot restores the state of the order books from a snapshot,
+// the orders are not recorded in the journal again
+func (p *Pool) applySnapshot(s *JournalSnapshot) {
+	for market, state := range s.Markets {
+		p.OpenMarket(market)
+		e, _ := p.engine(market)
+		e.do(func() {
+			e.tradeSequence = state.TradeSequence
+			e.lastPrice = state.LastPrice
+		})
+	}
+	report := &RestoreReport{
+		Markets: make(map[string]int),
+	}
+	for _, r := range s.Orders {
+		p.OpenMarket(r.Payload.Market)
+		e, _ := p.engine(r.Payload.Market)
+		e.do(func() {
+			journal := e.journal
+			e.journal = nil
+			e.restore(r, report)
+			e.journal = journal
+		})
+	}
+	for _, issue := range report.Issues {
+		log.Warnf("snapshot order not restored: %s", issue)
+	}
+}
+
+// Compact replaces the journal with a snapshot of the order books, so that
+// the books are recovered without replaying the whole history.
+// It must be called before Run.
+func (p *Pool) Compact() error {
+	p.mu.RLock()
+	journal := p.journal
+	p.mu.RUnlock()
+	if journal == nil {
+		return nil
+	}
+	return journal.Compact(p.Snapshot())
+}
@@ -0,0 +1,72 @@
+package clob
+
+import (
+	"authex/model"
+
+	"github.com/labstack/gommon/log"
+	"github.com/shopspring/decimal"
+)
+
+// addTrigger holds a stop order until the last traded price reaches its stop price
+func (e *engine) addTrigger(r *model.SignedRequest[model.Order]) {
+	e.triggers = append(e.triggers, r)
+	if r.Payload.GetTimeInForce() == model.TimeInForceGTD {
+		e.expiries[r.Payload.ID] = r.Payload.ExpiresAt
+	}
+	log.Debugf("order %s %s HELD stop price %s", r.Payload.ID, r.Payload.Side, r.Payload.StopPrice)
+}
+
+// removeTrigger removes a stop order that has not been triggered yet,
+// it returns nil if the order is not found
+func (e *engine) removeTrigger(orderID string) *model.SignedRequest[model.Order] {
+	stops := e.triggers
+	for i, r := range stops {
+		if r.Payload.ID == orderID {
+			e.triggers = append(stops[:i:i], stops[i+1:]...)
+			return r
+		}
+	}
+	return nil
+}
+
+// releaseTriggered processes the stop orders triggered by the last traded price,
+// in the order they have been received. Since a triggered order can trade and
+// move the price, the trigger book is checked again after each release.
+func (e *engine) releaseTriggered() {
+	for {
+		if !e.lastPrice.Valid {
+			return
+		}
+		lastPrice := e.lastPrice.Decimal
+		var triggered *model.SignedRequest[model.Order]
+		for _, r := range e.triggers {
+			if isTriggered(&r.Payload, lastPrice) {
+				triggered = r
+				break
+			}
+		}
+		if triggered == nil {
+			return
+		}
+		e.removeTrigger(triggered.Payload.ID)
+		m := cancellation(&triggered.Payload, triggered.Payload.Size, model.StatusTriggered)
+		m.Price = lastPrice
+		log.Debugf("order %s %s TRIGGERED price %s", m.OrderID, m.Side, m.Price)
+		e.matches <- m
+		e.processOrder(triggered)
+	}
+}
+
+// isTriggered returns true if the last traded price reached the stop price:
+// bid stops trigger when the price rises to the stop price,
+// ask stops trigger when the price falls to the stop price
+func isTriggered(o *model.Order, lastPrice decimal.Decimal) bool {
+	stopPrice, err := decimal.NewFromString(o.StopPrice)
+	if err != nil {
+		return false
+	}
+	if o.Side == model.SideBid {
+		return lastPrice.GreaterThanOrEqual(stopPrice)
+	}
+	return lastPrice.LessThanOrEqual(stopPrice)
+}
@@ -3,10 +3,19 @@ package cmd
 import (
 	"authex/helpers"
 	"authex/model"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
 	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/shopspring/decimal"
 	"github.com/spf13/cobra"
 )
 
@@ -35,15 +44,32 @@ func withdraw(url string, asset string, amount string) error {
 }
 
 func order(url string, market string, size string, price string, side string) error {
-	sizeUint, err := strconv.ParseUint(size, 10, 64)
+	sizeDec, err := decimal.NewFromString(size)
 	if err != nil {
-		return err
+		return errors.Join(errors.New("invalid size"), err)
+	}
+	var displaySizeDec decimal.Decimal
+	if !helpers.IsEmpty(displaySize) {
+		if displaySizeDec, err = decimal.NewFromString(displaySize); err != nil {
+			return errors.Join(errors.New("invalid display size"), err)
+		}
 	}
 	o := model.Order{
-		Market: market,
-		Side:   side,
-		Size:   uint(sizeUint),
-		Price:  price,
+		Market:              market,
+		Side:                side,
+		Size:                sizeDec,
+		Price:               price,
+		TimeInForce:         strings.ToUpper(timeInForce),
+		PostOnly:            postOnly,
+		Reprice:             reprice,
+		StopPrice:           stopPrice,
+		DisplaySize:         displaySizeDec,
+		SelfTradePrevention: strings.ToUpper(selfTradePrevention),
+	}
+	if !helpers.IsEmpty(expiresAt) {
+		if o.ExpiresAt, err = time.Parse(time.RFC3339, expiresAt); err != nil {
+			return errors.Join(errors.New("invalid expiration time, use the RFC3339 format"), err)
+		}
 	}
 	// sign the message
 	signature, err := helpers.Sign(
@@ -102,11 +128,125 @@ func cancelOrder(url string, id string) error {
 	return nil
 }
 
+// cancelAll cancels the open orders of a market and side (all if empty),
+// the path selects the orders of the signer or of all the accounts (admin)
+func cancelAll(url, path, market, side string) error {
+	req := model.Order{
+		Market:      market,
+		Side:        strings.ToLower(side),
+		SubmittedAt: time.Now().UTC(),
+	}
+	// sign the message
+	signature, err := helpers.Sign(
+		options.Identity.KeystorePath,
+		options.Identity.SignerAddress,
+		options.Identity.Password,
+		!nonInteractive,
+		req,
+	)
+	if err != nil {
+		err = errors.Join(errors.New("error signing the message"), err)
+		return err
+	}
+	r := &model.SignedRequest[model.Order]{
+		Signature: signature,
+		Payload:   req,
+	}
+	// send the request
+	code, data, err := helpers.Post(fmt.Sprint(url, path), r)
+	if err != nil {
+		err = errors.Join(errors.New("error cancelling orders"), err)
+		return err
+	}
+	helpers.PrintResponse(code, data)
+	return nil
+}
+
+func heartbeat(url, timeout string) error {
+	seconds, err := strconv.Atoi(timeout)
+	if err != nil {
+		return errors.Join(errors.New("invalid timeout"), err)
+	}
+	hb := model.Heartbeat{
+		Timeout:     seconds,
+		SubmittedAt: time.Now().UTC(),
+	}
+	if err = hb.Validate(); err != nil {
+		return err
+	}
+	// sign the message
+	signature, err := helpers.Sign(
+		options.Identity.KeystorePath,
+		options.Identity.SignerAddress,
+		options.Identity.Password,
+		!nonInteractive,
+		hb,
+	)
+	if err != nil {
+		err = errors.Join(errors.New("error signing the message"), err)
+		return err
+	}
+	r := &model.SignedRequest[model.Heartbeat]{
+		Signature: signature,
+		Payload:   hb,
+	}
+	// send the request
+	code, data, err := helpers.Post(fmt.Sprint(url, "/account/heartbeat"), r)
+	if err != nil {
+		err = errors.Join(errors.New("error sending heartbeat"), err)
+		return err
+	}
+	helpers.PrintResponse(code, data)
+	return nil
+}
+
+func amendOrder(url, id, price, size string) error {
+	amendment := model.Order{
+		Amends: id,
+		Price:  price,
+	}
+	if !helpers.IsEmpty(size) {
+		sizeDec, err := decimal.NewFromString(size)
+		if err != nil {
+			return errors.Join(errors.New("invalid size"), err)
+		}
+		amendment.Size = sizeDec
+	}
+	if err := amendment.ValidateAmendment(); err != nil {
+		return err
+	}
+	// sign the message
+	signature, err := helpers.Sign(
+		options.Identity.KeystorePath,
+		options.Identity.SignerAddress,
+		options.Identity.Password,
+		!nonInteractive,
+		amendment,
+	)
+	if err != nil {
+		err = errors.Join(errors.New("error signing the message"), err)
+		return err
+	}
+	r := &model.SignedRequest[model.Order]{
+		Signature: signature,
+		Payload:   amendment,
+	}
+	// send the request
+	code, data, err := helpers.Post(fmt.Sprint(url, "/account/orders/amend"), r)
+	if err != nil {
+		err = errors.Join(errors.New("error amending order"), err)
+		return err
+	}
+	helpers.PrintResponse(code, data)
+	return nil
+}
+
 var askLimitCmd = &cobra.Command{
 	Use:     "ask <market-address> <size> <price>",
 	Aliases: []string{"ask-limit", "sell-limit", "sell", "offer"},
 	Short:   "Submit a new order",
 	Args:    cobra.ExactArgs(3),
+	Example: `authex account ask 0x1234... 10 100 --time-in-force GTD --expires-at 2023-07-01T00:00:00Z`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return order(restBaseURL, args[0], args[1], args[2], model.SideAsk)
 	},
@@ -151,3 +291,128 @@ var cancelOrderCmd = &cobra.Command{
 		return cancelOrder(restBaseURL, args[0])
 	},
 }
+
+var cancelAllCmd = &cobra.Command{
+	Use:     "cancel-all",
+	Short:   "Cancel all the open orders of the account",
+	Args:    cobra.NoArgs,
+	Example: `authex account cancel-all --market 0x1234... --side bid`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cancelAll(restBaseURL, "/account/orders/cancel-all", cancelMarket, cancelSide)
+	},
+}
+
+var heartbeatCmd = &cobra.Command{
+	Use:   "heartbeat <timeout-seconds>",
+	Short: "Arm the dead man's switch of the account",
+	Long: `Arm the dead man's switch of the account: if no other heartbeat arrives
+	within the timeout, all the open orders of the account are cancelled.
+	A zero timeout disarms the switch.`,
+	Args:    cobra.ExactArgs(1),
+	Example: `authex account heartbeat 30`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return heartbeat(restBaseURL, args[0])
+	},
+}
+
+var amendOrderCmd = &cobra.Command{
+	Use:   "amend-order <order-id>",
+	Short: "Change the price and/or the open size of an order",
+	Long: `Change the price and/or the open (unfilled) size of an order.
+	An order whose size is reduced keeps its time priority, otherwise it is
+	placed again in the book and it may trade at the new price.`,
+	Aliases: []string{"amend"},
+	Args:    cobra.ExactArgs(1),
+	Example: `authex account amend-order 7f5c... --price 101 --size 5`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return amendOrder(restBaseURL, args[0], amendPrice, amendSize)
+	},
+}
+
+var balancesCmd = &cobra.Command{
+	Use:     "balances",
+	Short:   "Get the available, locked and pending balances of the account",
+	Aliases: []string{"balance"},
+	Args:    cobra.NoArgs,
+	Example: `authex account balances --from 0x1234...`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return balances(restBaseURL, options.Identity.SignerAddress)
+	},
+}
+
+func balances(url, address string) error {
+	// send the request
+	code, data, err := helpers.Get(fmt.Sprint(url, "/account/", address, "/balances"))
+	if err != nil {
+		err = errors.Join(errors.New("error getting balances"), err)
+		return err
+	}
+	var rsp struct {
+		Balances []*model.Balance `json:"balances"`
+	}
+	if code != http.StatusOK || json.Unmarshal([]byte(data), &rsp) != nil {
+		helpers.PrintResponse(code, data)
+		return nil
+	}
+	printBalances(os.Stdout, rsp.Balances)
+	return nil
+}
+
+// printBalances renders the balances of an account as a table
+func printBalances(w io.Writer, balances []*model.Balance) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "SYMBOL\tASSET\tAVAILABLE\tLOCKED\tTOTAL\t")
+	for _, b := range balances {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t\n", b.Symbol, b.Asset, b.Available, b.Locked, b.Total)
+	}
+	tw.Flush()
+}
+
+var ledgerCmd = &cobra.Command{
+	Use:     "ledger",
+	Short:   "Get the ledger entries that moved the balances of the account",
+	Args:    cobra.NoArgs,
+	Example: `authex account ledger --asset 0x1234... --limit 20`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return ledger(restBaseURL, options.Identity.SignerAddress, ledgerAsset, ledgerLimit)
+	},
+}
+
+func ledger(url, address, asset string, limit int) error {
+	params := neturl.Values{}
+	params.Set("limit", strconv.Itoa(limit))
+	if asset != "" {
+		params.Set("asset", asset)
+	}
+	// send the request
+	code, data, err := helpers.Get(fmt.Sprint(url, "/account/", address, "/ledger?", params.Encode()))
+	if err != nil {
+		err = errors.Join(errors.New("error getting ledger"), err)
+		return err
+	}
+	helpers.PrintResponse(code, data)
+	return nil
+}
+
+var depositsCmd = &cobra.Command{
+	Use:     "deposits",
+	Short:   "Get the deposits of the account, pending or confirmed",
+	Args:    cobra.NoArgs,
+	Example: `authex account deposits --limit 20`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return deposits(restBaseURL, options.Identity.SignerAddress, depositLimit)
+	},
+}
+
+func deposits(url, address string, limit int) error {
+	params := neturl.Values{}
+	params.Set("limit", strconv.Itoa(limit))
+	// send the request
+	code, data, err := helpers.Get(fmt.Sprint(url, "/account/", address, "/deposits?", params.Encode()))
+	if err != nil {
+		err = errors.Join(errors.New("error getting deposits"), err)
+		return err
+	}
+	helpers.PrintResponse(code, data)
+	return nil
+}
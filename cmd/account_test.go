@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"authex/model"
+	"bytes"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPrintBalances tests that the balances are printed one per line, aligned to the right
+func TestPrintBalances(t *testing.T) {
+	balance := func(symbol, asset, available, locked string) *model.Balance {
+		a, l := decimal.RequireFromString(available), decimal.RequireFromString(locked)
+		return &model.Balance{Symbol: symbol, Asset: asset, Available: a, Locked: l, Total: a.Add(l)}
+	}
+	tests := []struct {
+		name     string
+		balances []*model.Balance
+		want     string
+	}{
+		{
+			name: "no balances",
+			want: "  SYMBOL  ASSET  AVAILABLE  LOCKED  TOTAL\n",
+		},
+		{
+			name: "balances",
+			balances: []*model.Balance{
+				balance("EUR", "0x60c197cc20da7f7d7c4d019fb9e66cd79b223c6c", "80.5", "20"),
+				balance("TKN", "0x1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d", "0", "1.25"),
+			},
+			want: "  SYMBOL                                       ASSET  AVAILABLE  LOCKED  TOTAL\n" +
+				"     EUR  0x60c197cc20da7f7d7c4d019fb9e66cd79b223c6c       80.5      20  100.5\n" +
+				"     TKN  0x1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d          0    1.25   1.25\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			printBalances(&out, tt.balances)
+			assert.Equal(t, tt.want, out.String())
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/shopspring/decimal"
 	"github.com/spf13/cobra"
 )
 
@@ -46,6 +47,35 @@ func registerMarket(url, baseStr, quoteStr string) (err error) {
 	market := model.Market{
 		BaseSymbol:  base[0],
 		QuoteSymbol: quote[0],
+		MarketRules: model.MarketRules{
+			SelfTradePrevention: strings.ToUpper(selfTradePrevention),
+		},
+	}
+	for _, rule := range []struct {
+		name  string
+		value string
+		dest  *decimal.Decimal
+	}{
+		{"tick size", tickSize, &market.TickSize},
+		{"lot size", lotSize, &market.LotSize},
+		{"min size", minSize, &market.MinSize},
+		{"min notional", minNotional, &market.MinNotional},
+		{"maker fee", makerFee, &market.MakerFee},
+		{"taker fee", takerFee, &market.TakerFee},
+	} {
+		if helpers.IsEmpty(rule.value) {
+			continue
+		}
+		if *rule.dest, err = decimal.NewFromString(rule.value); err != nil {
+			return fmt.Errorf("invalid %s %q: %w", rule.name, rule.value, err)
+		}
+	}
+	for _, t := range feeTiers {
+		tier, tErr := parseFeeTier(t)
+		if tErr != nil {
+			return tErr
+		}
+		market.FeeTiers = append(market.FeeTiers, tier)
 	}
 	if len(base) > 1 {
 		market.BaseAddress = base[1]
@@ -84,6 +114,20 @@ func registerMarket(url, baseStr, quoteStr string) (err error) {
 	return
 }
 
+// parseFeeTier parses a fee tier in the format <min-volume>:<maker-fee>:<taker-fee>
+func parseFeeTier(s string) (tier model.FeeTier, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return tier, fmt.Errorf("invalid fee tier %q, the format is <min-volume>:<maker-fee>:<taker-fee>", s)
+	}
+	for i, dest := range []*decimal.Decimal{&tier.MinVolume, &tier.MakerFee, &tier.TakerFee} {
+		if *dest, err = decimal.NewFromString(parts[i]); err != nil {
+			return tier, fmt.Errorf("invalid fee tier %q: %w", s, err)
+		}
+	}
+	return tier, nil
+}
+
 // grantAccessCmd represents the registerMarket command.
 var grantAccessCmd = &cobra.Command{
 	Use:     "grant-access <account-address>",
@@ -181,3 +225,13 @@ func fund(url, account, asset, amount string) error {
 	helpers.PrintResponse(code, data)
 	return nil
 }
+
+var forceCancelAllCmd = &cobra.Command{
+	Use:     "cancel-all <market-address>",
+	Short:   "Cancel all the open orders of a market, of every account",
+	Args:    cobra.ExactArgs(1),
+	Example: `authex admin cancel-all 0x1234... --side ask`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cancelAll(restBaseURL, "/admin/orders/cancel-all", args[0], cancelSide)
+	},
+}
@@ -2,7 +2,15 @@ package cmd
 
 import (
 	"authex/helpers"
+	"authex/model"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
 
 	"github.com/spf13/cobra"
 )
@@ -118,3 +126,73 @@ func queryMarketPrice(url, market string) error {
 	helpers.PrintResponse(code, data)
 	return nil
 }
+
+var queryMarketDepthCmd = &cobra.Command{
+	Use:     "depth <market-address>",
+	Short:   "Get the aggregated price levels of a market",
+	Args:    cobra.ExactArgs(1),
+	Example: `authex query depth 0x123... --limit 5 --grouping 10`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return queryMarketDepth(restBaseURL, args[0], depthLimit, depthGrouping)
+	},
+}
+
+func queryMarketDepth(url, market string, limit int, grouping string) error {
+	params := neturl.Values{}
+	params.Set("limit", strconv.Itoa(limit))
+	if grouping != "" {
+		params.Set("grouping", grouping)
+	}
+	// send the request
+	code, data, err := helpers.Get(fmt.Sprint(url, "/query/markets/", market, "/depth?", params.Encode()))
+	if err != nil {
+		println("error getting depth:", err)
+		return err
+	}
+	var rsp struct {
+		Depth *model.MarketDepth `json:"depth"`
+	}
+	if code != http.StatusOK || json.Unmarshal([]byte(data), &rsp) != nil || rsp.Depth == nil {
+		helpers.PrintResponse(code, data)
+		return nil
+	}
+	printDepth(os.Stdout, rsp.Depth)
+	return nil
+}
+
+// printDepth renders the price levels of a market as a table,
+// the asks are printed above the bids with the best prices next to the spread
+func printDepth(w io.Writer, depth *model.MarketDepth) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "SIDE\tPRICE\tSIZE\tORDERS\t")
+	for i := len(depth.Asks) - 1; i >= 0; i-- {
+		l := depth.Asks[i]
+		fmt.Fprintf(tw, "ask\t%s\t%s\t%d\t\n", l.Price, l.Size, l.Orders)
+	}
+	fmt.Fprintln(tw, "\t\t\t\t")
+	for _, l := range depth.Bids {
+		fmt.Fprintf(tw, "bid\t%s\t%s\t%d\t\n", l.Price, l.Size, l.Orders)
+	}
+	tw.Flush()
+}
+
+var queryMarketTradesCmd = &cobra.Command{
+	Use:     "trades <market-address>",
+	Short:   "Get the trades of a market, with their fees",
+	Args:    cobra.ExactArgs(1),
+	Example: `authex query trades 0x123...`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return queryMarketTrades(restBaseURL, args[0])
+	},
+}
+
+func queryMarketTrades(url, market string) error {
+	// send the request
+	code, data, err := helpers.Get(fmt.Sprint(url, "/query/markets/", market, "/trades"))
+	if err != nil {
+		println("error getting trades:", err)
+		return err
+	}
+	helpers.PrintResponse(code, data)
+	return nil
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"authex/model"
+	"bytes"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPrintDepth tests that the best prices are printed next to the spread
+func TestPrintDepth(t *testing.T) {
+	level := func(price, size string, orders int) model.PriceLevel {
+		return model.PriceLevel{Price: decimal.RequireFromString(price), Size: decimal.RequireFromString(size), Orders: orders}
+	}
+	tests := []struct {
+		name  string
+		depth *model.MarketDepth
+		want  string
+	}{
+		{
+			name:  "empty book",
+			depth: &model.MarketDepth{},
+			want: "  SIDE  PRICE  SIZE  ORDERS\n" +
+				"                           \n",
+		},
+		{
+			name: "asks above the bids",
+			depth: &model.MarketDepth{
+				Asks: []model.PriceLevel{level("2.1", "5", 1), level("2.25", "120.5", 12)},
+				Bids: []model.PriceLevel{level("1.95", "10", 2), level("1.8", "3", 1)},
+			},
+			want: "  SIDE  PRICE   SIZE  ORDERS\n" +
+				"   ask   2.25  120.5      12\n" +
+				"   ask    2.1      5       1\n" +
+				"                            \n" +
+				"   bid   1.95     10       2\n" +
+				"   bid    1.8      3       1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			printDepth(&out, tt.depth)
+			assert.Equal(t, tt.want, out.String())
+		})
+	}
+}
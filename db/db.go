@@ -4,7 +4,6 @@ import (
 	"authex/helpers"
 	"authex/model"
 	"context"
-	_ "embed"
 	"errors"
 	"fmt"
 	"sync"
@@ -19,9 +18,6 @@ import (
 	pgxdecimal "github.com/jackc/pgx-shopspring-decimal"
 )
 
-//go:embed schema.sql
-var dbSchema string
-
 var (
 	ErrConnection = errors.New("connection or tx error")
 	ErrInsert     = errors.New("insert error")
@@ -30,19 +26,47 @@ var (
 	ErrSelect     = errors.New("select error")
 )
 
+// Connection is the Postgres implementation of the storage
 type Connection struct {
-	pool      *pgxpool.Pool
-	Matches   chan *model.Match
-	Transfers chan *model.BalanceChange
+	pool          *pgxpool.Pool
+	matches       chan *model.Match
+	trades        chan *model.Trade
+	transfers     chan *model.BalanceChange
+	confirmations chan *model.Confirmation
+
+	// feeAccount is credited with the trading fees
+	feeAccount string
 }
 
 // Close the connection and all channels
 func (c *Connection) Close() {
-	close(c.Matches)
-	close(c.Transfers)
+	close(c.matches)
+	close(c.trades)
+	close(c.transfers)
+	close(c.confirmations)
 	c.pool.Close()
 }
 
+// Matches returns the channel of the matches to settle
+func (c *Connection) Matches() chan *model.Match {
+	return c.matches
+}
+
+// Trades returns the channel of the trades to settle
+func (c *Connection) Trades() chan *model.Trade {
+	return c.trades
+}
+
+// Transfers returns the channel of the deposits to credit
+func (c *Connection) Transfers() chan *model.BalanceChange {
+	return c.transfers
+}
+
+// Confirmations returns the channel of the blocks whose deposits are confirmed
+func (c *Connection) Confirmations() chan *model.Confirmation {
+	return c.confirmations
+}
+
 func NewConnection(options *model.Settings) (*Connection, error) {
 	pool, err := pgxpool.New(context.Background(), options.DB.URI)
 	pool.Config().AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
@@ -54,9 +78,12 @@ func NewConnection(options *model.Settings) (*Connection, error) {
 		return nil, err
 	}
 	return &Connection{
-		pool:      pool,
-		Matches:   make(chan *model.Match),
-		Transfers: make(chan *model.BalanceChange),
+		pool:          pool,
+		matches:       make(chan *model.Match),
+		trades:        make(chan *model.Trade),
+		transfers:     make(chan *model.BalanceChange),
+		confirmations: make(chan *model.Confirmation),
+		feeAccount:    options.Fees.Account,
 	}, nil
 }
 
@@ -66,57 +93,117 @@ func (c *Connection) Run() {
 	wg.Add(2)
 	defer wg.Wait()
 
-	// handle ERC20 transfers
+	// handle ERC20 transfers and their confirmations, in the order they are sent
+	// by the node client so that a deposit is recorded before it's confirmed
 	go func() {
-		for {
-			t, ok := <-c.Transfers
-			if !ok {
-				wg.Done()
-				log.Debugf("closing balance handler")
-				break
-			}
-			tx, err := c.pool.BeginTx(context.Background(), pgx.TxOptions{})
-			if err != nil {
-				log.Errorf("error starting transaction: %v", err)
-			}
-			q := `INSERT INTO balances (address, asset_address, balance) VALUES ($1, $2, $3) ON CONFLICT (address, asset_address) DO UPDATE SET balance = balances.balance + $3`
-			for _, delta := range t.Deltas {
-				if _, err = tx.Exec(context.Background(), q, delta.Address, t.TokenAddress, delta.Amount); err != nil {
-					log.Errorf("error updating the recipient balance: %v", err)
-					if err = tx.Rollback(context.Background()); err != nil {
-						log.Warnf("tx rollback error: %v", err)
-					}
-					break
+		defer wg.Done()
+		transfers, confirmations := c.transfers, c.confirmations
+		for transfers != nil || confirmations != nil {
+			select {
+			case t, ok := <-transfers:
+				if !ok {
+					log.Debugf("closing balance handler")
+					transfers = nil
+					continue
 				}
-			}
-			// update token block number
-			if _, err = tx.Exec(context.Background(), "UPDATE assets SET last_block = $1 WHERE address = $2", t.BlockNumber, t.TokenAddress); err != nil {
-				log.Errorf("error updating the asset block number: %v", err)
-				if err = tx.Rollback(context.Background()); err != nil {
-					log.Warnf("tx rollback error: %v", err)
+				c.handleTransfer(t)
+			case cf, ok := <-confirmations:
+				if !ok {
+					log.Debugf("closing confirmation handler")
+					confirmations = nil
+					continue
 				}
-				break
-			}
-			if err = tx.Commit(context.Background()); err != nil {
-				log.Warnf("tx commit error: %v", err)
+				c.handleConfirmation(cf)
 			}
 		}
 	}()
 
-	// handle CLOB matches
+	// handle CLOB matches and trades, in the order they are sent by the
+	// matching engine so that the holds of an order are settled before it's closed
 	go func() {
-		for {
-			match, ok := <-c.Matches
-			if !ok {
-				wg.Done()
-				log.Debugf("closing match handler")
-				break
+		defer wg.Done()
+		matches, trades := c.matches, c.trades
+		for matches != nil || trades != nil {
+			select {
+			case match, ok := <-matches:
+				if !ok {
+					log.Debugf("closing match handler")
+					matches = nil
+					continue
+				}
+				c.handleMatch(match)
+			case trade, ok := <-trades:
+				if !ok {
+					log.Debugf("closing trade handler")
+					trades = nil
+					continue
+				}
+				c.handleTrade(trade)
 			}
-			c.handleMatch(match)
 		}
 	}()
 }
 
+// handleTransfer records the deposits of a block, they are credited to the available
+// balance of the recipients once confirmed. The transfers on chain are recorded once even
+// if their log is delivered again, and reversed if their log is removed by a reorganization.
+func (c *Connection) handleTransfer(t *model.BalanceChange) {
+	tx, err := c.pool.BeginTx(context.Background(), pgx.TxOptions{})
+	if err != nil {
+		log.Errorf("error starting transaction: %v", err)
+		return
+	}
+	defer txRollback(tx)
+	switch {
+	case t.Removed:
+		err = reverseDeposit(tx, t)
+	case t.IsOnChain():
+		err = recordDeposit(tx, t)
+	default:
+		for _, delta := range t.Deltas {
+			legs := []model.LedgerLeg{
+				available(delta.Address, t.TokenAddress, "", delta.Amount),
+				external(delta.Address, t.TokenAddress, delta.Amount.Neg()),
+			}
+			if err = post(tx, model.LedgerFunding, "", legs...); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Errorf("error updating the recipient balance: %v", err)
+		return
+	}
+	// update token block number
+	if t.IsOnChain() && !t.Removed {
+		q := `UPDATE assets SET last_block = GREATEST(last_block, $1) WHERE address = $2`
+		if _, err = tx.Exec(context.Background(), q, t.BlockNumber, t.TokenAddress); err != nil {
+			log.Errorf("error updating the asset block number: %v", err)
+			return
+		}
+	}
+	if err = tx.Commit(context.Background()); err != nil {
+		log.Warnf("tx commit error: %v", err)
+	}
+}
+
+// handleConfirmation credits the pending deposits of the confirmed blocks
+func (c *Connection) handleConfirmation(cf *model.Confirmation) {
+	tx, err := c.pool.BeginTx(context.Background(), pgx.TxOptions{})
+	if err != nil {
+		log.Errorf("error starting transaction: %v", err)
+		return
+	}
+	defer txRollback(tx)
+	if err = confirmDeposits(tx, cf); err != nil {
+		log.Errorf("error confirming the deposits: %v", err)
+		return
+	}
+	if err = tx.Commit(context.Background()); err != nil {
+		log.Warnf("tx commit error: %v", err)
+	}
+}
+
 func (c *Connection) handleMatch(m *model.Match) {
 	tx, err := c.pool.BeginTx(context.Background(), pgx.TxOptions{
 		IsoLevel: pgx.RepeatableRead,
@@ -128,110 +215,455 @@ func (c *Connection) handleMatch(m *model.Match) {
 	defer txRollback(tx)
 	// insert into matches
 	q := `INSERT INTO matches
-	(id, order_id, price, size, side, matched_at, status)
-	VALUES ($1, $2, $3, $4, $5, $6, $7)`
-	_, err = tx.Exec(context.Background(), q, m.ID, m.OrderID, m.Price, m.Size, m.Side, m.Time, m.Status)
+	(id, order_id, price, size, side, matched_at, status, reason)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	ON CONFLICT DO NOTHING`
+	tag, err := tx.Exec(context.Background(), q, m.ID, m.OrderID, m.Price, m.Size, m.Side, m.Time, m.Status, m.Reason)
 	if err != nil {
 		log.Errorf("error inserting match: %v", err)
 		return
 	}
-	// update orders
-	var balanceDelta decimal.Decimal
-	// update balances
-	switch m.Side {
-	case model.SideBid:
+	// matches are sent again when the clob is recovered from the journal
+	if tag.RowsAffected() == 0 {
+		log.Debugf("match %s for order %s already settled", m.ID, m.OrderID)
+		return
+	}
+	if err = updateOrderState(tx, m); err != nil {
+		log.Errorf("handleMatch - error updating the order state: %v", err)
+		return
+	}
+	// a triggered stop order is only recorded, the order is then matched as usual
+	if m.Status == model.StatusTriggered {
+		if err = tx.Commit(context.Background()); err != nil {
+			log.Warnf("handleMatch - tx commit error: %v", err)
+		}
+		return
+	}
+	// a repriced order is updated with the new price
+	if m.Status == model.StatusRepriced {
+		if err = repriceOrder(tx, m); err != nil {
+			log.Errorf("handleMatch - error repricing order: %v", err)
+			return
+		}
+		if err = tx.Commit(context.Background()); err != nil {
+			log.Warnf("handleMatch - tx commit error: %v", err)
+		}
+		return
+	}
+	// an amended order is updated with the new price and size
+	if m.Status == model.StatusAmended {
+		if err = amendOrder(tx, m); err != nil {
+			log.Errorf("handleMatch - error amending order: %v", err)
+			return
+		}
+		if err = tx.Commit(context.Background()); err != nil {
+			log.Warnf("handleMatch - tx commit error: %v", err)
+		}
+		return
+	}
+	// the filled quantity is settled by the trades
+	if m.Status == model.StatusPartial {
+		if err = tx.Commit(context.Background()); err != nil {
+			log.Warnf("handleMatch - tx commit error: %v", err)
+		}
+		return
+	}
+	// a decremented order releases the hold of the quantity removed from the book,
+	// a closed order (filled, cancelled, expired, rejected or prevented) releases
+	// what is left of its hold
+	var amount decimal.NullDecimal
+	if m.Status == model.StatusDecremented {
+		switch m.Side {
+		case model.SideBid:
+			amount = decimal.NewNullDecimal(m.Price.Mul(m.Size))
+		case model.SideAsk:
+			amount = decimal.NewNullDecimal(m.Size)
+		default:
+			log.Errorf("unknown side: %s", m.Side)
+			return
+		}
+	}
+	released, err := releaseHold(tx, m.OrderID, amount)
+	if err != nil {
+		log.Errorf("handleMatch - error releasing hold: %v", err)
+		return
+	}
+	log.Debugf("released %s for order id %s side %s status %s", released, m.OrderID, m.Side, m.Status)
+	if err = tx.Commit(context.Background()); err != nil {
+		log.Warnf("handleMatch - tx commit error: %v", err)
+	}
+}
 
-		q = `
-		WITH order_details AS (
-			SELECT o.from_address as _address, m.base_address as _base, m.quote_address as _quote
-			FROM orders o
-			JOIN markets m ON o.market_address = m.address
-			WHERE o.id = $1
-		  ),
-		  insert_quote_balance AS (
-			INSERT INTO balances (address, asset_address, balance)
-			SELECT _address, _quote, $2
-			FROM order_details
-			ON CONFLICT (address, asset_address) DO UPDATE SET balance = balances.balance + EXCLUDED.balance
-		  )
-		  SELECT 1; `
-		balanceDelta = m.Size
-		log.Debugf("update balances for order id %s side %s:  quote(%s)", m.OrderID, m.Side, balanceDelta)
-	case model.SideAsk:
-		q = `
-		WITH order_details AS (
-			SELECT o.from_address as _address, m.base_address as _base, m.quote_address as _quote
-			FROM orders o
-			JOIN markets m ON o.market_address = m.address
-			WHERE o.id = $1
-		),
-		insert_base_balance AS (
-			INSERT INTO balances (address, asset_address, balance)
-			SELECT _address, _base, $2
-			FROM order_details
-			ON CONFLICT (address, asset_address) DO UPDATE SET balance = balances.balance + EXCLUDED.balance
+// updateOrderState applies a match to the status and the remaining quantity of an order,
+// the filled quantity is updated by the trades
+func updateOrderState(tx pgx.Tx, m *model.Match) error {
+	switch m.Status {
+	case model.StatusTriggered:
+		return setOrderStatus(tx, m.OrderID, model.StatusOpen, "", m.Time)
+	case model.StatusAmended:
+		q := `UPDATE orders SET remaining = $2 WHERE id = $1 AND NOT (status = any($3))`
+		if _, err := tx.Exec(context.Background(), q, m.OrderID, m.Size, model.ClosedStatuses); err != nil {
+			return errors.Join(ErrUpdate, err)
+		}
+	case model.StatusDecremented:
+		q := `UPDATE orders SET remaining = GREATEST(remaining - $2, 0) WHERE id = $1 AND NOT (status = any($3))`
+		if _, err := tx.Exec(context.Background(), q, m.OrderID, m.Size, model.ClosedStatuses); err != nil {
+			return errors.Join(ErrUpdate, err)
+		}
+	case model.StatusFilled, model.StatusCancelled, model.StatusExpired, model.StatusRejected, model.StatusPrevented:
+		return setOrderStatus(tx, m.OrderID, m.Status, m.Reason, m.Time)
+	}
+	return nil
+}
+
+// setOrderStatus changes the status of an order and records the change in the history
+// of the order, closed orders keep their status and have no remaining quantity
+func setOrderStatus(tx pgx.Tx, orderID, status, reason string, at time.Time) error {
+	q := `
+	WITH changed AS (
+		UPDATE orders SET status = $2, remaining = CASE WHEN $2 = any($3) THEN 0 ELSE remaining END
+		WHERE id = $1 AND status <> $2 AND NOT (status = any($3))
+		RETURNING id
+	)
+	INSERT INTO order_history (order_id, status, reason, changed_at)
+	SELECT id, $2, $4, $5 FROM changed`
+	if _, err := tx.Exec(context.Background(), q, orderID, status, model.ClosedStatuses, reason, at); err != nil {
+		return errors.Join(ErrUpdate, err)
+	}
+	return nil
+}
+
+// fillOrder adds a trade to the filled quantity and to the average price of an order,
+// the order is filled when no quantity remains
+func fillOrder(tx pgx.Tx, orderID string, price, size decimal.Decimal, at time.Time) error {
+	var remaining decimal.Decimal
+	q := `
+	UPDATE orders SET filled = filled + $3,
+		average_price = (average_price * filled + $2 * $3) / (filled + $3),
+		remaining = GREATEST(remaining - $3, 0)
+	WHERE id = $1
+	RETURNING remaining`
+	if err := tx.QueryRow(context.Background(), q, orderID, price, size).Scan(&remaining); err != nil {
+		return errors.Join(ErrUpdate, err)
+	}
+	status := model.StatusPartial
+	if remaining.IsZero() {
+		status = model.StatusFilled
+	}
+	return setOrderStatus(tx, orderID, status, "", at)
+}
+
+// releaseHold moves an amount locked by an order back to the available balance
+// of the account, the whole remaining hold is released if the amount is null.
+// It returns the amount released.
+func releaseHold(tx pgx.Tx, orderID string, amount decimal.NullDecimal) (released decimal.Decimal, err error) {
+	var address, asset string
+	q := `SELECT address, asset_address, amount FROM holds WHERE order_id = $1 FOR UPDATE`
+	if err = tx.QueryRow(context.Background(), q, orderID).Scan(&address, &asset, &released); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return decimal.Zero, nil
+		}
+		return released, errors.Join(ErrSelect, err)
+	}
+	if amount.Valid && amount.Decimal.LessThan(released) {
+		released = amount.Decimal
+	}
+	legs := []model.LedgerLeg{
+		held(address, asset, orderID, released.Neg()),
+		available(address, asset, orderID, released),
+	}
+	return released, post(tx, model.LedgerRelease, orderID, legs...)
+}
+
+// spendHold returns the ledger legs that take from the hold of an order the amount spent
+// in a trade of the given size, bid orders hold the amount at the limit (or protection) price
+// and the price improvement is released to the available balance. The amount not covered
+// by the hold is taken from the available balance.
+func spendHold(tx pgx.Tx, orderID string, size, spent decimal.Decimal) ([]model.LedgerLeg, error) {
+	var (
+		address, asset string
+		reserve, taken decimal.Decimal
+	)
+	q := `
+	SELECT o.from_address, CASE WHEN trim(o.side) = 'bid' THEN m.base_address ELSE m.quote_address END,
+		CASE WHEN trim(o.side) = 'bid' THEN COALESCE(NULLIF(o.price, 0), o.protection_price, 0) ELSE 0 END
+	FROM orders o JOIN markets m ON m.address = o.market_address
+	WHERE o.id = $1`
+	if err := tx.QueryRow(context.Background(), q, orderID).Scan(&address, &asset, &reserve); err != nil {
+		return nil, errors.Join(ErrSelect, err)
+	}
+	q = `SELECT COALESCE((SELECT amount FROM holds WHERE order_id = $1 FOR UPDATE), 0)`
+	if err := tx.QueryRow(context.Background(), q, orderID).Scan(&taken); err != nil {
+		return nil, errors.Join(ErrSelect, err)
+	}
+	needed := spent
+	if reserve.IsPositive() {
+		needed = reserve.Mul(size)
+	}
+	taken = decimal.Min(taken, needed)
+	return []model.LedgerLeg{
+		held(address, asset, orderID, taken.Neg()),
+		available(address, asset, orderID, taken.Sub(spent)),
+	}, nil
+}
+
+// repriceOrder sets the new price of a post only order, for bid orders
+// the difference with the amount held when the order was placed is
+// released to the account
+func repriceOrder(tx pgx.Tx, m *model.Match) error {
+	var oldPrice decimal.Decimal
+	q := `
+	WITH old AS (
+		SELECT price FROM orders WHERE id = $1 FOR UPDATE
+	),
+	update_order AS (
+		UPDATE orders SET price = $2 WHERE id = $1
+	)
+	SELECT price FROM old`
+	if err := tx.QueryRow(context.Background(), q, m.OrderID, m.Price).Scan(&oldPrice); err != nil {
+		return errors.Join(ErrUpdate, err)
+	}
+	if m.Side != model.SideBid {
+		return nil
+	}
+	_, err := releaseHold(tx, m.OrderID, decimal.NewNullDecimal(oldPrice.Sub(m.Price).Mul(m.Size)))
+	return err
+}
+
+// amendOrder sets the new price and open size of an amended order, the size of the order
+// becomes the quantity already filled plus the new open size. The hold of the order is set
+// to the amount needed by the new open size.
+func amendOrder(tx pgx.Tx, m *model.Match) error {
+	q := `
+	UPDATE orders o SET price = $2, size = $3 + COALESCE((
+		SELECT sum(m.size) FROM matches m WHERE m.order_id = o.id AND m.status = any($4)
+	), 0)
+	WHERE o.id = $1`
+	if _, err := tx.Exec(context.Background(), q, m.OrderID, m.Price, m.Size, model.ReducedStatuses); err != nil {
+		return errors.Join(ErrUpdate, err)
+	}
+	held := m.Size
+	if m.Side == model.SideBid {
+		held = m.Price.Mul(m.Size)
+	}
+	return setHold(tx, m.OrderID, held)
+}
+
+// setHold sets the amount held by an order, the difference with
+// the current hold is moved from (or to) the available balance
+func setHold(tx pgx.Tx, orderID string, amount decimal.Decimal) error {
+	var (
+		address, asset string
+		current        decimal.Decimal
+	)
+	q := `SELECT address, asset_address, amount FROM holds WHERE order_id = $1 FOR UPDATE`
+	if err := tx.QueryRow(context.Background(), q, orderID).Scan(&address, &asset, &current); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return errors.Join(ErrSelect, err)
+	}
+	legs := []model.LedgerLeg{
+		held(address, asset, orderID, amount.Sub(current)),
+		available(address, asset, orderID, current.Sub(amount)),
+	}
+	return post(tx, model.LedgerAmend, orderID, legs...)
+}
+
+// handleTrade settles a trade in one transaction: the bid order receives the quote asset
+// and the ask order the base asset, the assets given in exchange are taken from the
+// holds placed with the orders
+func (c *Connection) handleTrade(t *model.Trade) {
+	tx, err := c.pool.BeginTx(context.Background(), pgx.TxOptions{
+		IsoLevel: pgx.RepeatableRead,
+	})
+	if err != nil {
+		log.Errorf("error starting transaction: %v", err)
+		return
+	}
+	defer txRollback(tx)
+	q := `INSERT INTO trades
+	(market_address, sequence, maker_order_id, taker_order_id, price, size, aggressor_side, traded_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	ON CONFLICT DO NOTHING`
+	tag, err := tx.Exec(context.Background(), q, t.Market, t.Sequence, t.MakerOrderID, t.TakerOrderID, t.Price, t.Size, t.AggressorSide, t.Time)
+	if err != nil {
+		log.Errorf("handleTrade - error inserting trade: %v", err)
+		return
+	}
+	// trades are sent again when the clob is recovered from the journal
+	if tag.RowsAffected() == 0 {
+		log.Debugf("trade %s:%d already settled", t.Market, t.Sequence)
+		return
+	}
+	// no fees are charged without a fee account
+	var fees model.MarketFees
+	if c.feeAccount != "" {
+		if fees, err = marketFees(tx, t.Market); err != nil {
+			log.Errorf("handleTrade - error getting the market fees: %v", err)
+			return
+		}
+	}
+	var legs []model.LedgerLeg
+	for _, o := range []struct {
+		id, side string
+		maker    bool
+		fee      *decimal.Decimal
+	}{{t.MakerOrderID, t.MakerSide(), true, &t.MakerFee}, {t.TakerOrderID, t.AggressorSide, false, &t.TakerFee}} {
+		// bid orders give the base asset and receive the quote asset
+		spent, received := t.Price.Mul(t.Size), t.Size
+		if o.side == model.SideAsk {
+			spent, received = t.Size, t.Price.Mul(t.Size)
+		}
+		if err = fillOrder(tx, o.id, t.Price, t.Size, t.Time); err != nil {
+			log.Errorf("handleTrade - error filling order: %v", err)
+			return
+		}
+		spentLegs, sErr := spendHold(tx, o.id, t.Size, spent)
+		if sErr != nil {
+			log.Errorf("handleTrade - error spending hold: %v", sErr)
+			return
+		}
+		legs = append(legs, spentLegs...)
+		// the fee is taken from the received asset
+		if c.feeAccount != "" {
+			volume, vErr := tradedVolume(tx, o.id, t)
+			if vErr != nil {
+				log.Errorf("handleTrade - error getting the traded volume: %v", vErr)
+				return
+			}
+			maker, taker := fees.Rates(volume)
+			rate := taker
+			if o.maker {
+				rate = maker
+			}
+			*o.fee = received.Mul(rate)
+		}
+		owner, asset, rErr := receivedAsset(tx, o.id)
+		if rErr != nil {
+			log.Errorf("handleTrade - error getting the received asset: %v", rErr)
+			return
+		}
+		log.Debugf("update balances for order id %s side %s trade %d: %s %s fee %s", o.id, o.side, t.Sequence, received, asset, o.fee)
+		legs = append(legs,
+			available(owner, asset, o.id, received.Sub(*o.fee)),
+			available(c.feeAccount, asset, "", *o.fee),
 		)
-		SELECT 1; `
-		balanceDelta = m.Price.Mul(m.Size)
-		log.Debugf("update balances for order id %s side %s:  base(%s)", m.OrderID, m.Side, balanceDelta)
-	default:
-		log.Errorf("unknown side: %s", m.Side)
+	}
+	if err = post(tx, model.LedgerTrade, fmt.Sprintf("%s:%d", t.Market, t.Sequence), legs...); err != nil {
+		log.Errorf("handleTrade - error updating balances: %v", err)
 		return
 	}
-
-	if _, err = tx.Exec(context.Background(), q, m.OrderID, balanceDelta); err != nil {
-		log.Errorf("handleMatch - error updating balance: %v", err)
+	q = `UPDATE trades SET maker_fee = $3, taker_fee = $4 WHERE market_address = $1 AND sequence = $2`
+	if _, err = tx.Exec(context.Background(), q, t.Market, t.Sequence, t.MakerFee, t.TakerFee); err != nil {
+		log.Errorf("handleTrade - error recording the fees: %v", err)
+		return
 	}
 	if err = tx.Commit(context.Background()); err != nil {
-		log.Warnf("handleMatch - tx commit error: %v", err)
+		log.Warnf("handleTrade - tx commit error: %v", err)
 	}
 }
 
-// Setup the database, open a connection and create the database schema
-func Setup(options *model.Settings, force bool) error {
-	conn, err := pgx.Connect(context.Background(), options.DB.URI)
+// receivedAsset returns the owner of an order and the asset it receives in the trades,
+// bid orders receive the quote asset and ask orders the base asset
+func receivedAsset(tx pgx.Tx, orderID string) (owner, asset string, err error) {
+	q := `
+	SELECT o.from_address, CASE WHEN trim(o.side) = 'bid' THEN m.quote_address ELSE m.base_address END
+	FROM orders o JOIN markets m ON m.address = o.market_address
+	WHERE o.id = $1`
+	if err = tx.QueryRow(context.Background(), q, orderID).Scan(&owner, &asset); err != nil {
+		return owner, asset, errors.Join(ErrSelect, err)
+	}
+	return owner, asset, nil
+}
+
+// marketFees returns the fee rates of a market, including the volume based tiers
+func marketFees(tx pgx.Tx, market string) (fees model.MarketFees, err error) {
+	q := `SELECT maker_fee, taker_fee FROM markets WHERE address = $1`
+	if err = tx.QueryRow(context.Background(), q, market).Scan(&fees.MakerFee, &fees.TakerFee); err != nil {
+		return fees, errors.Join(ErrSelect, err)
+	}
+	tiers, err := feeTiers(tx, market)
 	if err != nil {
-		return errors.Join(ErrConnection, err)
+		return fees, err
 	}
-	defer conn.Close(context.Background())
-	return createSchema(conn, force)
+	fees.FeeTiers = tiers[market]
+	return fees, nil
 }
 
-func (c *Connection) InitializeSchema() error {
-	conn, err := c.pool.Acquire(context.Background())
+// feeTiers returns the fee tiers of a market, or of all the markets
+// if the market is empty, grouped by market
+func feeTiers(q queryer, market string) (map[string][]model.FeeTier, error) {
+	rows, err := q.Query(context.Background(), `
+	SELECT market_address, min_volume, maker_fee, taker_fee
+	FROM fee_tiers
+	WHERE $1 = '' OR market_address = $1
+	ORDER BY market_address, min_volume`, market)
 	if err != nil {
-		return errors.Join(ErrConnection, err)
+		return nil, errors.Join(ErrSelect, err)
 	}
-	defer conn.Release()
-	if err = createSchema(conn.Conn(), false); err != nil {
-		return errors.Join(ErrInsert, err)
+	defer rows.Close()
+	tiers := make(map[string][]model.FeeTier)
+	for rows.Next() {
+		var (
+			address string
+			t       model.FeeTier
+		)
+		if err = rows.Scan(&address, &t.MinVolume, &t.MakerFee, &t.TakerFee); err != nil {
+			return nil, errors.Join(ErrSelect, err)
+		}
+		tiers[address] = append(tiers[address], t)
 	}
-	return nil
+	return tiers, nil
+}
+
+// tradedVolume returns the value (price times size) traded by the account of an order
+// in the market of a trade, in the 30 days before the trade
+func tradedVolume(tx pgx.Tx, orderID string, t *model.Trade) (volume decimal.Decimal, err error) {
+	q := `
+	SELECT COALESCE(sum(t.price * t.size), 0)
+	FROM trades t JOIN orders o ON o.id IN (t.maker_order_id, t.taker_order_id)
+	WHERE t.market_address = $2 AND t.traded_at > $3::timestamp - interval '30 days' AND t.traded_at <= $3
+	AND t.sequence <> $4
+	AND o.from_address = (SELECT from_address FROM orders WHERE id = $1)`
+	if err = tx.QueryRow(context.Background(), q, orderID, t.Market, t.Time, t.Sequence).Scan(&volume); err != nil {
+		return volume, errors.Join(ErrSelect, err)
+	}
+	return volume, nil
+}
+
+// queryer runs queries on a connection pool or in a transaction
+type queryer interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
 }
 
-// createSchema creates the database schema, optionally overwriting it
-func createSchema(conn *pgx.Conn, overwrite bool) error {
-	// check if the schema exists
-	var schemaExists bool
-	q := `SELECT EXISTS (
-		SELECT 1 FROM information_schema.tables
-		WHERE table_schema = 'public' AND table_name = 'markets');`
-	err := conn.QueryRow(context.Background(), q).Scan(&schemaExists)
+// Setup the database, open a connection and apply the schema migrations,
+// the schema is dropped and created again if force is set
+func Setup(options *model.Settings, force bool) error {
+	m, err := NewMigrator(options)
 	if err != nil {
-		return errors.Join(ErrSelect, err)
+		return err
 	}
-	if schemaExists && !overwrite {
-		return nil
+	defer m.Close()
+	if force {
+		return m.Reset()
 	}
-	_, err = conn.Exec(context.Background(), dbSchema)
+	return m.Up(0)
+}
+
+// InitializeSchema applies the pending schema migrations, it fails
+// if the database schema is newer than the one supported
+func (c *Connection) InitializeSchema() error {
+	conn, err := c.pool.Acquire(context.Background())
 	if err != nil {
-		return errors.Join(ErrInsert, err)
+		return errors.Join(ErrConnection, err)
 	}
-	return nil
+	defer conn.Release()
+	return (&Migrator{conn: conn.Conn()}).Up(0)
 }
 
 // SaveMarket saves a market to the database
-func (c *Connection) SaveMarket(marketAddress string, base, quote *model.Asset) error {
+func (c *Connection) SaveMarket(marketAddress string, base, quote *model.Asset, rules model.MarketRules, fees model.MarketFees) error {
 	tx, err := c.pool.BeginTx(context.Background(), pgx.TxOptions{})
 	if err != nil {
 		return err
@@ -246,23 +678,41 @@ func (c *Connection) SaveMarket(marketAddress string, base, quote *model.Asset)
 		}
 	}
 	_, err = tx.Exec(context.Background(),
-		`INSERT INTO markets (address, base_address, quote_address, recorded_at)
-		VALUES ($1, $2, $3, $4)`, marketAddress, base.Address, quote.Address, time.Now().UTC())
+		`INSERT INTO markets (address, base_address, quote_address, recorded_at, self_trade_prevention, tick_size, lot_size, min_size, min_notional, maker_fee, taker_fee)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`, marketAddress, base.Address, quote.Address, time.Now().UTC(),
+		rules.SelfTradePrevention, rules.TickSize, rules.LotSize, rules.MinSize, rules.MinNotional, fees.MakerFee, fees.TakerFee)
 	if err != nil {
 		return errors.Join(ErrInsert, err)
 	}
+	q = `INSERT INTO fee_tiers (market_address, min_volume, maker_fee, taker_fee) VALUES ($1, $2, $3, $4)`
+	for _, t := range fees.FeeTiers {
+		if _, err = tx.Exec(context.Background(), q, marketAddress, t.MinVolume, t.MakerFee, t.TakerFee); err != nil {
+			return errors.Join(ErrInsert, err)
+		}
+	}
 	if err = tx.Commit(context.Background()); err != nil {
 		return errors.Join(ErrConnection, err)
 	}
 	return nil
 }
 
-// UpdateBalance updates the balance of an asset for an address
+// UpdateBalance updates the balance of an asset for an address,
+// the funding is recorded in the ledger
 func (c *Connection) UpdateBalance(address, asset string, delta decimal.Decimal) error {
-	q := `INSERT INTO balances (address, asset_address, balance) VALUES ($1, $2, $3)
-	ON CONFLICT (address, asset_address) DO UPDATE SET balance =   balances.balance + EXCLUDED.balance`
-	if _, err := c.pool.Exec(context.Background(), q, address, asset, delta); err != nil {
-		return errors.Join(ErrUpsert, err)
+	tx, err := c.pool.Begin(context.Background())
+	if err != nil {
+		return errors.Join(ErrConnection, err)
+	}
+	defer txRollback(tx)
+	legs := []model.LedgerLeg{
+		available(address, asset, "", delta),
+		external(address, asset, delta.Neg()),
+	}
+	if err = post(tx, model.LedgerFunding, "", legs...); err != nil {
+		return err
+	}
+	if err = tx.Commit(context.Background()); err != nil {
+		return errors.Join(ErrConnection, err)
 	}
 	return nil
 }
@@ -271,7 +721,8 @@ func (c *Connection) UpdateBalance(address, asset string, delta decimal.Decimal)
 func (c *Connection) GetMarkets() ([]*model.MarketInfo, error) {
 	var markets = make([]*model.MarketInfo, 0)
 	q := `
-select m.address, m.recorded_at,
+select m.address, m.recorded_at, trim(m.self_trade_prevention), m.tick_size, m.lot_size, m.min_size, m.min_notional,
+m.maker_fee, m.taker_fee,
 b.symbol bs, b.address ba, b.class bt,
 q.symbol qs, q.address qa, q.class qt
 from markets m join assets b on (m.base_address = b.address)
@@ -286,6 +737,8 @@ order by m.recorded_at desc`
 		var market model.MarketInfo
 		if err = rows.Scan(
 			&market.Address, &market.RecordedAt,
+			&market.SelfTradePrevention, &market.TickSize, &market.LotSize, &market.MinSize, &market.MinNotional,
+			&market.MakerFee, &market.TakerFee,
 			&market.Base.Symbol, &market.Base.Address, &market.Base.Class,
 			&market.Quote.Symbol, &market.Quote.Address, &market.Quote.Class,
 		); err != nil {
@@ -293,6 +746,14 @@ order by m.recorded_at desc`
 		}
 		markets = append(markets, &market)
 	}
+	rows.Close()
+	tiers, err := feeTiers(c.pool, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range markets {
+		m.FeeTiers = tiers[m.Address]
+	}
 	return markets, nil
 }
 
@@ -300,7 +761,8 @@ order by m.recorded_at desc`
 func (c *Connection) GetMarketByAddress(address string) (*model.MarketInfo, error) {
 	var market model.MarketInfo
 	q := `
-select m.address, m.recorded_at,
+select m.address, m.recorded_at, trim(m.self_trade_prevention), m.tick_size, m.lot_size, m.min_size, m.min_notional,
+m.maker_fee, m.taker_fee,
 b.symbol bs, b.address ba, b.class bt,
 q.symbol qs, q.address qa, q.class qt
 from markets m join assets b on (m.base_address = b.address)
@@ -308,12 +770,19 @@ join assets q on (m.quote_address = q.address)
 where m.address = $1`
 	err := c.pool.QueryRow(context.Background(), q, address).Scan(
 		&market.Address, &market.RecordedAt,
+		&market.SelfTradePrevention, &market.TickSize, &market.LotSize, &market.MinSize, &market.MinNotional,
+		&market.MakerFee, &market.TakerFee,
 		&market.Base.Symbol, &market.Base.Address, &market.Base.Class,
 		&market.Quote.Symbol, &market.Quote.Address, &market.Quote.Class,
 	)
 	if err != nil {
 		return nil, errors.Join(ErrSelect, err)
 	}
+	tiers, err := feeTiers(c.pool, address)
+	if err != nil {
+		return nil, err
+	}
+	market.FeeTiers = tiers[address]
 	return &market, nil
 }
 
@@ -325,6 +794,24 @@ func (c *Connection) IsAuthorized(address string) (active bool) {
 	return
 }
 
+// GetAssetBlocks returns the first block of a token and the last block with a transfer recorded
+func (c *Connection) GetAssetBlocks(address string) (first, last uint64, err error) {
+	q := `SELECT first_block, last_block FROM assets WHERE address = $1`
+	if err = c.pool.QueryRow(context.Background(), q, address).Scan(&first, &last); err != nil {
+		return 0, 0, errors.Join(ErrSelect, err)
+	}
+	return first, last, nil
+}
+
+// SetAssetFirstBlock sets the first block of a token, if it is not set yet
+func (c *Connection) SetAssetFirstBlock(address string, block uint64) error {
+	q := `UPDATE assets SET first_block = $1 WHERE address = $2 AND first_block = 0`
+	if _, err := c.pool.Exec(context.Background(), q, block, address); err != nil {
+		return errors.Join(ErrUpdate, err)
+	}
+	return nil
+}
+
 // GetTokenAddresses returns the list of tokens addresses currently in the database
 func (c *Connection) GetAssetAddressesByClass(class string) ([]string, error) {
 	rows, err := c.pool.Query(context.Background(), "SELECT address FROM assets WHERE class = $1", class)
@@ -351,16 +838,11 @@ func (c *Connection) ValidateOrder(order *model.Order, from string, quote decima
 	if err != nil {
 		return fmt.Errorf("market not found")
 	}
-
-	var price decimal.Decimal
-	if quote.IsZero() { // it's a limit order, calculate the total amount
-		if price, err = helpers.ParseAmount(order.Price); err != nil {
-			return fmt.Errorf("invalid price")
-		}
+	price, targetAsset, balanceDelta, err := orderHold(market, order, quote)
+	if err != nil {
+		return err
 	}
 
-	size := decimal.NewFromInt(int64(order.Size))
-
 	// open a transaction
 	tx, err := c.pool.Begin(context.Background())
 	if err != nil {
@@ -368,47 +850,211 @@ func (c *Connection) ValidateOrder(order *model.Order, from string, quote decima
 	}
 	defer txRollback(tx)
 
-	var (
-		targetAsset  string
-		balanceDelta decimal.Decimal
-		newBalance   decimal.Decimal
-	)
+	// populate the order ID and RecordedAt
+	order.ID = uuid.New().String()
+
+	// if all is good insert the order
+	// stop orders wait for their trigger
+	status := model.StatusOpen
+	if order.IsStop() {
+		status = model.StatusPending
+	}
+	q := `INSERT INTO orders (id, market_address, from_address, side, price, size, recorded_at, submitted_at, time_in_force, expires_at, post_only, reprice, stop_price, display_size, self_trade_prevention, protection_price, status, remaining)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $6)`
+	_, err = tx.Exec(context.Background(), q, order.ID, market.Address, from, order.Side, price, order.Size, order.RecordedAt, order.SubmittedAt,
+		order.GetTimeInForce(), nullTime(order.ExpiresAt), order.PostOnly, order.Reprice, nullDecimal(order.StopPrice), order.DisplaySize, order.SelfTradePrevention,
+		nullDecimal(order.ProtectionPrice), status)
+	if err != nil {
+		return errors.Join(ErrInsert, err)
+	}
+	q = `INSERT INTO order_history (order_id, status, changed_at) VALUES ($1, $2, $3)`
+	if _, err = tx.Exec(context.Background(), q, order.ID, status, order.RecordedAt); err != nil {
+		return errors.Join(ErrInsert, err)
+	}
+	// lock the debited amount until the order is filled or closed
+	legs := []model.LedgerLeg{
+		available(from, targetAsset, order.ID, balanceDelta.Neg()),
+		held(from, targetAsset, order.ID, balanceDelta),
+	}
+	if err = post(tx, model.LedgerHold, order.ID, legs...); err != nil {
+		return err
+	}
+	if err = checkBalance(tx, from, targetAsset); err != nil {
+		return err
+	}
+	if err = tx.Commit(context.Background()); err != nil {
+		return errors.Join(ErrConnection, err)
+	}
+	return nil
+}
 
+// orderHold checks an order against the rules of its market and returns the limit
+// price of the order, zero for market orders, and the asset and the amount to hold
+// until the order is filled or closed
+func orderHold(market *model.MarketInfo, order *model.Order, quote decimal.Decimal) (price decimal.Decimal, asset string, amount decimal.Decimal, err error) {
+	if err = market.ValidateOrder(*order); err != nil {
+		return
+	}
+	var reserve decimal.Decimal
+	if !order.IsMarket() { // it's a limit order, calculate the total amount
+		if price, err = helpers.ParseAmount(order.Price); err != nil {
+			err = fmt.Errorf("invalid price")
+			return
+		}
+		reserve = price
+	} else {
+		// market orders, stop market orders included, reserve the funds at their protection price
+		if reserve, err = helpers.ParseAmount(order.ProtectionPrice); err != nil {
+			err = fmt.Errorf("invalid protection price")
+			return
+		}
+		// stop market orders are quoted when they are triggered
+		if !order.IsStop() {
+			if err = market.ValidateNotional(quote); err != nil {
+				return
+			}
+		}
+	}
 	switch order.Side {
 	case model.SideBid:
-		targetAsset = market.Base.Address
-		balanceDelta = price.Mul(size)
+		asset, amount = market.Base.Address, reserve.Mul(order.Size)
 	case model.SideAsk:
-		targetAsset = market.Quote.Address
-		balanceDelta = size
+		asset, amount = market.Quote.Address, order.Size
 	default:
-		return fmt.Errorf("invalid order side")
+		err = fmt.Errorf("invalid order side")
 	}
+	return
+}
 
-	q := `UPDATE balances SET balance = balance - $1 WHERE address = $2 AND asset_address = $3 returning balance`
-	err = tx.QueryRow(context.Background(), q, balanceDelta, from, targetAsset).Scan(&newBalance)
+// ValidateAmendment checks an amendment of an open order against the market rules and
+// adds to the hold of the order the funds needed by the new price and size. Bids hold
+// the new open size at the higher of the old and the new price until the amendment is
+// processed, then the hold is adjusted to the new price. It populates the amendment ID.
+func (c *Connection) ValidateAmendment(amendment, order *model.Order) error {
+	market, err := c.GetMarketByAddress(order.Market)
 	if err != nil {
-		return errors.Join(ErrUpdate, err)
+		return fmt.Errorf("market not found")
 	}
-	if newBalance.IsNegative() {
-		return fmt.Errorf("insufficient %s balance", targetAsset)
+	remaining, _, err := c.GetOrderRemaining(order.ID)
+	if err != nil {
+		return err
+	}
+	needed, err := amendmentHold(market, amendment, order, remaining)
+	if err != nil {
+		return err
 	}
 
-	// populate the order ID and RecordedAt
-	order.ID = uuid.New().String()
-
-	// if all is good insert the order
-	q = `INSERT INTO orders (id, market_address, from_address, side, price, size, recorded_at, submitted_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
-	_, err = tx.Exec(context.Background(), q, order.ID, market.Address, from, order.Side, price, order.Size, order.RecordedAt, order.SubmittedAt)
+	tx, err := c.pool.Begin(context.Background())
 	if err != nil {
-		return errors.Join(ErrInsert, err)
+		return errors.Join(ErrConnection, err)
+	}
+	defer txRollback(tx)
+
+	// the order is locked so that it cannot be closed meanwhile,
+	// orders that hold nothing have no hold
+	var (
+		current     decimal.Decimal
+		from, asset string
+		closed      bool
+	)
+	q := `
+	SELECT COALESCE(h.amount, 0), o.from_address,
+		CASE WHEN trim(o.side) = 'bid' THEN m.base_address ELSE m.quote_address END,
+		o.status = any($2)
+	FROM orders o JOIN markets m ON m.address = o.market_address
+	LEFT JOIN holds h ON h.order_id = o.id
+	WHERE o.id = $1
+	FOR UPDATE OF o`
+	if err = tx.QueryRow(context.Background(), q, order.ID, model.ClosedStatuses).Scan(&current, &from, &asset, &closed); err != nil {
+		return errors.Join(ErrSelect, err)
+	}
+	if closed {
+		return fmt.Errorf("order %s is closed", order.ID)
+	}
+	if extra := needed.Sub(current); extra.IsPositive() {
+		legs := []model.LedgerLeg{
+			available(from, asset, order.ID, extra.Neg()),
+			held(from, asset, order.ID, extra),
+		}
+		if err = post(tx, model.LedgerHold, order.ID, legs...); err != nil {
+			return err
+		}
+		if err = checkBalance(tx, from, asset); err != nil {
+			return err
+		}
 	}
+	amendment.ID = uuid.New().String()
 	if err = tx.Commit(context.Background()); err != nil {
 		return errors.Join(ErrConnection, err)
 	}
 	return nil
 }
 
+// amendmentHold checks an amended order against the rules of its market and returns
+// the amount the order must hold until the amendment is processed
+func amendmentHold(market *model.MarketInfo, amendment, order *model.Order, remaining decimal.Decimal) (decimal.Decimal, error) {
+	if order.IsMarket() && !helpers.IsEmpty(amendment.Price) {
+		return decimal.Zero, fmt.Errorf("market orders cannot be repriced")
+	}
+	amended := *order
+	amended.Size = remaining
+	if amendment.Size.IsPositive() {
+		amended.Size = amendment.Size
+	}
+	if !helpers.IsEmpty(amendment.Price) {
+		amended.Price = amendment.Price
+	}
+	if err := market.ValidateOrder(amended); err != nil {
+		return decimal.Zero, err
+	}
+	if order.Side != model.SideBid {
+		return amended.Size, nil
+	}
+	// market orders are not repriced, they hold the funds at their protection price
+	oldPrice, _ := decimal.NewFromString(order.Price)
+	if order.IsMarket() {
+		oldPrice, _ = decimal.NewFromString(order.ProtectionPrice)
+	}
+	newPrice, _ := decimal.NewFromString(amended.Price)
+	return decimal.Max(oldPrice, newPrice).Mul(amended.Size), nil
+}
+
+// GetBalances returns the available, locked, total and pending balance of an account for each asset
+func (c *Connection) GetBalances(address string) ([]*model.Balance, error) {
+	q := `
+	WITH locked AS (
+		SELECT asset_address, sum(amount) AS amount FROM holds WHERE address = $1 GROUP BY asset_address
+	),
+	available AS (
+		SELECT asset_address, balance AS amount FROM balances WHERE address = $1
+	),
+	pending AS (
+		SELECT asset_address, sum(amount) AS amount FROM deposits WHERE address = $1 AND status = 'pending' GROUP BY asset_address
+	)
+	SELECT a.address, a.symbol, COALESCE(av.amount, 0), COALESCE(l.amount, 0), COALESCE(p.amount, 0)
+	FROM assets a
+	LEFT JOIN available av ON av.asset_address = a.address
+	LEFT JOIN locked l ON l.asset_address = a.address
+	LEFT JOIN pending p ON p.asset_address = a.address
+	WHERE av.asset_address IS NOT NULL OR l.asset_address IS NOT NULL OR p.asset_address IS NOT NULL
+	ORDER BY a.symbol, a.address`
+	rows, err := c.pool.Query(context.Background(), q, address)
+	if err != nil {
+		return nil, errors.Join(ErrSelect, err)
+	}
+	defer rows.Close()
+	balances := make([]*model.Balance, 0)
+	for rows.Next() {
+		b := new(model.Balance)
+		if err = rows.Scan(&b.Asset, &b.Symbol, &b.Available, &b.Locked, &b.Pending); err != nil {
+			return nil, errors.Join(ErrSelect, err)
+		}
+		b.Total = b.Available.Add(b.Locked)
+		balances = append(balances, b)
+	}
+	return balances, nil
+}
+
 func (c *Connection) GetBalance(address, token string) (decimal.Decimal, error) {
 	var b decimal.Decimal
 	err := c.pool.QueryRow(context.Background(), "SELECT balance FROM balances WHERE address = $1 AND asset_address = $2", address, token).Scan(&b)
@@ -418,31 +1064,280 @@ func (c *Connection) GetBalance(address, token string) (decimal.Decimal, error)
 	return b, err
 }
 
+// GetDeposits returns the latest deposits of an account, pending, confirmed or reversed
+func (c *Connection) GetDeposits(address string, limit int) ([]*model.Deposit, error) {
+	q := `
+	SELECT chain_id, tx_hash, log_index, block_number, address, asset_address, amount, status, recorded_at
+	FROM "deposits"
+	WHERE address = $1
+	ORDER BY block_number DESC, log_index DESC
+	LIMIT $2`
+	rows, err := c.pool.Query(context.Background(), q, address, limit)
+	if err != nil {
+		return nil, errors.Join(ErrSelect, err)
+	}
+	defer rows.Close()
+	deposits := make([]*model.Deposit, 0)
+	for rows.Next() {
+		d := new(model.Deposit)
+		if err = rows.Scan(&d.ChainID, &d.TxHash, &d.LogIndex, &d.BlockNumber, &d.Address, &d.Asset, &d.Amount, &d.Status, &d.Time); err != nil {
+			return nil, errors.Join(ErrSelect, err)
+		}
+		deposits = append(deposits, d)
+	}
+	return deposits, nil
+}
+
 // GetOrder returns an order from the database
 func (c *Connection) GetOrder(id string) (order *model.Order, from, status string, err error) {
 	q := `
 	SELECT o.id, o.from_address, o.market_address, o.side, o.price, o.size, o.recorded_at, o.submitted_at,
-	COALESCE(m.status, 'open') AS status
+	o.time_in_force, o.expires_at, o.post_only, o.reprice, o.stop_price, o.display_size, trim(o.self_trade_prevention),
+	o.protection_price, o.status
 	FROM "orders" o
-	LEFT JOIN (
-		SELECT order_id, status
-		FROM "matches"
-		WHERE status = any($2)
-	) m ON m.order_id = o.id
 	WHERE o.id = $1
 	`
 	order = new(model.Order)
-	var price decimal.Decimal
-	err = c.pool.QueryRow(context.Background(), q, id, model.ClosedStatuses).Scan(
-		&order.ID, &from, &order.Market, &order.Side, &price, &order.Size, &order.RecordedAt, &order.SubmittedAt, &status,
+	var (
+		price           decimal.Decimal
+		expiresAt       *time.Time
+		stopPrice       decimal.NullDecimal
+		protectionPrice decimal.NullDecimal
+	)
+	err = c.pool.QueryRow(context.Background(), q, id).Scan(
+		&order.ID, &from, &order.Market, &order.Side, &price, &order.Size, &order.RecordedAt, &order.SubmittedAt,
+		&order.TimeInForce, &expiresAt, &order.PostOnly, &order.Reprice, &stopPrice, &order.DisplaySize, &order.SelfTradePrevention,
+		&protectionPrice, &status,
 	)
 	if err != nil {
 		return
 	}
 	order.Price = price.String()
+	if expiresAt != nil {
+		order.ExpiresAt = *expiresAt
+	}
+	if stopPrice.Valid {
+		order.StopPrice = stopPrice.Decimal.String()
+	}
+	if protectionPrice.Valid {
+		order.ProtectionPrice = protectionPrice.Decimal.String()
+	}
+	return
+}
+
+// GetOrderState returns the status of an order, its filled and remaining quantities,
+// the average price of its fills and the history of its status changes
+func (c *Connection) GetOrderState(id string) (*model.OrderState, error) {
+	state := &model.OrderState{History: make([]model.OrderStatusChange, 0)}
+	q := `SELECT status, filled, remaining, average_price FROM "orders" WHERE id = $1`
+	err := c.pool.QueryRow(context.Background(), q, id).Scan(&state.Status, &state.Filled, &state.Remaining, &state.AveragePrice)
+	if err != nil {
+		return nil, errors.Join(ErrSelect, err)
+	}
+	q = `SELECT status, reason, changed_at FROM "order_history" WHERE order_id = $1 ORDER BY id`
+	rows, err := c.pool.Query(context.Background(), q, id)
+	if err != nil {
+		return nil, errors.Join(ErrSelect, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h model.OrderStatusChange
+		if err = rows.Scan(&h.Status, &h.Reason, &h.Time); err != nil {
+			return nil, errors.Join(ErrSelect, err)
+		}
+		state.History = append(state.History, h)
+	}
+	return state, rows.Err()
+}
+
+// GetOrderRemaining returns the remaining (unfilled) size of an order and the part
+// of it that is displayed in the book, that for iceberg orders is at most the display size
+func (c *Connection) GetOrderRemaining(id string) (remaining, displayed decimal.Decimal, err error) {
+	q := `SELECT remaining, display_size FROM "orders" WHERE id = $1`
+	var displaySize decimal.Decimal
+	if err = c.pool.QueryRow(context.Background(), q, id).Scan(&remaining, &displaySize); err != nil {
+		err = errors.Join(ErrSelect, err)
+		return
+	}
+	displayed = remaining
+	if displaySize.IsPositive() && displaySize.LessThan(remaining) {
+		displayed = displaySize
+	}
 	return
 }
 
+// GetOpenOrders returns the limit orders that are still resting in the order book
+// and the stop orders that have not been triggered yet, sorted by time priority.
+// The size of each order is the remaining (unfilled) size, for iceberg orders it
+// includes the hidden quantity and only the display size is restored as visible.
+// Triggered stop orders are returned without the stop price.
+func (c *Connection) GetOpenOrders() ([]*model.SignedRequest[model.Order], error) {
+	q := `
+	SELECT o.id, o.from_address, o.market_address, o.side, o.price, o.remaining,
+	o.recorded_at, o.submitted_at, o.time_in_force, o.expires_at, o.post_only, o.reprice,
+	-- triggered stop orders are no longer pending
+	CASE WHEN o.status = $2 THEN o.stop_price END AS stop_price,
+	o.display_size, trim(o.self_trade_prevention), o.protection_price
+	FROM "orders" o
+	WHERE NOT (o.status = any($1)) AND o.remaining > 0
+	-- market orders, triggered stop market orders included, do not rest in the book
+	AND (o.price > 0 OR o.status = $2)
+	ORDER BY o.recorded_at, o.id
+	`
+	rows, err := c.pool.Query(context.Background(), q, model.ClosedStatuses, model.StatusPending)
+	if err != nil {
+		return nil, errors.Join(ErrSelect, err)
+	}
+	defer rows.Close()
+	orders := make([]*model.SignedRequest[model.Order], 0)
+	for rows.Next() {
+		var (
+			r               = new(model.SignedRequest[model.Order])
+			price           decimal.Decimal
+			expiresAt       *time.Time
+			stopPrice       decimal.NullDecimal
+			protectionPrice decimal.NullDecimal
+		)
+		if err = rows.Scan(
+			&r.Payload.ID, &r.From, &r.Payload.Market, &r.Payload.Side, &price, &r.Payload.Size, &r.Payload.RecordedAt, &r.Payload.SubmittedAt,
+			&r.Payload.TimeInForce, &expiresAt, &r.Payload.PostOnly, &r.Payload.Reprice, &stopPrice, &r.Payload.DisplaySize, &r.Payload.SelfTradePrevention,
+			&protectionPrice,
+		); err != nil {
+			return nil, errors.Join(ErrSelect, err)
+		}
+		if expiresAt != nil {
+			r.Payload.ExpiresAt = *expiresAt
+		}
+		if stopPrice.Valid {
+			r.Payload.StopPrice = stopPrice.Decimal.String()
+		}
+		if protectionPrice.Valid {
+			r.Payload.ProtectionPrice = protectionPrice.Decimal.String()
+		}
+		if !price.IsZero() {
+			r.Payload.Price = price.String()
+		}
+		orders = append(orders, r)
+	}
+	return orders, nil
+}
+
+// GetOrderHistory returns all the orders in the order they have been recorded,
+// market orders have an empty price
+func (c *Connection) GetOrderHistory() ([]*model.SignedRequest[model.Order], error) {
+	q := `
+	SELECT id, from_address, market_address, side, price, size, recorded_at, submitted_at, time_in_force, expires_at, post_only, reprice, stop_price, display_size, trim(self_trade_prevention),
+	protection_price
+	FROM "orders"
+	ORDER BY recorded_at, id
+	`
+	rows, err := c.pool.Query(context.Background(), q)
+	if err != nil {
+		return nil, errors.Join(ErrSelect, err)
+	}
+	defer rows.Close()
+	orders := make([]*model.SignedRequest[model.Order], 0)
+	for rows.Next() {
+		var (
+			r               = new(model.SignedRequest[model.Order])
+			price           decimal.Decimal
+			expiresAt       *time.Time
+			stopPrice       decimal.NullDecimal
+			protectionPrice decimal.NullDecimal
+		)
+		if err = rows.Scan(
+			&r.Payload.ID, &r.From, &r.Payload.Market, &r.Payload.Side, &price, &r.Payload.Size, &r.Payload.RecordedAt, &r.Payload.SubmittedAt,
+			&r.Payload.TimeInForce, &expiresAt, &r.Payload.PostOnly, &r.Payload.Reprice, &stopPrice, &r.Payload.DisplaySize, &r.Payload.SelfTradePrevention,
+			&protectionPrice,
+		); err != nil {
+			return nil, errors.Join(ErrSelect, err)
+		}
+		if expiresAt != nil {
+			r.Payload.ExpiresAt = *expiresAt
+		}
+		if stopPrice.Valid {
+			r.Payload.StopPrice = stopPrice.Decimal.String()
+		}
+		if protectionPrice.Valid {
+			r.Payload.ProtectionPrice = protectionPrice.Decimal.String()
+		}
+		if !price.IsZero() {
+			r.Payload.Price = price.String()
+		}
+		orders = append(orders, r)
+	}
+	return orders, nil
+}
+
+// GetMatches returns all the matches in the order they have been recorded
+func (c *Connection) GetMatches() ([]*model.Match, error) {
+	q := `
+	SELECT id, order_id, price, size, trim(side), matched_at, status, reason
+	FROM "matches"
+	ORDER BY matched_at, id, order_id
+	`
+	rows, err := c.pool.Query(context.Background(), q)
+	if err != nil {
+		return nil, errors.Join(ErrSelect, err)
+	}
+	defer rows.Close()
+	matches := make([]*model.Match, 0)
+	for rows.Next() {
+		m := new(model.Match)
+		if err = rows.Scan(&m.ID, &m.OrderID, &m.Price, &m.Size, &m.Side, &m.Time, &m.Status, &m.Reason); err != nil {
+			return nil, errors.Join(ErrSelect, err)
+		}
+		matches = append(matches, m)
+	}
+	return matches, nil
+}
+
+// GetTrades returns the trades of a market in the order they have been executed
+func (c *Connection) GetTrades(market string) ([]*model.Trade, error) {
+	q := `
+	SELECT market_address, sequence, maker_order_id, taker_order_id, price, size, trim(aggressor_side), traded_at, maker_fee, taker_fee
+	FROM "trades"
+	WHERE market_address = $1
+	ORDER BY sequence
+	`
+	rows, err := c.pool.Query(context.Background(), q, market)
+	if err != nil {
+		return nil, errors.Join(ErrSelect, err)
+	}
+	defer rows.Close()
+	trades := make([]*model.Trade, 0)
+	for rows.Next() {
+		t := new(model.Trade)
+		if err = rows.Scan(&t.Market, &t.Sequence, &t.MakerOrderID, &t.TakerOrderID, &t.Price, &t.Size, &t.AggressorSide, &t.Time, &t.MakerFee, &t.TakerFee); err != nil {
+			return nil, errors.Join(ErrSelect, err)
+		}
+		trades = append(trades, t)
+	}
+	return trades, nil
+}
+
+// GetOrderFees returns the fees paid by an order in the asset it receives,
+// the rebates of the maker trades are subtracted
+func (c *Connection) GetOrderFees(id string) (fees decimal.Decimal, err error) {
+	q := `
+	SELECT COALESCE(sum(CASE WHEN maker_order_id = $1 THEN maker_fee ELSE taker_fee END), 0)
+	FROM "trades"
+	WHERE maker_order_id = $1 OR taker_order_id = $1`
+	if err = c.pool.QueryRow(context.Background(), q, id).Scan(&fees); err != nil {
+		return fees, errors.Join(ErrSelect, err)
+	}
+	return fees, nil
+}
+
+// GetTradeSequence returns the sequence number of the last trade of a market
+func (c *Connection) GetTradeSequence(market string) (sequence uint64, err error) {
+	q := `SELECT COALESCE(max(sequence), 0) FROM "trades" WHERE market_address = $1`
+	if err = c.pool.QueryRow(context.Background(), q, market).Scan(&sequence); err != nil {
+		return 0, errors.Join(ErrSelect, err)
+	}
+	return sequence, nil
+}
+
 // GetMarketPrice returns the current market price
 // it uses the VWAP (Volume Weighted Average Price) formula
 func (c *Connection) GetMarketPrice(market string) (price decimal.Decimal, err error) {
@@ -467,6 +1362,20 @@ func (c *Connection) SetAuthorization(address string, active bool) error {
 	return err
 }
 
+// nullTime maps the zero time to NULL
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// nullDecimal maps an empty amount to NULL
+func nullDecimal(s string) decimal.NullDecimal {
+	d, err := decimal.NewFromString(s)
+	return decimal.NullDecimal{Decimal: d, Valid: err == nil}
+}
+
 func txRollback(tx pgx.Tx) {
 	if err := tx.Rollback(context.Background()); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
 		log.Warnf("tx rollback error: %v", err)
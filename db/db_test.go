@@ -59,7 +59,7 @@ func createContainer(ctx context.Context) (testcontainers.Container, string, err
 		return container, "", fmt.Errorf("failed to get container external port: %w", err)
 	}
 
-	log.Infof("postgres container ready and running at port: ", p.Port())
+	log.Infof("postgres container ready and running at port: %s", p.Port())
 
 	time.Sleep(time.Second)
 
@@ -82,14 +82,8 @@ func TestMain(m *testing.M) {
 		log.Fatal("failed to setup test", err)
 	}
 
-	settings = model.Settings{
-		DB: struct {
-			URI            string
-			MaxConnections int
-		}{
-			URI: uri,
-		},
-	}
+	settings = model.Settings{}
+	settings.DB.URI = uri
 	exitStatus := m.Run()
 	if err = container.Terminate(ctx); err != nil {
 		log.Fatalf("error terminating container %v", err)
@@ -151,7 +145,7 @@ func TestConnection_SaveMarket(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err = dbCli.SaveMarket(tt.args.marketAddress, tt.args.base, tt.args.quote)
+			err = dbCli.SaveMarket(tt.args.marketAddress, tt.args.base, tt.args.quote, model.MarketRules{}, model.MarketFees{})
 			assert.ErrorIs(t, err, tt.wantErr)
 			_, err = dbCli.GetMarketByAddress(tt.args.marketAddress)
 			assert.NoError(t, err, "market must exists")
@@ -176,7 +170,7 @@ func TestConnection_handleMatch(t *testing.T) {
 	assert.NoError(t, err, "error initializing the database")
 	// start the db
 	go dbCli.Run()
-	clob := clob.NewPool(dbCli.Matches)
+	clob := clob.NewPool(dbCli.Matches()).WithTrades(dbCli.Trades())
 	go clob.Run()
 
 	type balance struct {
@@ -198,6 +192,8 @@ func TestConnection_handleMatch(t *testing.T) {
 		args         args
 		wantBalances []balance
 		wantPrice    []price
+		wantTrades   int
+		wantLocked   []balance
 		wantErr      error
 	}{
 		{
@@ -234,7 +230,7 @@ func TestConnection_handleMatch(t *testing.T) {
 							// alice buys 1 eur(quote) for 100 usd(base)
 							Market: _usd_eur,
 							Price:  "100",
-							Size:   1,
+							Size:   decimal.NewFromInt(1),
 							Side:   model.SideBid,
 						},
 						From: _alice,
@@ -244,7 +240,7 @@ func TestConnection_handleMatch(t *testing.T) {
 							// bob sells 1 eur(quote) for 100 usd(base)
 							Market: _usd_eur,
 							Price:  "100",
-							Size:   1,
+							Size:   decimal.NewFromInt(1),
 							Side:   model.SideAsk,
 						},
 						From: _bob,
@@ -279,6 +275,12 @@ func TestConnection_handleMatch(t *testing.T) {
 					price:         decimal.NewFromInt(100),
 				},
 			},
+			wantTrades: 1,
+			// the holds are spent by the trade
+			wantLocked: []balance{
+				{accountAddress: _alice, assetAddress: _usd, balance: decimal.Zero},
+				{accountAddress: _bob, assetAddress: _eur, balance: decimal.Zero},
+			},
 		},
 	}
 
@@ -286,8 +288,9 @@ func TestConnection_handleMatch(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 
 			// create the market
-			err = dbCli.SaveMarket(tt.args.market.Address, &tt.args.market.Base, &tt.args.market.Quote)
+			err = dbCli.SaveMarket(tt.args.market.Address, &tt.args.market.Base, &tt.args.market.Quote, tt.args.market.MarketRules, tt.args.market.MarketFees)
 			assert.NoError(t, err, "error saving market")
+			clob.OpenMarket(tt.args.market.Address)
 
 			// create the initial balances
 			for _, balance := range tt.args.initialBalances {
@@ -305,7 +308,7 @@ func TestConnection_handleMatch(t *testing.T) {
 				// TODO incorrect
 				zeroQuote := decimal.NewFromInt(0)
 				dbCli.ValidateOrder(&order.Payload, order.From, zeroQuote)
-				clob.Inbound <- order
+				assert.NoError(t, clob.Submit(order), "error submitting order")
 			}
 			// give the clob some time to process the orders
 			time.Sleep(50 * time.Millisecond)
@@ -315,6 +318,31 @@ func TestConnection_handleMatch(t *testing.T) {
 				assert.NoError(t, err, "error getting balance")
 				assert.Equalf(t, wantBalance.balance, balance, "balance mismatch account: %s, asset: %s, balance: %s", wantBalance.accountAddress, wantBalance.assetAddress, balance)
 			}
+			for _, wantLocked := range tt.wantLocked {
+				balances, err := dbCli.GetBalances(wantLocked.accountAddress)
+				assert.NoError(t, err, "error getting balances")
+				for _, b := range balances {
+					if b.Asset == wantLocked.assetAddress {
+						assert.Truef(t, wantLocked.balance.Equal(b.Locked), "locked mismatch account: %s, asset: %s, locked: %s", wantLocked.accountAddress, wantLocked.assetAddress, b.Locked)
+					}
+				}
+			}
+			trades, err := dbCli.GetTrades(tt.args.market.Address)
+			assert.NoError(t, err, "error getting trades")
+			assert.Len(t, trades, tt.wantTrades, "trades mismatch")
+			// the orders of the trades are filled
+			if tt.wantTrades > 0 {
+				for _, order := range tt.args.orders {
+					state, err := dbCli.GetOrderState(order.Payload.ID)
+					assert.NoError(t, err, "error getting order state")
+					assert.Equal(t, model.StatusFilled, state.Status, "order must be filled")
+					assert.True(t, state.Remaining.IsZero(), "filled order must have no remaining quantity")
+				}
+			}
+			// the ledger accounts for every balance movement
+			differences, err := dbCli.CheckLedger()
+			assert.NoError(t, err, "error checking the ledger")
+			assert.Empty(t, differences, "the ledger must match the balances")
 
 			// for _, wantPrice := range tt.wantPrice {
 			// 	price, err := dbCli.GetMarketPrice(wantPrice.marketAddress)
@@ -328,3 +356,169 @@ func TestConnection_handleMatch(t *testing.T) {
 	dbCli.Close()
 	clob.Close()
 }
+
+func TestConnection_GetOpenOrders(t *testing.T) {
+	var (
+		_alice   = "0xaa992902d88EA6192585B72D0B01C020F036bb99"
+		_gbp_chf = "0x6f1b5a1e3c7d2b4a8e9f0c1d2e3f4a5b6c7d8e9f"
+		_gbp     = "0x1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d"
+		_chf     = "0x2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e"
+	)
+	dbCli, err := db.NewConnection(&settings)
+	assert.NoError(t, err, "error connecting to the database")
+	assert.NoError(t, dbCli.InitializeSchema(), "error initializing the database")
+	defer dbCli.Close()
+
+	base := &model.Asset{Symbol: "GBP", Address: _gbp, Class: model.AssetOffChain}
+	quote := &model.Asset{Symbol: "CHF", Address: _chf, Class: model.AssetOffChain}
+	assert.NoError(t, dbCli.SaveMarket(_gbp_chf, base, quote, model.MarketRules{}, model.MarketFees{}))
+	assert.NoError(t, dbCli.UpdateBalance(_alice, _gbp, decimal.NewFromInt(1_000)))
+
+	orders := []*model.Order{
+		{Market: _gbp_chf, Side: model.SideBid, Price: "2", Size: decimal.NewFromInt(10), SubmittedAt: time.Now().UTC()},
+		{Market: _gbp_chf, Side: model.SideBid, Price: "3", Size: decimal.NewFromInt(5), StopPrice: "4", SubmittedAt: time.Now().UTC()},
+	}
+	for _, o := range orders {
+		o.RecordedAt = time.Now().UTC()
+		assert.NoError(t, dbCli.ValidateOrder(o, _alice, decimal.Zero), "error validating order")
+	}
+
+	open, err := dbCli.GetOpenOrders()
+	assert.NoError(t, err, "error getting the open orders")
+	restored := make(map[string]model.Order)
+	for _, r := range open {
+		if r.Payload.Market == _gbp_chf {
+			assert.Equal(t, _alice, r.From)
+			restored[r.Payload.ID] = r.Payload
+		}
+	}
+	assert.Len(t, restored, len(orders))
+	for _, o := range orders {
+		r := restored[o.ID]
+		assert.Equal(t, o.Price, r.Price)
+		assert.Equal(t, o.StopPrice, r.StopPrice)
+		assert.True(t, o.Size.Equal(r.Size), "size %s, want %s", r.Size, o.Size)
+	}
+
+	// the open orders are restored in the order books
+	pool := clob.NewPool(dbCli.Matches())
+	pool.OpenMarket(_gbp_chf)
+	report := pool.Restore(open)
+	assert.True(t, report.IsConsistent(), "issues: %v", report.Issues)
+	assert.Equal(t, len(orders), report.Markets[_gbp_chf])
+}
+
+func TestMigrator(t *testing.T) {
+	m, err := db.NewMigrator(&settings)
+	assert.NoError(t, err, "error connecting to the database")
+	defer m.Close()
+
+	// the schema is created by the migrations
+	assert.NoError(t, m.Up(0))
+	migrations, version, err := m.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, db.SchemaVersion(), version)
+	assert.Len(t, migrations, db.SchemaVersion())
+	for _, mg := range migrations {
+		assert.NotNil(t, mg.AppliedAt, "migration %d must be applied", mg.Version)
+	}
+	// applying the migrations again does nothing
+	assert.NoError(t, m.Up(0))
+	assert.ErrorIs(t, m.Up(1), db.ErrMigration, "cannot apply an older version")
+	// revert and apply all the migrations
+	assert.NoError(t, m.Down(0))
+	_, version, err = m.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, version)
+	assert.Error(t, m.Down(1), "cannot revert to a newer version")
+	assert.NoError(t, m.Up(0))
+
+	// the server refuses a schema newer than the supported one
+	pool, err := pgxpool.New(context.Background(), settings.DB.URI)
+	assert.NoError(t, err)
+	defer pool.Close()
+	_, err = pool.Exec(context.Background(), `INSERT INTO schema_version (version, name, applied_at) VALUES ($1, 'future', now())`, db.SchemaVersion()+1)
+	assert.NoError(t, err)
+	dbCli, err := db.NewConnection(&settings)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, dbCli.InitializeSchema(), db.ErrSchemaTooNew)
+	_, err = pool.Exec(context.Background(), `DELETE FROM schema_version WHERE version = $1`, db.SchemaVersion()+1)
+	assert.NoError(t, err)
+}
+
+// baselineSchema is the schema created by the releases before the migrations
+//
+//go:embed testdata/baseline_schema.sql
+var baselineSchema string
+
+func TestMigrator_Baseline(t *testing.T) {
+	var (
+		_alice   = "0xaa992902d88EA6192585B72D0B01C020F036bb99"
+		_bob     = "0xbb992902d88EA6192585B72D0B01C020F036bb99"
+		_gbp_chf = "0x6f1b5a1e3c7d2b4a8e9f0c1d2e3f4a5b6c7d8e9f"
+		_gbp     = "0x1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d"
+		_chf     = "0x2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e"
+		_open    = "00000000-0000-0000-0000-000000000001"
+		_filled  = "00000000-0000-0000-0000-000000000002"
+	)
+	pool, err := pgxpool.New(context.Background(), settings.DB.URI)
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	// a database created by the baseline schema, with an open bid and a filled ask:
+	// the funds of the orders were taken from the balances when they were placed
+	_, err = pool.Exec(context.Background(), `DROP SCHEMA public CASCADE; CREATE SCHEMA public;`)
+	assert.NoError(t, err)
+	_, err = pool.Exec(context.Background(), baselineSchema)
+	assert.NoError(t, err)
+	data := []string{
+		fmt.Sprintf(`INSERT INTO assets (address, symbol, class) VALUES ('%s', 'GBP', 'offchain'), ('%s', 'CHF', 'offchain')`, _gbp, _chf),
+		fmt.Sprintf(`INSERT INTO markets (address, base_address, quote_address, recorded_at) VALUES ('%s', '%s', '%s', now())`, _gbp_chf, _gbp, _chf),
+		fmt.Sprintf(`INSERT INTO orders (id, from_address, side, submitted_at, recorded_at, price, size, market_address) VALUES
+			('%s', '%s', 'bid', now(), now(), 2, 10, '%s'), ('%s', '%s', 'ask', now(), now(), 3, 5, '%s')`,
+			_open, _alice, _gbp_chf, _filled, _bob, _gbp_chf),
+		fmt.Sprintf(`INSERT INTO matches (id, order_id, price, size, side, matched_at, status) VALUES ('%s', '%s', 3, 5, 'ask', now(), 'filled')`, _filled, _filled),
+		fmt.Sprintf(`INSERT INTO balances (address, asset_address, balance) VALUES ('%s', '%s', 80), ('%s', '%s', 15)`, _alice, _gbp, _bob, _gbp),
+		fmt.Sprintf(`INSERT INTO accounts (address) VALUES ('%s'), ('%s')`, _alice, _bob),
+	}
+	for _, q := range data {
+		_, err = pool.Exec(context.Background(), q)
+		assert.NoError(t, err, q)
+	}
+
+	// the migrations upgrade the schema and keep the data
+	m, err := db.NewMigrator(&settings)
+	assert.NoError(t, err, "error connecting to the database")
+	defer m.Close()
+	assert.NoError(t, m.Up(0))
+	_, version, err := m.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, db.SchemaVersion(), version)
+
+	dbCli, err := db.NewConnection(&settings)
+	assert.NoError(t, err)
+	defer dbCli.Close()
+	// the open bid holds the funds it took
+	balances, err := dbCli.GetBalances(_alice)
+	assert.NoError(t, err)
+	if assert.Len(t, balances, 1) {
+		assert.True(t, decimal.NewFromInt(80).Equal(balances[0].Available), "available %s", balances[0].Available)
+		assert.True(t, decimal.NewFromInt(20).Equal(balances[0].Locked), "locked %s", balances[0].Locked)
+	}
+	state, err := dbCli.GetOrderState(_open)
+	assert.NoError(t, err)
+	assert.Equal(t, model.StatusOpen, state.Status)
+	state, err = dbCli.GetOrderState(_filled)
+	assert.NoError(t, err)
+	assert.Equal(t, model.StatusFilled, state.Status)
+	open, err := dbCli.GetOpenOrders()
+	assert.NoError(t, err)
+	if assert.Len(t, open, 1) {
+		assert.Equal(t, _open, open[0].Payload.ID)
+		assert.True(t, decimal.NewFromInt(10).Equal(open[0].Payload.Size))
+	}
+	// the opening entry of the ledger matches the balances and the holds
+	differences, err := dbCli.CheckLedger()
+	assert.NoError(t, err)
+	assert.Empty(t, differences)
+}
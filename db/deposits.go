@@ -0,0 +1,120 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"authex/model"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/gommon/log"
+	"github.com/shopspring/decimal"
+)
+
+// depositReference returns the reference of the ledger entries of a deposit
+func depositReference(txHash string, logIndex uint) string {
+	return fmt.Sprintf("%s:%d", txHash, logIndex)
+}
+
+// recordDeposit records a transfer on chain, a deposit waits for its confirmations in the
+// pending account while a withdrawal is debited at once. A log already recorded is skipped,
+// unless it was reversed and the new chain delivers it again.
+func recordDeposit(tx pgx.Tx, t *model.BalanceChange) error {
+	reference := depositReference(t.TxHash, t.LogIndex)
+	q := `INSERT INTO deposits (chain_id, tx_hash, log_index, block_number, address, asset_address, amount, status, recorded_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	ON CONFLICT ON CONSTRAINT deposits_unique_log DO UPDATE
+	SET block_number = EXCLUDED.block_number, status = EXCLUDED.status, recorded_at = EXCLUDED.recorded_at
+	WHERE deposits.status = 'reversed'`
+	for _, delta := range t.Deltas {
+		status, leg := model.DepositPending, pending(delta.Address, t.TokenAddress, delta.Amount)
+		if delta.Amount.IsNegative() {
+			status, leg = model.DepositConfirmed, available(delta.Address, t.TokenAddress, "", delta.Amount)
+		}
+		tag, err := tx.Exec(context.Background(), q, t.ChainID, t.TxHash, t.LogIndex, t.BlockNumber, delta.Address, t.TokenAddress,
+			delta.Amount, status, time.Now().UTC())
+		if err != nil {
+			return errors.Join(ErrUpsert, err)
+		}
+		if tag.RowsAffected() == 0 {
+			log.Infof("deposit %s already recorded", reference)
+			continue
+		}
+		if err = post(tx, model.LedgerDeposit, reference, leg, external(delta.Address, t.TokenAddress, delta.Amount.Neg())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reverseDeposit reverses the transfer of a log removed by a reorganization of the chain.
+// A confirmed deposit is not reversed, it may be spent already, and it's reported instead.
+func reverseDeposit(tx pgx.Tx, t *model.BalanceChange) error {
+	reference := depositReference(t.TxHash, t.LogIndex)
+	var (
+		address, asset, status string
+		amount                 decimal.Decimal
+	)
+	q := `SELECT address, asset_address, amount, status FROM deposits WHERE chain_id = $1 AND tx_hash = $2 AND log_index = $3 FOR UPDATE`
+	err := tx.QueryRow(context.Background(), q, t.ChainID, t.TxHash, t.LogIndex).Scan(&address, &asset, &amount, &status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		log.Infof("removed deposit %s not recorded", reference)
+		return nil
+	}
+	if err != nil {
+		return errors.Join(ErrSelect, err)
+	}
+	var leg model.LedgerLeg
+	switch {
+	case status == model.DepositReversed:
+		log.Infof("deposit %s already reversed", reference)
+		return nil
+	case status == model.DepositPending:
+		leg = pending(address, asset, amount.Neg())
+	case amount.IsNegative():
+		leg = available(address, asset, "", amount.Neg())
+	default:
+		log.Errorf("confirmed deposit %s removed by a reorganization deeper than the confirmations", reference)
+		return nil
+	}
+	q = `UPDATE deposits SET status = 'reversed' WHERE chain_id = $1 AND tx_hash = $2 AND log_index = $3`
+	if _, err = tx.Exec(context.Background(), q, t.ChainID, t.TxHash, t.LogIndex); err != nil {
+		return errors.Join(ErrUpdate, err)
+	}
+	return post(tx, model.LedgerReverse, reference, leg, external(address, asset, amount))
+}
+
+// confirmDeposits credits the pending deposits of a chain up to the confirmed block
+// to the available balance of the recipients
+func confirmDeposits(tx pgx.Tx, cf *model.Confirmation) error {
+	q := `
+	WITH confirmed AS (
+		UPDATE deposits SET status = 'confirmed'
+		WHERE chain_id = $1 AND status = 'pending' AND block_number <= $2
+		RETURNING tx_hash, log_index, block_number, address, asset_address, amount
+	)
+	SELECT tx_hash, log_index, address, asset_address, amount FROM confirmed ORDER BY block_number, log_index`
+	rows, err := tx.Query(context.Background(), q, cf.ChainID, cf.BlockNumber)
+	if err != nil {
+		return errors.Join(ErrUpdate, err)
+	}
+	defer rows.Close()
+	var deposits []*model.Deposit
+	for rows.Next() {
+		d := new(model.Deposit)
+		if err = rows.Scan(&d.TxHash, &d.LogIndex, &d.Address, &d.Asset, &d.Amount); err != nil {
+			return errors.Join(ErrUpdate, err)
+		}
+		deposits = append(deposits, d)
+	}
+	rows.Close()
+	for _, d := range deposits {
+		legs := []model.LedgerLeg{pending(d.Address, d.Asset, d.Amount.Neg()), available(d.Address, d.Asset, "", d.Amount)}
+		if err = post(tx, model.LedgerConfirm, depositReference(d.TxHash, d.LogIndex), legs...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"authex/model"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+// post records an entry in the ledger and applies its legs, the available legs to
+// the balances of the accounts and the held legs to the holds of the orders.
+// The balances and the holds are only changed by posting entries.
+func post(tx pgx.Tx, reason, reference string, legs ...model.LedgerLeg) error {
+	e := &model.LedgerEntry{Reason: reason, Reference: reference, Time: time.Now().UTC()}
+	for _, l := range legs {
+		if !l.Amount.IsZero() {
+			e.Legs = append(e.Legs, l)
+		}
+	}
+	if len(e.Legs) == 0 {
+		return nil
+	}
+	if err := e.Validate(); err != nil {
+		return fmt.Errorf("%s entry %s: %w", reason, reference, err)
+	}
+	q := `INSERT INTO ledger_entries (reason, reference, recorded_at) VALUES ($1, $2, $3) RETURNING id`
+	if err := tx.QueryRow(context.Background(), q, e.Reason, e.Reference, e.Time).Scan(&e.ID); err != nil {
+		return errors.Join(ErrInsert, err)
+	}
+	for _, l := range e.Legs {
+		q = `INSERT INTO ledger_legs (entry_id, address, asset_address, account, order_id, amount) VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6)`
+		if _, err := tx.Exec(context.Background(), q, e.ID, l.Address, l.Asset, l.Account, l.OrderID, l.Amount); err != nil {
+			return errors.Join(ErrInsert, err)
+		}
+		switch l.Account {
+		case model.LedgerAvailable:
+			q = `INSERT INTO balances (address, asset_address, balance) VALUES ($1, $2, $3)
+			ON CONFLICT (address, asset_address) DO UPDATE SET balance = balances.balance + EXCLUDED.balance`
+			if _, err := tx.Exec(context.Background(), q, l.Address, l.Asset, l.Amount); err != nil {
+				return errors.Join(ErrUpsert, err)
+			}
+		case model.LedgerHeld:
+			q = `INSERT INTO holds (order_id, address, asset_address, amount) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (order_id) DO UPDATE SET amount = holds.amount + EXCLUDED.amount`
+			if _, err := tx.Exec(context.Background(), q, l.OrderID, l.Address, l.Asset, l.Amount); err != nil {
+				return errors.Join(ErrUpsert, err)
+			}
+		}
+	}
+	return nil
+}
+
+// available returns a leg of the available balance of an account
+func available(address, asset, orderID string, amount decimal.Decimal) model.LedgerLeg {
+	return model.LedgerLeg{Address: address, Asset: asset, Account: model.LedgerAvailable, OrderID: orderID, Amount: amount}
+}
+
+// held returns a leg of the hold of an order
+func held(address, asset, orderID string, amount decimal.Decimal) model.LedgerLeg {
+	return model.LedgerLeg{Address: address, Asset: asset, Account: model.LedgerHeld, OrderID: orderID, Amount: amount}
+}
+
+// pending returns a leg of the deposits of an account waiting for their confirmations
+func pending(address, asset string, amount decimal.Decimal) model.LedgerLeg {
+	return model.LedgerLeg{Address: address, Asset: asset, Account: model.LedgerPending, Amount: amount}
+}
+
+// external returns a leg of the assets that enter or leave the exchange
+func external(address, asset string, amount decimal.Decimal) model.LedgerLeg {
+	return model.LedgerLeg{Address: address, Asset: asset, Account: model.LedgerExternal, Amount: amount}
+}
+
+// checkBalance fails if the available balance of an account is negative
+func checkBalance(tx pgx.Tx, address, asset string) error {
+	var balance decimal.Decimal
+	q := `SELECT COALESCE((SELECT balance FROM balances WHERE address = $1 AND asset_address = $2), 0)`
+	if err := tx.QueryRow(context.Background(), q, address, asset).Scan(&balance); err != nil {
+		return errors.Join(ErrSelect, err)
+	}
+	if balance.IsNegative() {
+		return fmt.Errorf("insufficient %s balance", asset)
+	}
+	return nil
+}
+
+// GetLedger returns the latest ledger entries that moved the balances of an account,
+// optionally of one asset, with all their legs
+func (c *Connection) GetLedger(address, asset string, limit int) ([]*model.LedgerEntry, error) {
+	q := `
+	SELECT id, reason, reference, recorded_at
+	FROM ledger_entries
+	WHERE id IN (SELECT entry_id FROM ledger_legs WHERE address = $1 AND ($2 = '' OR asset_address = $2))
+	ORDER BY id DESC
+	LIMIT $3`
+	rows, err := c.pool.Query(context.Background(), q, address, asset, limit)
+	if err != nil {
+		return nil, errors.Join(ErrSelect, err)
+	}
+	defer rows.Close()
+	var (
+		entries = make([]*model.LedgerEntry, 0)
+		byID    = make(map[int64]*model.LedgerEntry)
+		ids     []int64
+	)
+	for rows.Next() {
+		e := new(model.LedgerEntry)
+		if err = rows.Scan(&e.ID, &e.Reason, &e.Reference, &e.Time); err != nil {
+			return nil, errors.Join(ErrSelect, err)
+		}
+		entries = append(entries, e)
+		byID[e.ID] = e
+		ids = append(ids, e.ID)
+	}
+	rows.Close()
+	q = `
+	SELECT entry_id, address, asset_address, account, COALESCE(order_id, ''), amount
+	FROM ledger_legs
+	WHERE entry_id = any($1)
+	ORDER BY entry_id, account, address`
+	if rows, err = c.pool.Query(context.Background(), q, ids); err != nil {
+		return nil, errors.Join(ErrSelect, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id int64
+			l  model.LedgerLeg
+		)
+		if err = rows.Scan(&id, &l.Address, &l.Asset, &l.Account, &l.OrderID, &l.Amount); err != nil {
+			return nil, errors.Join(ErrSelect, err)
+		}
+		byID[id].Legs = append(byID[id].Legs, l)
+	}
+	return entries, nil
+}
+
+// CheckLedger compares the sums of the ledger legs with the balances, the holds and the
+// pending deposits of the accounts, and checks that the legs of every entry balance.
+// It returns the differences found, an empty list if the ledger is consistent.
+func (c *Connection) CheckLedger() ([]model.LedgerDifference, error) {
+	differences := make([]model.LedgerDifference, 0)
+	q := `
+	WITH ledger AS (
+		SELECT address, asset_address, account, sum(amount) AS amount
+		FROM ledger_legs
+		WHERE account IN ('available', 'held', 'pending')
+		GROUP BY address, asset_address, account
+	),
+	recorded AS (
+		SELECT address, asset_address, 'available' AS account, balance AS amount FROM balances
+		UNION ALL
+		SELECT address, asset_address, 'held', sum(amount) FROM holds GROUP BY address, asset_address
+		UNION ALL
+		SELECT address, asset_address, 'pending', sum(amount) FROM deposits WHERE status = 'pending' GROUP BY address, asset_address
+	)
+	SELECT COALESCE(l.address, r.address), COALESCE(l.asset_address, r.asset_address), COALESCE(l.account, r.account),
+		COALESCE(l.amount, 0), COALESCE(r.amount, 0)
+	FROM ledger l FULL JOIN recorded r
+	ON l.address = r.address AND l.asset_address = r.asset_address AND l.account = r.account
+	WHERE COALESCE(l.amount, 0) <> COALESCE(r.amount, 0)
+	ORDER BY 1, 2, 3`
+	rows, err := c.pool.Query(context.Background(), q)
+	if err != nil {
+		return nil, errors.Join(ErrSelect, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d model.LedgerDifference
+		if err = rows.Scan(&d.Address, &d.Asset, &d.Account, &d.Ledger, &d.Recorded); err != nil {
+			return nil, errors.Join(ErrSelect, err)
+		}
+		differences = append(differences, d)
+	}
+	rows.Close()
+	q = `
+	SELECT entry_id, asset_address, sum(amount)
+	FROM ledger_legs
+	GROUP BY entry_id, asset_address
+	HAVING sum(amount) <> 0
+	ORDER BY entry_id`
+	if rows, err = c.pool.Query(context.Background(), q); err != nil {
+		return nil, errors.Join(ErrSelect, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d model.LedgerDifference
+		if err = rows.Scan(&d.EntryID, &d.Asset, &d.Ledger); err != nil {
+			return nil, errors.Join(ErrSelect, err)
+		}
+		differences = append(differences, d)
+	}
+	return differences, nil
+}
@@ -0,0 +1,1142 @@
+package db
+
+import (
+	"authex/model"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/gommon/log"
+	"github.com/shopspring/decimal"
+)
+
+// Memory is the in-memory implementation of the storage, it keeps the same records
+// of the Postgres one but nothing survives a restart. It's meant for tests and demos.
+type Memory struct {
+	mu            sync.RWMutex
+	matches       chan *model.Match
+	trades        chan *model.Trade
+	transfers     chan *model.BalanceChange
+	confirmations chan *model.Confirmation
+
+	// feeAccount is credited with the trading fees
+	feeAccount string
+
+	assets    map[string]model.Asset
+	markets   map[string]*model.MarketInfo
+	accounts  map[string]bool
+	orders    map[string]*memoryOrder
+	matchLog  []*model.Match
+	matchKeys map[string]bool
+	tradeLog  map[string][]*model.Trade
+	tradeKeys map[string]bool
+	// balances are the available balances by address and asset
+	balances map[string]map[string]decimal.Decimal
+	holds    map[string]*memoryHold
+	ledger   []*model.LedgerEntry
+	deposits []*model.Deposit
+	// depositKeys are the deposits by chain, transaction and log
+	depositKeys map[string]*model.Deposit
+	// firstBlocks are the first blocks watched, by asset
+	firstBlocks map[string]uint64
+	// lastBlocks are the last blocks with a transfer recorded, by asset
+	lastBlocks map[string]uint64
+}
+
+// memoryOrder is an order with its owner and its execution state
+type memoryOrder struct {
+	order model.Order
+	from  string
+	state model.OrderState
+	// reduced is the quantity removed by the filled, partial and decremented matches
+	reduced decimal.Decimal
+}
+
+// memoryHold is the amount locked by an order
+type memoryHold struct {
+	address, asset string
+	amount         decimal.Decimal
+}
+
+// NewMemory returns an empty in-memory storage
+func NewMemory(options *model.Settings) *Memory {
+	return &Memory{
+		matches:       make(chan *model.Match),
+		trades:        make(chan *model.Trade),
+		transfers:     make(chan *model.BalanceChange),
+		confirmations: make(chan *model.Confirmation),
+		feeAccount:    options.Fees.Account,
+		assets:        make(map[string]model.Asset),
+		markets:       make(map[string]*model.MarketInfo),
+		accounts:      make(map[string]bool),
+		orders:        make(map[string]*memoryOrder),
+		matchKeys:     make(map[string]bool),
+		tradeLog:      make(map[string][]*model.Trade),
+		tradeKeys:     make(map[string]bool),
+		balances:      make(map[string]map[string]decimal.Decimal),
+		holds:         make(map[string]*memoryHold),
+		depositKeys:   make(map[string]*model.Deposit),
+		firstBlocks:   make(map[string]uint64),
+		lastBlocks:    make(map[string]uint64),
+	}
+}
+
+// Close the channels
+func (m *Memory) Close() {
+	close(m.matches)
+	close(m.trades)
+	close(m.transfers)
+	close(m.confirmations)
+}
+
+// Matches returns the channel of the matches to settle
+func (m *Memory) Matches() chan *model.Match {
+	return m.matches
+}
+
+// Trades returns the channel of the trades to settle
+func (m *Memory) Trades() chan *model.Trade {
+	return m.trades
+}
+
+// Transfers returns the channel of the deposits to credit
+func (m *Memory) Transfers() chan *model.BalanceChange {
+	return m.transfers
+}
+
+// Confirmations returns the channel of the blocks whose deposits are confirmed
+func (m *Memory) Confirmations() chan *model.Confirmation {
+	return m.confirmations
+}
+
+// InitializeSchema does nothing, the memory is ready to be used
+func (m *Memory) InitializeSchema() error {
+	return nil
+}
+
+// Run settles the matches, the trades and the transfers until the channels are closed
+func (m *Memory) Run() {
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	defer wg.Wait()
+
+	// handle ERC20 transfers and their confirmations, in the order they are sent by the node client
+	go func() {
+		defer wg.Done()
+		transfers, confirmations := m.transfers, m.confirmations
+		for transfers != nil || confirmations != nil {
+			select {
+			case t, ok := <-transfers:
+				if !ok {
+					log.Debugf("closing balance handler")
+					transfers = nil
+					continue
+				}
+				m.handleTransfer(t)
+			case cf, ok := <-confirmations:
+				if !ok {
+					log.Debugf("closing confirmation handler")
+					confirmations = nil
+					continue
+				}
+				m.handleConfirmation(cf)
+			}
+		}
+	}()
+
+	// handle CLOB matches and trades, in the order they are sent by the matching engine
+	go func() {
+		defer wg.Done()
+		matches, trades := m.matches, m.trades
+		for matches != nil || trades != nil {
+			select {
+			case match, ok := <-matches:
+				if !ok {
+					log.Debugf("closing match handler")
+					matches = nil
+					continue
+				}
+				m.handleMatch(match)
+			case trade, ok := <-trades:
+				if !ok {
+					log.Debugf("closing trade handler")
+					trades = nil
+					continue
+				}
+				m.handleTrade(trade)
+			}
+		}
+	}()
+}
+
+// handleTransfer records the deposits of a block, they are credited to the available
+// balance of the recipients once confirmed. The transfers on chain are recorded once
+// and reversed if their log is removed by a reorganization.
+func (m *Memory) handleTransfer(t *model.BalanceChange) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var err error
+	switch {
+	case t.Removed:
+		err = m.reverseDeposit(t)
+	case t.IsOnChain():
+		err = m.recordDeposit(t)
+	default:
+		for _, delta := range t.Deltas {
+			legs := []model.LedgerLeg{
+				available(delta.Address, t.TokenAddress, "", delta.Amount),
+				external(delta.Address, t.TokenAddress, delta.Amount.Neg()),
+			}
+			if err = m.post(model.LedgerFunding, "", legs...); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Errorf("error updating the recipient balance: %v", err)
+		return
+	}
+	if t.IsOnChain() && !t.Removed && t.BlockNumber > m.lastBlocks[t.TokenAddress] {
+		m.lastBlocks[t.TokenAddress] = t.BlockNumber
+	}
+}
+
+// recordDeposit records a transfer on chain, a deposit waits for its confirmations in the
+// pending account while a withdrawal is debited at once
+func (m *Memory) recordDeposit(t *model.BalanceChange) error {
+	reference := depositReference(t.TxHash, t.LogIndex)
+	key := fmt.Sprintf("%s/%s", t.ChainID, reference)
+	for _, delta := range t.Deltas {
+		d, ok := m.depositKeys[key]
+		if ok && d.Status != model.DepositReversed {
+			log.Infof("deposit %s already recorded", reference)
+			continue
+		}
+		if !ok {
+			d = &model.Deposit{ChainID: t.ChainID, TxHash: t.TxHash, LogIndex: t.LogIndex, Address: delta.Address, Asset: t.TokenAddress, Amount: delta.Amount}
+			m.depositKeys[key] = d
+			m.deposits = append(m.deposits, d)
+		}
+		status, leg := model.DepositPending, pending(delta.Address, t.TokenAddress, delta.Amount)
+		if delta.Amount.IsNegative() {
+			status, leg = model.DepositConfirmed, available(delta.Address, t.TokenAddress, "", delta.Amount)
+		}
+		d.BlockNumber, d.Status, d.Time = t.BlockNumber, status, time.Now().UTC()
+		if err := m.post(model.LedgerDeposit, reference, leg, external(delta.Address, t.TokenAddress, delta.Amount.Neg())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reverseDeposit reverses the transfer of a log removed by a reorganization of the chain,
+// a confirmed deposit is reported instead
+func (m *Memory) reverseDeposit(t *model.BalanceChange) error {
+	reference := depositReference(t.TxHash, t.LogIndex)
+	d, ok := m.depositKeys[fmt.Sprintf("%s/%s", t.ChainID, reference)]
+	if !ok {
+		log.Infof("removed deposit %s not recorded", reference)
+		return nil
+	}
+	var leg model.LedgerLeg
+	switch {
+	case d.Status == model.DepositReversed:
+		log.Infof("deposit %s already reversed", reference)
+		return nil
+	case d.Status == model.DepositPending:
+		leg = pending(d.Address, d.Asset, d.Amount.Neg())
+	case d.Amount.IsNegative():
+		leg = available(d.Address, d.Asset, "", d.Amount.Neg())
+	default:
+		log.Errorf("confirmed deposit %s removed by a reorganization deeper than the confirmations", reference)
+		return nil
+	}
+	d.Status = model.DepositReversed
+	return m.post(model.LedgerReverse, reference, leg, external(d.Address, d.Asset, d.Amount))
+}
+
+// handleConfirmation credits the pending deposits of the confirmed blocks
+func (m *Memory) handleConfirmation(cf *model.Confirmation) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var confirmed []*model.Deposit
+	for _, d := range m.deposits {
+		if d.ChainID == cf.ChainID && d.Status == model.DepositPending && d.BlockNumber <= cf.BlockNumber {
+			confirmed = append(confirmed, d)
+		}
+	}
+	sort.SliceStable(confirmed, func(i, j int) bool {
+		if confirmed[i].BlockNumber != confirmed[j].BlockNumber {
+			return confirmed[i].BlockNumber < confirmed[j].BlockNumber
+		}
+		return confirmed[i].LogIndex < confirmed[j].LogIndex
+	})
+	for _, d := range confirmed {
+		d.Status = model.DepositConfirmed
+		legs := []model.LedgerLeg{pending(d.Address, d.Asset, d.Amount.Neg()), available(d.Address, d.Asset, "", d.Amount)}
+		if err := m.post(model.LedgerConfirm, depositReference(d.TxHash, d.LogIndex), legs...); err != nil {
+			log.Errorf("error confirming the deposits: %v", err)
+			return
+		}
+	}
+}
+
+func (m *Memory) handleMatch(match *model.Match) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// matches are sent again when the clob is recovered from the journal
+	key := fmt.Sprintf("%s/%s/%s", match.ID, match.OrderID, match.Status)
+	if m.matchKeys[key] {
+		log.Debugf("match %s for order %s already settled", match.ID, match.OrderID)
+		return
+	}
+	o, ok := m.orders[match.OrderID]
+	if !ok {
+		log.Errorf("handleMatch - order %s not found", match.OrderID)
+		return
+	}
+	recorded := *match
+	m.matchKeys[key] = true
+	m.matchLog = append(m.matchLog, &recorded)
+	for _, s := range model.ReducedStatuses {
+		if s == match.Status {
+			o.reduced = o.reduced.Add(match.Size)
+		}
+	}
+	m.updateOrderState(o, match)
+	switch match.Status {
+	case model.StatusTriggered:
+		// a triggered stop order is only recorded, the order is then matched as usual
+		return
+	case model.StatusPartial:
+		// the filled quantity is settled by the trades
+		return
+	case model.StatusRepriced:
+		// a repriced order is updated with the new price
+		oldPrice, _ := decimal.NewFromString(o.order.Price)
+		o.order.Price = match.Price.String()
+		if match.Side == model.SideBid {
+			m.releaseHold(o.order.ID, decimal.NewNullDecimal(oldPrice.Sub(match.Price).Mul(match.Size)))
+		}
+		return
+	case model.StatusAmended:
+		// an amended order is updated with the new price and size
+		o.order.Price = match.Price.String()
+		o.order.Size = match.Size.Add(o.reduced)
+		amount := match.Size
+		if match.Side == model.SideBid {
+			amount = match.Price.Mul(match.Size)
+		}
+		m.setHold(o.order.ID, amount)
+		return
+	}
+	// a decremented order releases the hold of the quantity removed from the book,
+	// a closed order releases what is left of its hold
+	var amount decimal.NullDecimal
+	if match.Status == model.StatusDecremented {
+		switch match.Side {
+		case model.SideBid:
+			amount = decimal.NewNullDecimal(match.Price.Mul(match.Size))
+		case model.SideAsk:
+			amount = decimal.NewNullDecimal(match.Size)
+		default:
+			log.Errorf("unknown side: %s", match.Side)
+			return
+		}
+	}
+	released := m.releaseHold(match.OrderID, amount)
+	log.Debugf("released %s for order id %s side %s status %s", released, match.OrderID, match.Side, match.Status)
+}
+
+// updateOrderState applies a match to the status and the remaining quantity of an order
+func (m *Memory) updateOrderState(o *memoryOrder, match *model.Match) {
+	switch match.Status {
+	case model.StatusTriggered:
+		m.setOrderStatus(o, model.StatusOpen, "", match.Time)
+	case model.StatusAmended:
+		if !model.IsClosed(o.state.Status) {
+			o.state.Remaining = match.Size
+		}
+	case model.StatusDecremented:
+		if !model.IsClosed(o.state.Status) {
+			o.state.Remaining = decimal.Max(o.state.Remaining.Sub(match.Size), decimal.Zero)
+		}
+	case model.StatusFilled, model.StatusCancelled, model.StatusExpired, model.StatusRejected, model.StatusPrevented:
+		m.setOrderStatus(o, match.Status, match.Reason, match.Time)
+	}
+}
+
+// setOrderStatus changes the status of an order and records the change in its history,
+// closed orders keep their status and have no remaining quantity
+func (m *Memory) setOrderStatus(o *memoryOrder, status, reason string, at time.Time) {
+	if o.state.Status == status || model.IsClosed(o.state.Status) {
+		return
+	}
+	o.state.Status = status
+	if model.IsClosed(status) {
+		o.state.Remaining = decimal.Zero
+	}
+	o.state.History = append(o.state.History, model.OrderStatusChange{Status: status, Reason: reason, Time: at})
+}
+
+// releaseHold moves an amount locked by an order back to the available balance, the whole
+// remaining hold is released if the amount is null. It returns the amount released.
+func (m *Memory) releaseHold(orderID string, amount decimal.NullDecimal) decimal.Decimal {
+	h, ok := m.holds[orderID]
+	if !ok {
+		return decimal.Zero
+	}
+	released := h.amount
+	if amount.Valid && amount.Decimal.LessThan(released) {
+		released = amount.Decimal
+	}
+	legs := []model.LedgerLeg{
+		held(h.address, h.asset, orderID, released.Neg()),
+		available(h.address, h.asset, orderID, released),
+	}
+	if err := m.post(model.LedgerRelease, orderID, legs...); err != nil {
+		log.Errorf("error releasing hold: %v", err)
+	}
+	return released
+}
+
+// setHold sets the amount held by an order, the difference with
+// the current hold is moved from (or to) the available balance
+func (m *Memory) setHold(orderID string, amount decimal.Decimal) {
+	h, ok := m.holds[orderID]
+	if !ok {
+		return
+	}
+	legs := []model.LedgerLeg{
+		held(h.address, h.asset, orderID, amount.Sub(h.amount)),
+		available(h.address, h.asset, orderID, h.amount.Sub(amount)),
+	}
+	if err := m.post(model.LedgerAmend, orderID, legs...); err != nil {
+		log.Errorf("error amending hold: %v", err)
+	}
+}
+
+// handleTrade settles a trade: the bid order receives the quote asset and the ask order
+// the base asset, the assets given in exchange are taken from the holds of the orders
+func (m *Memory) handleTrade(t *model.Trade) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// trades are sent again when the clob is recovered from the journal
+	key := fmt.Sprintf("%s:%d", t.Market, t.Sequence)
+	if m.tradeKeys[key] {
+		log.Debugf("trade %s already settled", key)
+		return
+	}
+	market, ok := m.markets[t.Market]
+	if !ok {
+		log.Errorf("handleTrade - market %s not found", t.Market)
+		return
+	}
+	var (
+		legs   []model.LedgerLeg
+		filled []*memoryOrder
+	)
+	for _, o := range []struct {
+		id, side string
+		maker    bool
+		fee      *decimal.Decimal
+	}{{t.MakerOrderID, t.MakerSide(), true, &t.MakerFee}, {t.TakerOrderID, t.AggressorSide, false, &t.TakerFee}} {
+		order, ok := m.orders[o.id]
+		if !ok {
+			log.Errorf("handleTrade - order %s not found", o.id)
+			return
+		}
+		// bid orders give the base asset and receive the quote asset
+		spent, received, asset := t.Price.Mul(t.Size), t.Size, market.Quote.Address
+		if o.side == model.SideAsk {
+			spent, received, asset = t.Size, t.Price.Mul(t.Size), market.Base.Address
+		}
+		legs = append(legs, m.spendHold(order, market, t.Size, spent)...)
+		// the fee is taken from the received asset
+		if m.feeAccount != "" {
+			maker, taker := market.Rates(m.tradedVolume(order.from, t))
+			rate := taker
+			if o.maker {
+				rate = maker
+			}
+			*o.fee = received.Mul(rate)
+		}
+		legs = append(legs,
+			available(order.from, asset, o.id, received.Sub(*o.fee)),
+			available(m.feeAccount, asset, "", *o.fee),
+		)
+		filled = append(filled, order)
+	}
+	if err := m.post(model.LedgerTrade, fmt.Sprintf("%s:%d", t.Market, t.Sequence), legs...); err != nil {
+		log.Errorf("handleTrade - error updating balances: %v", err)
+		return
+	}
+	for _, o := range filled {
+		m.fillOrder(o, t.Price, t.Size, t.Time)
+	}
+	recorded := *t
+	m.tradeKeys[key] = true
+	m.tradeLog[t.Market] = append(m.tradeLog[t.Market], &recorded)
+}
+
+// spendHold returns the ledger legs that take from the hold of an order the amount spent
+// in a trade of the given size, as spendHold of the Postgres storage
+func (m *Memory) spendHold(o *memoryOrder, market *model.MarketInfo, size, spent decimal.Decimal) []model.LedgerLeg {
+	asset, reserve := market.Quote.Address, decimal.Zero
+	if o.order.Side == model.SideBid {
+		asset = market.Base.Address
+		if reserve, _ = decimal.NewFromString(o.order.Price); reserve.IsZero() {
+			reserve, _ = decimal.NewFromString(o.order.ProtectionPrice)
+		}
+	}
+	taken := decimal.Zero
+	if h, ok := m.holds[o.order.ID]; ok {
+		taken = h.amount
+	}
+	needed := spent
+	if reserve.IsPositive() {
+		needed = reserve.Mul(size)
+	}
+	taken = decimal.Min(taken, needed)
+	return []model.LedgerLeg{
+		held(o.from, asset, o.order.ID, taken.Neg()),
+		available(o.from, asset, o.order.ID, taken.Sub(spent)),
+	}
+}
+
+// fillOrder adds a trade to the filled quantity and to the average price of an order,
+// the order is filled when no quantity remains
+func (m *Memory) fillOrder(o *memoryOrder, price, size decimal.Decimal, at time.Time) {
+	notional := o.state.AveragePrice.Mul(o.state.Filled).Add(price.Mul(size))
+	o.state.Filled = o.state.Filled.Add(size)
+	o.state.AveragePrice = notional.Div(o.state.Filled)
+	o.state.Remaining = decimal.Max(o.state.Remaining.Sub(size), decimal.Zero)
+	status := model.StatusPartial
+	if o.state.Remaining.IsZero() {
+		status = model.StatusFilled
+	}
+	m.setOrderStatus(o, status, "", at)
+}
+
+// tradedVolume returns the value (price times size) traded by an account
+// in the market of a trade, in the 30 days before the trade
+func (m *Memory) tradedVolume(account string, t *model.Trade) decimal.Decimal {
+	volume, since := decimal.Zero, t.Time.Add(-30*24*time.Hour)
+	for _, x := range m.tradeLog[t.Market] {
+		if !x.Time.After(since) || x.Time.After(t.Time) {
+			continue
+		}
+		for _, id := range []string{x.MakerOrderID, x.TakerOrderID} {
+			if o, ok := m.orders[id]; ok && o.from == account {
+				volume = volume.Add(x.Price.Mul(x.Size))
+			}
+		}
+	}
+	return volume
+}
+
+// post records an entry in the ledger and applies its legs to the balances and the holds
+func (m *Memory) post(reason, reference string, legs ...model.LedgerLeg) error {
+	e := &model.LedgerEntry{Reason: reason, Reference: reference, Time: time.Now().UTC()}
+	for _, l := range legs {
+		if !l.Amount.IsZero() {
+			e.Legs = append(e.Legs, l)
+		}
+	}
+	if len(e.Legs) == 0 {
+		return nil
+	}
+	if err := e.Validate(); err != nil {
+		return fmt.Errorf("%s entry %s: %w", reason, reference, err)
+	}
+	e.ID = int64(len(m.ledger) + 1)
+	m.ledger = append(m.ledger, e)
+	for _, l := range e.Legs {
+		switch l.Account {
+		case model.LedgerAvailable:
+			if m.balances[l.Address] == nil {
+				m.balances[l.Address] = make(map[string]decimal.Decimal)
+			}
+			m.balances[l.Address][l.Asset] = m.balances[l.Address][l.Asset].Add(l.Amount)
+		case model.LedgerHeld:
+			h, ok := m.holds[l.OrderID]
+			if !ok {
+				h = &memoryHold{address: l.Address, asset: l.Asset}
+				m.holds[l.OrderID] = h
+			}
+			h.amount = h.amount.Add(l.Amount)
+		}
+	}
+	return nil
+}
+
+// checkBalance fails if the available balance of an account would be negative
+// after the amount is taken from it
+func (m *Memory) checkBalance(address, asset string, amount decimal.Decimal) error {
+	if m.balances[address][asset].Sub(amount).IsNegative() {
+		return fmt.Errorf("insufficient %s balance", asset)
+	}
+	return nil
+}
+
+// SaveMarket saves a market and its assets
+func (m *Memory) SaveMarket(marketAddress string, base, quote *model.Asset, rules model.MarketRules, fees model.MarketFees) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.markets[marketAddress]; ok {
+		return errors.Join(ErrInsert, fmt.Errorf("market %s already exists", marketAddress))
+	}
+	for _, a := range []*model.Asset{base, quote} {
+		if _, ok := m.assets[a.Address]; !ok {
+			m.assets[a.Address] = *a
+		}
+	}
+	m.markets[marketAddress] = &model.MarketInfo{
+		Address:     marketAddress,
+		RecordedAt:  time.Now().UTC(),
+		Base:        m.assets[base.Address],
+		Quote:       m.assets[quote.Address],
+		MarketRules: rules,
+		MarketFees:  fees,
+	}
+	return nil
+}
+
+// UpdateBalance updates the balance of an asset for an address,
+// the funding is recorded in the ledger
+func (m *Memory) UpdateBalance(address, asset string, delta decimal.Decimal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	legs := []model.LedgerLeg{
+		available(address, asset, "", delta),
+		external(address, asset, delta.Neg()),
+	}
+	return m.post(model.LedgerFunding, "", legs...)
+}
+
+// GetMarkets returns all the markets, the latest first
+func (m *Memory) GetMarkets() ([]*model.MarketInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	markets := make([]*model.MarketInfo, 0, len(m.markets))
+	for _, market := range m.markets {
+		info := *market
+		markets = append(markets, &info)
+	}
+	sort.Slice(markets, func(i, j int) bool { return markets[i].RecordedAt.After(markets[j].RecordedAt) })
+	return markets, nil
+}
+
+// GetMarketByAddress returns a market by its address
+func (m *Memory) GetMarketByAddress(address string) (*model.MarketInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	market, ok := m.markets[address]
+	if !ok {
+		return nil, errors.Join(ErrSelect, model.ErrMarketNotFound)
+	}
+	info := *market
+	return &info, nil
+}
+
+// IsAuthorized returns true if the account is in the access list
+func (m *Memory) IsAuthorized(address string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.accounts[address]
+}
+
+// SetAuthorization sets the authorization status of an account
+func (m *Memory) SetAuthorization(address string, active bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.accounts[address] = active
+	return nil
+}
+
+// GetAssetAddressesByClass returns the addresses of the assets of a class
+func (m *Memory) GetAssetAddressesByClass(class string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var addresses []string
+	for _, a := range m.assets {
+		if a.Class == class {
+			addresses = append(addresses, a.Address)
+		}
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+// GetAssetBlocks returns the first block of a token and the last block with a transfer recorded
+func (m *Memory) GetAssetBlocks(address string) (first, last uint64, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if _, ok := m.assets[address]; !ok {
+		return 0, 0, errors.Join(ErrSelect, fmt.Errorf("asset %s not found", address))
+	}
+	return m.firstBlocks[address], m.lastBlocks[address], nil
+}
+
+// SetAssetFirstBlock sets the first block of a token, if it is not set yet
+func (m *Memory) SetAssetFirstBlock(address string, block uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.assets[address]; !ok {
+		return errors.Join(ErrUpdate, fmt.Errorf("asset %s not found", address))
+	}
+	if m.firstBlocks[address] == 0 {
+		m.firstBlocks[address] = block
+	}
+	return nil
+}
+
+// ValidateOrder checks an order against the rules of its market and the balance
+// of the account, then records the order and holds the funds it needs
+func (m *Memory) ValidateOrder(order *model.Order, from string, quote decimal.Decimal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	market, ok := m.markets[order.Market]
+	if !ok {
+		return fmt.Errorf("market not found")
+	}
+	price, asset, amount, err := orderHold(market, order, quote)
+	if err != nil {
+		return err
+	}
+	if err = m.checkBalance(from, asset, amount); err != nil {
+		return err
+	}
+	order.ID = uuid.New().String()
+	// stop orders wait for their trigger
+	status := model.StatusOpen
+	if order.IsStop() {
+		status = model.StatusPending
+	}
+	o := &memoryOrder{
+		order: *order,
+		from:  from,
+		state: model.OrderState{
+			Status:    status,
+			Remaining: order.Size,
+			History:   []model.OrderStatusChange{{Status: status, Time: order.RecordedAt}},
+		},
+	}
+	// the amounts are stored as the Postgres storage returns them
+	o.order.Market = market.Address
+	o.order.Amends = ""
+	o.order.Price = price.String()
+	o.order.TimeInForce = order.GetTimeInForce()
+	o.order.StopPrice = normalizeAmount(order.StopPrice)
+	o.order.ProtectionPrice = normalizeAmount(order.ProtectionPrice)
+	m.orders[order.ID] = o
+	// lock the debited amount until the order is filled or closed
+	legs := []model.LedgerLeg{
+		available(from, asset, order.ID, amount.Neg()),
+		held(from, asset, order.ID, amount),
+	}
+	return m.post(model.LedgerHold, order.ID, legs...)
+}
+
+// ValidateAmendment checks an amendment of an open order against the market rules and
+// adds to the hold of the order the funds needed by the new price and size
+func (m *Memory) ValidateAmendment(amendment, order *model.Order) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	market, ok := m.markets[order.Market]
+	if !ok {
+		return fmt.Errorf("market not found")
+	}
+	o, ok := m.orders[order.ID]
+	if !ok {
+		return errors.Join(ErrSelect, model.ErrOrderNotFound)
+	}
+	needed, err := amendmentHold(market, amendment, order, o.state.Remaining)
+	if err != nil {
+		return err
+	}
+	if model.IsClosed(o.state.Status) {
+		return fmt.Errorf("order %s is closed", order.ID)
+	}
+	asset := market.Quote.Address
+	if o.order.Side == model.SideBid {
+		asset = market.Base.Address
+	}
+	current := decimal.Zero
+	if h, ok := m.holds[order.ID]; ok {
+		current = h.amount
+	}
+	if extra := needed.Sub(current); extra.IsPositive() {
+		if err = m.checkBalance(o.from, asset, extra); err != nil {
+			return err
+		}
+		legs := []model.LedgerLeg{
+			available(o.from, asset, order.ID, extra.Neg()),
+			held(o.from, asset, order.ID, extra),
+		}
+		if err = m.post(model.LedgerHold, order.ID, legs...); err != nil {
+			return err
+		}
+	}
+	amendment.ID = uuid.New().String()
+	return nil
+}
+
+// GetBalances returns the available, locked, total and pending balance of an account for each asset
+func (m *Memory) GetBalances(address string) ([]*model.Balance, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	locked := make(map[string]decimal.Decimal)
+	for _, h := range m.holds {
+		if h.address == address {
+			locked[h.asset] = locked[h.asset].Add(h.amount)
+		}
+	}
+	unconfirmed := make(map[string]decimal.Decimal)
+	for _, d := range m.deposits {
+		if d.Address == address && d.Status == model.DepositPending {
+			unconfirmed[d.Asset] = unconfirmed[d.Asset].Add(d.Amount)
+		}
+	}
+	balances := make([]*model.Balance, 0)
+	for _, a := range m.assets {
+		av, hasBalance := m.balances[address][a.Address]
+		l, hasHold := locked[a.Address]
+		p, hasPending := unconfirmed[a.Address]
+		if !hasBalance && !hasHold && !hasPending {
+			continue
+		}
+		balances = append(balances, &model.Balance{Asset: a.Address, Symbol: a.Symbol, Available: av, Locked: l, Total: av.Add(l), Pending: p})
+	}
+	sort.Slice(balances, func(i, j int) bool {
+		if balances[i].Symbol != balances[j].Symbol {
+			return balances[i].Symbol < balances[j].Symbol
+		}
+		return balances[i].Asset < balances[j].Asset
+	})
+	return balances, nil
+}
+
+// GetBalance returns the available balance of an account for an asset
+func (m *Memory) GetBalance(address, token string) (decimal.Decimal, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.balances[address][token], nil
+}
+
+// GetOrder returns an order, its owner and its status
+func (m *Memory) GetOrder(id string) (order *model.Order, from, status string, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	o, ok := m.orders[id]
+	if !ok {
+		err = errors.Join(ErrSelect, model.ErrOrderNotFound)
+		return
+	}
+	order = new(model.Order)
+	*order = o.order
+	return order, o.from, o.state.Status, nil
+}
+
+// GetOrderState returns the status of an order, its filled and remaining quantities,
+// the average price of its fills and the history of its status changes
+func (m *Memory) GetOrderState(id string) (*model.OrderState, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	o, ok := m.orders[id]
+	if !ok {
+		return nil, errors.Join(ErrSelect, model.ErrOrderNotFound)
+	}
+	state := o.state
+	state.History = append(make([]model.OrderStatusChange, 0, len(o.state.History)), o.state.History...)
+	return &state, nil
+}
+
+// GetOrderRemaining returns the remaining (unfilled) size of an order and the part
+// of it that is displayed in the book
+func (m *Memory) GetOrderRemaining(id string) (remaining, displayed decimal.Decimal, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	o, ok := m.orders[id]
+	if !ok {
+		err = errors.Join(ErrSelect, model.ErrOrderNotFound)
+		return
+	}
+	remaining, displayed = o.state.Remaining, o.state.Remaining
+	if o.order.DisplaySize.IsPositive() && o.order.DisplaySize.LessThan(remaining) {
+		displayed = o.order.DisplaySize
+	}
+	return
+}
+
+// GetOrderFees returns the fees paid by an order in the asset it receives
+func (m *Memory) GetOrderFees(id string) (decimal.Decimal, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	fees := decimal.Zero
+	o, ok := m.orders[id]
+	if !ok {
+		return fees, nil
+	}
+	for _, t := range m.tradeLog[o.order.Market] {
+		switch id {
+		case t.MakerOrderID:
+			fees = fees.Add(t.MakerFee)
+		case t.TakerOrderID:
+			fees = fees.Add(t.TakerFee)
+		}
+	}
+	return fees, nil
+}
+
+// GetOpenOrders returns the limit orders that are still resting in the order book
+// and the stop orders that have not been triggered yet, sorted by time priority,
+// as GetOpenOrders of the Postgres storage
+func (m *Memory) GetOpenOrders() ([]*model.SignedRequest[model.Order], error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	orders := make([]*model.SignedRequest[model.Order], 0)
+	for _, o := range m.sortedOrders() {
+		isLimit, pending := o.order.Price != "0", o.state.Status == model.StatusPending
+		// market orders, triggered stop market orders included, do not rest in the book
+		if model.IsClosed(o.state.Status) || !o.state.Remaining.IsPositive() || (!isLimit && !pending) {
+			continue
+		}
+		r := m.request(o)
+		r.Payload.Size = o.state.Remaining
+		// triggered stop orders are no longer pending
+		if !pending {
+			r.Payload.StopPrice = ""
+		}
+		orders = append(orders, r)
+	}
+	return orders, nil
+}
+
+// GetOrderHistory returns all the orders in the order they have been recorded,
+// market orders have an empty price
+func (m *Memory) GetOrderHistory() ([]*model.SignedRequest[model.Order], error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	orders := make([]*model.SignedRequest[model.Order], 0, len(m.orders))
+	for _, o := range m.sortedOrders() {
+		orders = append(orders, m.request(o))
+	}
+	return orders, nil
+}
+
+// sortedOrders returns the orders sorted by the time they have been recorded
+func (m *Memory) sortedOrders() []*memoryOrder {
+	orders := make([]*memoryOrder, 0, len(m.orders))
+	for _, o := range m.orders {
+		orders = append(orders, o)
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		if !orders[i].order.RecordedAt.Equal(orders[j].order.RecordedAt) {
+			return orders[i].order.RecordedAt.Before(orders[j].order.RecordedAt)
+		}
+		return orders[i].order.ID < orders[j].order.ID
+	})
+	return orders
+}
+
+// request returns the signed request of a recorded order
+func (m *Memory) request(o *memoryOrder) *model.SignedRequest[model.Order] {
+	r := &model.SignedRequest[model.Order]{From: o.from, Payload: o.order}
+	if r.Payload.Price == "0" {
+		r.Payload.Price = ""
+	}
+	return r
+}
+
+// GetMatches returns all the matches in the order they have been recorded
+func (m *Memory) GetMatches() ([]*model.Match, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	matches := make([]*model.Match, 0, len(m.matchLog))
+	for _, match := range m.matchLog {
+		recorded := *match
+		matches = append(matches, &recorded)
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if !matches[i].Time.Equal(matches[j].Time) {
+			return matches[i].Time.Before(matches[j].Time)
+		}
+		if matches[i].ID != matches[j].ID {
+			return matches[i].ID < matches[j].ID
+		}
+		return matches[i].OrderID < matches[j].OrderID
+	})
+	return matches, nil
+}
+
+// GetTrades returns the trades of a market in the order they have been executed
+func (m *Memory) GetTrades(market string) ([]*model.Trade, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	trades := make([]*model.Trade, 0, len(m.tradeLog[market]))
+	for _, t := range m.tradeLog[market] {
+		recorded := *t
+		trades = append(trades, &recorded)
+	}
+	sort.Slice(trades, func(i, j int) bool { return trades[i].Sequence < trades[j].Sequence })
+	return trades, nil
+}
+
+// GetTradeSequence returns the sequence number of the last trade of a market
+func (m *Memory) GetTradeSequence(market string) (sequence uint64, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, t := range m.tradeLog[market] {
+		if t.Sequence > sequence {
+			sequence = t.Sequence
+		}
+	}
+	return sequence, nil
+}
+
+// GetMarketPrice returns the current market price, the VWAP of the filled matches
+func (m *Memory) GetMarketPrice(market string) (decimal.Decimal, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	notional, size := decimal.Zero, decimal.Zero
+	for _, match := range m.matchLog {
+		if o, ok := m.orders[match.OrderID]; !ok || o.order.Market != market || match.Status != model.StatusFilled {
+			continue
+		}
+		notional, size = notional.Add(match.Price.Mul(match.Size)), size.Add(match.Size)
+	}
+	if size.IsZero() {
+		return decimal.Zero, nil
+	}
+	return notional.Div(size), nil
+}
+
+// GetLedger returns the latest ledger entries that moved the balances of an account,
+// optionally of one asset, with all their legs
+func (m *Memory) GetLedger(address, asset string, limit int) ([]*model.LedgerEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entries := make([]*model.LedgerEntry, 0)
+	for i := len(m.ledger) - 1; i >= 0 && len(entries) < limit; i-- {
+		e := m.ledger[i]
+		for _, l := range e.Legs {
+			if l.Address == address && (asset == "" || l.Asset == asset) {
+				entry := *e
+				entry.Legs = append([]model.LedgerLeg(nil), e.Legs...)
+				sort.SliceStable(entry.Legs, func(a, b int) bool {
+					if entry.Legs[a].Account != entry.Legs[b].Account {
+						return entry.Legs[a].Account < entry.Legs[b].Account
+					}
+					return entry.Legs[a].Address < entry.Legs[b].Address
+				})
+				entries = append(entries, &entry)
+				break
+			}
+		}
+	}
+	return entries, nil
+}
+
+// GetDeposits returns the latest deposits of an account, pending, confirmed or reversed
+func (m *Memory) GetDeposits(address string, limit int) ([]*model.Deposit, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	deposits := make([]*model.Deposit, 0)
+	for _, d := range m.deposits {
+		if d.Address == address {
+			deposit := *d
+			deposits = append(deposits, &deposit)
+		}
+	}
+	sort.SliceStable(deposits, func(i, j int) bool {
+		if deposits[i].BlockNumber != deposits[j].BlockNumber {
+			return deposits[i].BlockNumber > deposits[j].BlockNumber
+		}
+		return deposits[i].LogIndex > deposits[j].LogIndex
+	})
+	if len(deposits) > limit {
+		deposits = deposits[:limit]
+	}
+	return deposits, nil
+}
+
+// CheckLedger compares the sums of the ledger legs with the balances, the holds and the
+// pending deposits of the accounts, and checks that the legs of every entry balance
+func (m *Memory) CheckLedger() ([]model.LedgerDifference, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	type account struct{ address, asset, account string }
+	var (
+		ledger      = make(map[account]decimal.Decimal)
+		recorded    = make(map[account]decimal.Decimal)
+		differences = make([]model.LedgerDifference, 0)
+		unbalanced  []model.LedgerDifference
+	)
+	for _, e := range m.ledger {
+		sums := make(map[string]decimal.Decimal)
+		for _, l := range e.Legs {
+			sums[l.Asset] = sums[l.Asset].Add(l.Amount)
+			if l.Account != model.LedgerExternal {
+				k := account{l.Address, l.Asset, l.Account}
+				ledger[k] = ledger[k].Add(l.Amount)
+			}
+		}
+		for asset, sum := range sums {
+			if !sum.IsZero() {
+				unbalanced = append(unbalanced, model.LedgerDifference{EntryID: e.ID, Asset: asset, Ledger: sum})
+			}
+		}
+	}
+	for address, assets := range m.balances {
+		for asset, balance := range assets {
+			recorded[account{address, asset, model.LedgerAvailable}] = balance
+		}
+	}
+	for _, h := range m.holds {
+		k := account{h.address, h.asset, model.LedgerHeld}
+		recorded[k] = recorded[k].Add(h.amount)
+	}
+	for _, d := range m.deposits {
+		if d.Status == model.DepositPending {
+			k := account{d.Address, d.Asset, model.LedgerPending}
+			recorded[k] = recorded[k].Add(d.Amount)
+		}
+	}
+	for k := range recorded {
+		if _, ok := ledger[k]; !ok {
+			ledger[k] = decimal.Zero
+		}
+	}
+	for k, amount := range ledger {
+		if !amount.Equal(recorded[k]) {
+			differences = append(differences, model.LedgerDifference{
+				Address: k.address, Asset: k.asset, Account: k.account, Ledger: amount, Recorded: recorded[k],
+			})
+		}
+	}
+	sort.Slice(differences, func(i, j int) bool {
+		a, b := differences[i], differences[j]
+		if a.Address != b.Address {
+			return a.Address < b.Address
+		}
+		if a.Asset != b.Asset {
+			return a.Asset < b.Asset
+		}
+		return a.Account < b.Account
+	})
+	sort.SliceStable(unbalanced, func(i, j int) bool { return unbalanced[i].EntryID < unbalanced[j].EntryID })
+	return append(differences, unbalanced...), nil
+}
+
+// normalizeAmount formats an amount as the Postgres storage returns it, empty if it's not set
+func normalizeAmount(s string) string {
+	d, err := decimal.NewFromString(s)
+	if err != nil {
+		return ""
+	}
+	return d.String()
+}
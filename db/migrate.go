@@ -0,0 +1,268 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"authex/model"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/labstack/gommon/log"
+)
+
+// the migrations are named <version>_<name>.up.sql and <version>_<name>.down.sql,
+// the versions are applied in order and never changed once released
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var (
+	ErrSchemaTooNew = errors.New("the database schema is newer than the supported one")
+	ErrMigration    = errors.New("migration error")
+)
+
+// Migration is a versioned change of the database schema
+type Migration struct {
+	// Version is the sequence number of the migration, starting from 1
+	Version int
+	// Name is the description of the migration
+	Name string
+	// AppliedAt is the time the migration was applied, nil if it's pending
+	AppliedAt *time.Time
+
+	up, down string
+}
+
+// migrations returns the embedded migrations sorted by version
+func migrations() ([]*Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, errors.Join(ErrMigration, err)
+	}
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		name, direction, ok := strings.Cut(strings.TrimSuffix(e.Name(), ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("%w: invalid file name %s", ErrMigration, e.Name())
+		}
+		v, name, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(v)
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("%w: invalid version in file name %s", ErrMigration, e.Name())
+		}
+		sql, err := migrationFiles.ReadFile(path.Join("migrations", e.Name()))
+		if err != nil {
+			return nil, errors.Join(ErrMigration, err)
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.up = string(sql)
+		} else {
+			m.down = string(sql)
+		}
+	}
+	all := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("%w: migration %d must have both the up and the down files", ErrMigration, m.Version)
+		}
+		all = append(all, m)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Version < all[j].Version })
+	for i, m := range all {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("%w: missing migration %d", ErrMigration, i+1)
+		}
+	}
+	return all, nil
+}
+
+// SchemaVersion returns the version of the database schema supported by the binary
+func SchemaVersion() int {
+	all, err := migrations()
+	if err != nil {
+		log.Error(err)
+		return 0
+	}
+	return len(all)
+}
+
+// Migrator applies the schema migrations to a database
+type Migrator struct {
+	conn *pgx.Conn
+}
+
+// NewMigrator connects to the database to migrate, the connection
+// must be closed when the migrations are done
+func NewMigrator(options *model.Settings) (*Migrator, error) {
+	conn, err := pgx.Connect(context.Background(), options.DB.URI)
+	if err != nil {
+		return nil, errors.Join(ErrConnection, err)
+	}
+	return &Migrator{conn: conn}, nil
+}
+
+// Close the connection to the database
+func (m *Migrator) Close() {
+	if err := m.conn.Close(context.Background()); err != nil {
+		log.Warn(err)
+	}
+}
+
+// Status returns the migrations of the binary and of the database, with the
+// time they have been applied, and the version of the database schema
+func (m *Migrator) Status() (all []*Migration, version int, err error) {
+	if all, err = migrations(); err != nil {
+		return
+	}
+	applied, err := m.applied()
+	if err != nil {
+		return
+	}
+	for _, a := range applied {
+		if a.Version > len(all) {
+			all = append(all, a)
+			continue
+		}
+		all[a.Version-1].AppliedAt = a.AppliedAt
+	}
+	if len(applied) > 0 {
+		version = applied[len(applied)-1].Version
+	}
+	return
+}
+
+// Up applies the pending migrations up to a version, all of them if the version is 0,
+// it fails if the database schema is newer than the one supported by the binary
+func (m *Migrator) Up(target int) error {
+	all, version, err := m.Status()
+	if err != nil {
+		return err
+	}
+	supported := SchemaVersion()
+	if version > supported {
+		return fmt.Errorf("%w: database version %d, supported version %d", ErrSchemaTooNew, version, supported)
+	}
+	if target == 0 {
+		target = supported
+	}
+	if target > supported {
+		return fmt.Errorf("%w: unknown version %d", ErrMigration, target)
+	}
+	if target < version {
+		return fmt.Errorf("%w: target %d is below current version %d, use down", ErrMigration, target, version)
+	}
+	for _, mg := range all[version:target] {
+		if err = m.apply(mg, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Down reverts the applied migrations down to a version, 0 reverts all of them
+func (m *Migrator) Down(target int) error {
+	all, version, err := m.Status()
+	if err != nil {
+		return err
+	}
+	if version > SchemaVersion() {
+		return fmt.Errorf("%w: database version %d, supported version %d", ErrSchemaTooNew, version, SchemaVersion())
+	}
+	if target < 0 || target > version {
+		return fmt.Errorf("%w: cannot revert version %d to %d", ErrMigration, version, target)
+	}
+	for i := version; i > target; i-- {
+		if err = m.apply(all[i-1], false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reset drops the schema and applies all the migrations again,
+// the down migrations drop their objects only if they exist
+func (m *Migrator) Reset() error {
+	all, err := migrations()
+	if err != nil {
+		return err
+	}
+	for i := len(all) - 1; i >= 0; i-- {
+		if _, err = m.conn.Exec(context.Background(), all[i].down); err != nil {
+			return fmt.Errorf("%w: reverting migration %d: %w", ErrMigration, all[i].Version, err)
+		}
+	}
+	if _, err = m.conn.Exec(context.Background(), `DROP table if exists "schema_version"`); err != nil {
+		return errors.Join(ErrMigration, err)
+	}
+	return m.Up(0)
+}
+
+// applied returns the migrations recorded in the database,
+// the schema_version table is created if it doesn't exist
+func (m *Migrator) applied() ([]*Migration, error) {
+	q := `
+	CREATE table if not exists "schema_version" (
+		"version" int PRIMARY KEY,
+		"name" varchar(100) NOT NULL,
+		"applied_at" timestamp NOT NULL
+	)`
+	if _, err := m.conn.Exec(context.Background(), q); err != nil {
+		return nil, errors.Join(ErrMigration, err)
+	}
+	rows, err := m.conn.Query(context.Background(), `SELECT version, name, applied_at FROM schema_version ORDER BY version`)
+	if err != nil {
+		return nil, errors.Join(ErrSelect, err)
+	}
+	defer rows.Close()
+	applied := make([]*Migration, 0)
+	for rows.Next() {
+		a := new(Migration)
+		if err = rows.Scan(&a.Version, &a.Name, &a.AppliedAt); err != nil {
+			return nil, errors.Join(ErrSelect, err)
+		}
+		applied = append(applied, a)
+	}
+	return applied, rows.Err()
+}
+
+// apply runs a migration up or down and records it in a single transaction
+func (m *Migrator) apply(mg *Migration, up bool) error {
+	tx, err := m.conn.BeginTx(context.Background(), pgx.TxOptions{})
+	if err != nil {
+		return errors.Join(ErrConnection, err)
+	}
+	defer txRollback(tx)
+	sql, q, args := mg.down, `DELETE FROM schema_version WHERE version = $1`, []any{mg.Version}
+	if up {
+		sql, q, args = mg.up, `INSERT INTO schema_version (version, name, applied_at) VALUES ($1, $2, $3)`,
+			[]any{mg.Version, mg.Name, time.Now().UTC()}
+	}
+	if _, err = tx.Exec(context.Background(), sql); err != nil {
+		return fmt.Errorf("%w: migration %d (%s): %w", ErrMigration, mg.Version, mg.Name, err)
+	}
+	if _, err = tx.Exec(context.Background(), q, args...); err != nil {
+		return errors.Join(ErrMigration, err)
+	}
+	if err = tx.Commit(context.Background()); err != nil {
+		return errors.Join(ErrConnection, err)
+	}
+	if up {
+		log.Infof("migration %d (%s) applied", mg.Version, mg.Name)
+	} else {
+		log.Infof("migration %d (%s) reverted", mg.Version, mg.Name)
+	}
+	return nil
+}
@@ -0,0 +1,6 @@
+DROP table if exists "accounts" CASCADE;
+DROP table if exists "balances" CASCADE;
+DROP table if exists "matches" CASCADE;
+DROP table if exists "orders" CASCADE;
+DROP table if exists "markets" CASCADE;
+DROP table if exists "assets" CASCADE;
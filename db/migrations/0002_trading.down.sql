@@ -0,0 +1,26 @@
+-- the decimal prices and sizes are kept, they cannot be converted back to integers without losing precision
+DROP table if exists "holds" CASCADE;
+DROP table if exists "trades" CASCADE;
+DROP table if exists "fee_tiers" CASCADE;
+
+ALTER TABLE IF EXISTS "matches"
+    DROP COLUMN IF EXISTS "reason";
+
+ALTER TABLE IF EXISTS "orders"
+    DROP COLUMN IF EXISTS "time_in_force",
+    DROP COLUMN IF EXISTS "expires_at",
+    DROP COLUMN IF EXISTS "post_only",
+    DROP COLUMN IF EXISTS "reprice",
+    DROP COLUMN IF EXISTS "stop_price",
+    DROP COLUMN IF EXISTS "display_size",
+    DROP COLUMN IF EXISTS "self_trade_prevention",
+    DROP COLUMN IF EXISTS "protection_price";
+
+ALTER TABLE IF EXISTS "markets"
+    DROP COLUMN IF EXISTS "self_trade_prevention",
+    DROP COLUMN IF EXISTS "tick_size",
+    DROP COLUMN IF EXISTS "lot_size",
+    DROP COLUMN IF EXISTS "min_size",
+    DROP COLUMN IF EXISTS "min_notional",
+    DROP COLUMN IF EXISTS "maker_fee",
+    DROP COLUMN IF EXISTS "taker_fee";
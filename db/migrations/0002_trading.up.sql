@@ -0,0 +1,88 @@
+-- market rules and fees
+ALTER TABLE "markets"
+    ADD COLUMN IF NOT EXISTS "self_trade_prevention" char(2) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS "tick_size" numeric NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS "lot_size" numeric NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS "min_size" numeric NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS "min_notional" numeric NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS "maker_fee" numeric NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS "taker_fee" numeric NOT NULL DEFAULT 0;
+
+CREATE table if not exists "fee_tiers" (
+    "market_address" char(42) NOT NULL REFERENCES "markets" ("address"),
+    "min_volume" numeric NOT NULL,
+    "maker_fee" numeric NOT NULL,
+    "taker_fee" numeric NOT NULL,
+    PRIMARY KEY ("market_address", "min_volume")
+);
+
+-- decimal prices and sizes, order types
+ALTER TABLE "orders"
+    ALTER COLUMN "price" TYPE numeric,
+    ALTER COLUMN "size" TYPE numeric,
+    ADD COLUMN IF NOT EXISTS "time_in_force" char(3) NOT NULL DEFAULT 'GTC',
+    ADD COLUMN IF NOT EXISTS "expires_at" timestamp,
+    ADD COLUMN IF NOT EXISTS "post_only" boolean NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS "reprice" boolean NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS "stop_price" numeric,
+    ADD COLUMN IF NOT EXISTS "display_size" numeric NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS "self_trade_prevention" char(2) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS "protection_price" numeric;
+
+-- an order can have several matches with the same ID, e.g. triggered and filled
+ALTER TABLE "matches"
+    ALTER COLUMN "price" TYPE numeric,
+    ALTER COLUMN "size" TYPE numeric,
+    ALTER COLUMN "status" TYPE varchar(11),
+    ADD COLUMN IF NOT EXISTS "reason" varchar(20) NOT NULL DEFAULT '',
+    DROP CONSTRAINT IF EXISTS "matches_pkey",
+    ADD PRIMARY KEY ("id", "order_id", "status");
+
+CREATE table if not exists "trades" (
+    "market_address" char(42) NOT NULL REFERENCES "markets" ("address"),
+    "sequence" bigint NOT NULL,
+    "maker_order_id" char(36) NOT NULL REFERENCES "orders" ("id"),
+    "taker_order_id" char(36) NOT NULL REFERENCES "orders" ("id"),
+    "price" numeric NOT NULL,
+    "size" numeric NOT NULL,
+    "aggressor_side" char(3) NOT NULL,
+    "traded_at" timestamp NOT NULL,
+    "maker_fee" numeric NOT NULL DEFAULT 0,
+    "taker_fee" numeric NOT NULL DEFAULT 0,
+    -- the same orders can trade more than once, e.g. with the slices of an iceberg order
+    PRIMARY KEY ("market_address", "sequence")
+);
+
+CREATE INDEX IF NOT EXISTS "trades_index_maker_order_id" ON "trades" USING btree ("maker_order_id");
+CREATE INDEX IF NOT EXISTS "trades_index_taker_order_id" ON "trades" USING btree ("taker_order_id");
+
+ALTER TABLE "balances" ALTER COLUMN "balance" TYPE numeric;
+
+-- the funds of the open orders are held until the orders are closed
+CREATE table if not exists "holds" (
+    "order_id" char(36) PRIMARY KEY REFERENCES "orders" ("id"),
+    "address" char(42) NOT NULL,
+    "asset_address" char(42) NOT NULL REFERENCES "assets" ("address"),
+    "amount" numeric NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS "holds_index_address" ON "holds" USING btree ("address", "asset_address");
+
+-- the existing open orders already took their funds from the balances,
+-- the funds of the quantity not matched yet are recorded as held:
+-- bids hold the base asset at their price, asks hold the quote asset
+INSERT INTO "holds" ("order_id", "address", "asset_address", "amount")
+SELECT o."id", o."from_address",
+    CASE WHEN trim(o."side") = 'bid' THEN m."base_address" ELSE m."quote_address" END,
+    CASE WHEN trim(o."side") = 'bid' THEN o."price" * r."remaining" ELSE r."remaining" END
+FROM "orders" o
+JOIN "markets" m ON m."address" = o."market_address"
+JOIN (
+    SELECT o."id", o."size" - COALESCE(sum(x."size") FILTER (WHERE x."status" IN ('filled', 'partial')), 0) AS "remaining"
+    FROM "orders" o
+    LEFT JOIN "matches" x ON x."order_id" = o."id"
+    GROUP BY o."id"
+    HAVING NOT COALESCE(bool_or(x."status" IN ('filled', 'cancelled')), false)
+) r ON r."id" = o."id"
+WHERE r."remaining" > 0
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,3 @@
+DROP table if exists "ledger_legs" CASCADE;
+DROP table if exists "ledger_entries" CASCADE;
+DROP FUNCTION if exists "ledger_append_only"();
@@ -0,0 +1,51 @@
+CREATE table if not exists "ledger_entries" (
+    "id" bigserial PRIMARY KEY,
+    "reason" varchar(20) NOT NULL,
+    "reference" varchar(100) NOT NULL DEFAULT '',
+    "recorded_at" timestamp NOT NULL
+);
+
+CREATE table if not exists "ledger_legs" (
+    "entry_id" bigint NOT NULL REFERENCES "ledger_entries" ("id"),
+    "address" char(42) NOT NULL,
+    "asset_address" char(42) NOT NULL REFERENCES "assets" ("address"),
+    "account" varchar(10) NOT NULL, -- available, held or external
+    "order_id" char(36),
+    "amount" numeric NOT NULL -- positive for credits, negative for debits
+);
+
+CREATE INDEX IF NOT EXISTS "ledger_legs_index_entry_id" ON "ledger_legs" USING btree ("entry_id");
+CREATE INDEX IF NOT EXISTS "ledger_legs_index_address" ON "ledger_legs" USING btree ("address", "asset_address");
+
+-- the ledger is append only
+CREATE OR REPLACE FUNCTION "ledger_append_only"() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'the ledger is append only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER "ledger_entries_append_only" BEFORE UPDATE OR DELETE ON "ledger_entries"
+    FOR EACH ROW EXECUTE FUNCTION "ledger_append_only"();
+CREATE TRIGGER "ledger_legs_append_only" BEFORE UPDATE OR DELETE ON "ledger_legs"
+    FOR EACH ROW EXECUTE FUNCTION "ledger_append_only"();
+
+-- the existing balances and holds are recorded as an opening entry
+WITH opening AS (
+    INSERT INTO "ledger_entries" ("reason", "reference", "recorded_at")
+    SELECT 'opening', '', now() AT TIME ZONE 'utc'
+    WHERE EXISTS (SELECT 1 FROM "balances" WHERE "balance" <> 0) OR EXISTS (SELECT 1 FROM "holds" WHERE "amount" <> 0)
+    RETURNING "id"
+),
+amounts AS (
+    SELECT "address", "asset_address", 'available' AS "account", NULL AS "order_id", "balance" AS "amount" FROM "balances"
+    UNION ALL
+    SELECT "address", "asset_address", 'held', "order_id", "amount" FROM "holds"
+)
+INSERT INTO "ledger_legs" ("entry_id", "address", "asset_address", "account", "order_id", "amount")
+SELECT o."id", a."address", a."asset_address", a."account", a."order_id", a."amount"
+FROM opening o, amounts a WHERE a."amount" <> 0
+UNION ALL
+SELECT o."id", a."address", a."asset_address", 'external', NULL, -sum(a."amount")
+FROM opening o, amounts a
+GROUP BY o."id", a."address", a."asset_address"
+HAVING sum(a."amount") <> 0;
@@ -0,0 +1,7 @@
+DROP table if exists "order_history" CASCADE;
+
+ALTER TABLE IF EXISTS "orders"
+    DROP COLUMN IF EXISTS "status",
+    DROP COLUMN IF EXISTS "filled",
+    DROP COLUMN IF EXISTS "remaining",
+    DROP COLUMN IF EXISTS "average_price";
@@ -0,0 +1,55 @@
+ALTER TABLE "orders"
+    ADD COLUMN IF NOT EXISTS "status" varchar(11) NOT NULL DEFAULT 'open',
+    ADD COLUMN IF NOT EXISTS "filled" numeric NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS "remaining" numeric NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS "average_price" numeric NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS "orders_index_status" ON "orders" USING btree ("status");
+
+CREATE table if not exists "order_history" (
+    "id" bigserial PRIMARY KEY,
+    "order_id" char(36) NOT NULL REFERENCES "orders" ("id"),
+    "status" varchar(11) NOT NULL,
+    "reason" varchar(20) NOT NULL DEFAULT '',
+    "changed_at" timestamp NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS "order_history_index_order_id" ON "order_history" USING btree ("order_id");
+
+-- the state of the existing orders is derived from their trades and matches
+UPDATE "orders" o SET "filled" = t."filled", "average_price" = t."notional" / t."filled"
+FROM (
+    SELECT "id", sum("size") AS "filled", sum("price" * "size") AS "notional"
+    FROM (
+        SELECT "maker_order_id" AS "id", "price", "size" FROM "trades"
+        UNION ALL
+        SELECT "taker_order_id", "price", "size" FROM "trades"
+    ) x
+    GROUP BY "id"
+) t
+WHERE t."id" = o."id" AND t."filled" > 0;
+
+UPDATE "orders" o SET "remaining" = GREATEST(o."size" - o."filled" - COALESCE((
+    SELECT sum(m."size") FROM "matches" m WHERE m."order_id" = o."id" AND m."status" = 'decremented'
+), 0), 0);
+
+UPDATE "orders" o SET "status" = CASE
+    WHEN c."status" IS NOT NULL THEN c."status"
+    WHEN o."remaining" = 0 AND o."filled" > 0 THEN 'filled'
+    WHEN o."stop_price" IS NOT NULL AND NOT EXISTS (
+        SELECT 1 FROM "matches" m WHERE m."order_id" = o."id" AND m."status" = 'triggered'
+    ) THEN 'pending'
+    WHEN o."filled" > 0 THEN 'partial'
+    ELSE 'open' END,
+    "remaining" = CASE WHEN c."status" IS NOT NULL THEN 0 ELSE o."remaining" END
+FROM "orders" x
+LEFT JOIN (
+    SELECT DISTINCT ON ("order_id") "order_id", "status"
+    FROM "matches"
+    WHERE "status" IN ('filled', 'cancelled', 'expired', 'rejected', 'prevented')
+    ORDER BY "order_id", "matched_at"
+) c ON c."order_id" = x."id"
+WHERE x."id" = o."id";
+
+INSERT INTO "order_history" ("order_id", "status", "reason", "changed_at")
+SELECT "id", "status", '', "recorded_at" FROM "orders";
@@ -0,0 +1 @@
+DROP table if exists "deposits" CASCADE;
@@ -0,0 +1,14 @@
+-- the transfers on chain are credited once, identified by their log
+CREATE table if not exists "deposits" (
+    "chain_id" varchar(20) NOT NULL,
+    "tx_hash" char(66) NOT NULL,
+    "log_index" int NOT NULL,
+    "block_number" bigint NOT NULL,
+    "address" char(42) NOT NULL,
+    "asset_address" char(42) NOT NULL REFERENCES "assets" ("address"),
+    "amount" numeric NOT NULL,
+    "recorded_at" timestamp NOT NULL,
+    CONSTRAINT "deposits_unique_log" UNIQUE ("chain_id", "tx_hash", "log_index")
+);
+
+CREATE INDEX IF NOT EXISTS "deposits_index_address" ON "deposits" USING btree ("address");
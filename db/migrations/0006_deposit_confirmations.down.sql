@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS "deposits_index_pending";
+
+ALTER TABLE IF EXISTS "deposits" DROP COLUMN IF EXISTS "status";
@@ -0,0 +1,5 @@
+-- the deposits wait for their confirmations before they can be spent,
+-- the deposits recorded before were credited at once
+ALTER TABLE "deposits" ADD COLUMN IF NOT EXISTS "status" varchar(10) NOT NULL DEFAULT 'confirmed'; -- pending, confirmed or reversed
+
+CREATE INDEX IF NOT EXISTS "deposits_index_pending" ON "deposits" USING btree ("chain_id", "block_number") WHERE "status" = 'pending';
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"authex/model"
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+// storage backends
+const (
+	// StoragePostgres records the exchange in a Postgres database
+	StoragePostgres = "postgres"
+	// StorageMemory keeps the exchange in memory, nothing survives a restart
+	StorageMemory = "memory"
+)
+
+// Storage records the markets, the orders, the matches, the trades, the balances and
+// the accounts of the exchange. The matches, the trades, the transfers and the confirmations
+// sent to its channels are settled by Run, in the order they are received.
+type Storage interface {
+	// Run settles the matches, the trades and the transfers until the channels are closed
+	Run()
+	// Close the channels and release the resources of the storage
+	Close()
+	// InitializeSchema prepares the storage to be used
+	InitializeSchema() error
+	// Matches returns the channel of the matches to settle
+	Matches() chan *model.Match
+	// Trades returns the channel of the trades to settle
+	Trades() chan *model.Trade
+	// Transfers returns the channel of the deposits to credit
+	Transfers() chan *model.BalanceChange
+	// Confirmations returns the channel of the blocks whose deposits are confirmed
+	Confirmations() chan *model.Confirmation
+
+	// markets
+	SaveMarket(marketAddress string, base, quote *model.Asset, rules model.MarketRules, fees model.MarketFees) error
+	GetMarkets() ([]*model.MarketInfo, error)
+	GetMarketByAddress(address string) (*model.MarketInfo, error)
+	GetMarketPrice(market string) (decimal.Decimal, error)
+	GetAssetAddressesByClass(class string) ([]string, error)
+	GetAssetBlocks(address string) (first, last uint64, err error)
+	SetAssetFirstBlock(address string, block uint64) error
+
+	// orders
+	ValidateOrder(order *model.Order, from string, quote decimal.Decimal) error
+	ValidateAmendment(amendment, order *model.Order) error
+	GetOrder(id string) (order *model.Order, from, status string, err error)
+	GetOrderState(id string) (*model.OrderState, error)
+	GetOrderRemaining(id string) (remaining, displayed decimal.Decimal, err error)
+	GetOrderFees(id string) (decimal.Decimal, error)
+	GetOpenOrders() ([]*model.SignedRequest[model.Order], error)
+	GetOrderHistory() ([]*model.SignedRequest[model.Order], error)
+
+	// matches and trades
+	GetMatches() ([]*model.Match, error)
+	GetTrades(market string) ([]*model.Trade, error)
+	GetTradeSequence(market string) (uint64, error)
+
+	// balances
+	UpdateBalance(address, asset string, delta decimal.Decimal) error
+	GetBalances(address string) ([]*model.Balance, error)
+	GetBalance(address, token string) (decimal.Decimal, error)
+	GetLedger(address, asset string, limit int) ([]*model.LedgerEntry, error)
+	GetDeposits(address string, limit int) ([]*model.Deposit, error)
+	CheckLedger() ([]model.LedgerDifference, error)
+
+	// accounts
+	IsAuthorized(address string) bool
+	SetAuthorization(address string, active bool) error
+}
+
+var (
+	_ Storage = (*Connection)(nil)
+	_ Storage = (*Memory)(nil)
+)
+
+// NewStorage returns the storage backend selected in the settings,
+// Postgres if none is selected
+func NewStorage(options *model.Settings) (Storage, error) {
+	switch options.DB.Storage {
+	case StoragePostgres, "":
+		c, err := NewConnection(options)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case StorageMemory:
+		return NewMemory(options), nil
+	}
+	return nil, fmt.Errorf("unknown storage %q, use %s or %s", options.DB.Storage, StoragePostgres, StorageMemory)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -91,3 +92,12 @@ func EnvBool(key string, fallback bool) bool {
 	}
 	return fallback
 }
+
+func EnvUint(key string, fallback uint64) uint64 {
+	if value, ok := os.LookupEnv(key); ok {
+		if v, err := strconv.ParseUint(value, 10, 64); err == nil {
+			return v
+		}
+	}
+	return fallback
+}
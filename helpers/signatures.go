@@ -13,6 +13,11 @@ import (
 	"golang.org/x/term"
 )
 
+// serializable is a message that provides the bytes to sign
+type serializable interface {
+	Serialize() ([]byte, error)
+}
+
 func Sign(keystorePath, address, password string, promptPassword bool, msg any) (signature string, err error) {
 	if promptPassword {
 		password = PasswordPrompt(address)
@@ -27,8 +32,13 @@ func doSign(keystorePath, address, password string, msg any) (signature string,
 		return
 	}
 	defer ks.Lock(signer.Address)
-	// prepare the message
-	msgBytes, err := json.Marshal(msg)
+	// prepare the message, the bytes verified by the server are signed
+	var msgBytes []byte
+	if s, ok := msg.(serializable); ok {
+		msgBytes, err = s.Serialize()
+	} else {
+		msgBytes, err = json.Marshal(msg)
+	}
 	if err != nil {
 		return
 	}
@@ -0,0 +1,315 @@
+package model_test
+
+import (
+	"authex/model"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrder_Validate(t *testing.T) {
+	base := model.Order{
+		Market: "0x1",
+		Side:   model.SideBid,
+		Size:   decimal.NewFromInt(1),
+		Price:  "100",
+	}
+	with := func(f func(o *model.Order)) model.Order {
+		o := base
+		f(&o)
+		return o
+	}
+	tests := []struct {
+		name    string
+		order   model.Order
+		wantErr bool
+	}{
+		{"ok: limit", base, false},
+		{"ok: market", with(func(o *model.Order) { o.Price = "" }), false},
+		{"ok: IOC", with(func(o *model.Order) { o.TimeInForce = model.TimeInForceIOC }), false},
+		{"ok: market FOK", with(func(o *model.Order) { o.Price, o.TimeInForce = "", model.TimeInForceFOK }), false},
+		{"ok: GTD", with(func(o *model.Order) {
+			o.TimeInForce, o.ExpiresAt = model.TimeInForceGTD, time.Now().Add(time.Hour)
+		}), false},
+		{"ok: post only", with(func(o *model.Order) { o.PostOnly, o.Reprice = true, true }), false},
+		{"ERR: market post only", with(func(o *model.Order) { o.Price, o.PostOnly = "", true }), true},
+		{"ERR: IOC post only", with(func(o *model.Order) { o.TimeInForce, o.PostOnly = model.TimeInForceIOC, true }), true},
+		{"ERR: reprice without post only", with(func(o *model.Order) { o.Reprice = true }), true},
+		{"ok: stop limit", with(func(o *model.Order) { o.StopPrice = "90" }), false},
+		{"ok: stop market", with(func(o *model.Order) { o.Price, o.StopPrice = "", "90" }), false},
+		{"ERR: invalid stop price", with(func(o *model.Order) { o.StopPrice = "abc" }), true},
+		{"ERR: zero stop price", with(func(o *model.Order) { o.StopPrice = "0" }), true},
+		{"ok: iceberg", with(func(o *model.Order) { o.Size, o.DisplaySize = decimal.NewFromInt(10), decimal.NewFromInt(2) }), false},
+		{"ERR: market iceberg", with(func(o *model.Order) {
+			o.Price, o.Size, o.DisplaySize = "", decimal.NewFromInt(10), decimal.NewFromInt(2)
+		}), true},
+		{"ERR: IOC iceberg", with(func(o *model.Order) {
+			o.TimeInForce, o.Size, o.DisplaySize = model.TimeInForceIOC, decimal.NewFromInt(10), decimal.NewFromInt(2)
+		}), true},
+		{"ERR: display size too large", with(func(o *model.Order) { o.Size, o.DisplaySize = decimal.NewFromInt(10), decimal.NewFromInt(10) }), true},
+		{"ok: self-trade prevention", with(func(o *model.Order) { o.SelfTradePrevention = model.SelfTradeDecrement }), false},
+		{"ERR: unknown self-trade prevention", with(func(o *model.Order) { o.SelfTradePrevention = "XX" }), true},
+		{"ERR: no market", with(func(o *model.Order) { o.Market = "" }), true},
+		{"ERR: invalid side", with(func(o *model.Order) { o.Side = model.CancelOrder }), true},
+		{"ok: fractional size", with(func(o *model.Order) { o.Size = decimal.RequireFromString("0.25") }), false},
+		{"ERR: zero size", with(func(o *model.Order) { o.Size = decimal.Zero }), true},
+		{"ERR: ID set", with(func(o *model.Order) { o.ID = "abc" }), true},
+		{"ERR: unknown time in force", with(func(o *model.Order) { o.TimeInForce = "XYZ" }), true},
+		{"ERR: market GTC", with(func(o *model.Order) { o.Price, o.TimeInForce = "", model.TimeInForceGTC }), true},
+		{"ERR: GTD without expiration", with(func(o *model.Order) { o.TimeInForce = model.TimeInForceGTD }), true},
+		{"ERR: GTD expired", with(func(o *model.Order) {
+			o.TimeInForce, o.ExpiresAt = model.TimeInForceGTD, time.Now().Add(-time.Hour)
+		}), true},
+		{"ERR: expiration without GTD", with(func(o *model.Order) { o.ExpiresAt = time.Now().Add(time.Hour) }), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.order.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestOrder_ValidateAmendment(t *testing.T) {
+	tests := []struct {
+		name    string
+		order   model.Order
+		wantErr bool
+	}{
+		{"ok: price", model.Order{Amends: "o1", Price: "100"}, false},
+		{"ok: size", model.Order{Amends: "o1", Size: decimal.NewFromInt(1)}, false},
+		{"ok: price and size", model.Order{Amends: "o1", Price: "100", Size: decimal.NewFromInt(1)}, false},
+		{"ERR: nothing to amend", model.Order{Amends: "o1"}, true},
+		{"ERR: no order", model.Order{Price: "100"}, true},
+		{"ERR: ID set", model.Order{ID: "a1", Amends: "o1", Price: "100"}, true},
+		{"ERR: negative size", model.Order{Amends: "o1", Size: decimal.NewFromInt(-1)}, true},
+		{"ERR: invalid price", model.Order{Amends: "o1", Price: "abc"}, true},
+		{"ERR: zero price", model.Order{Amends: "o1", Price: "0"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.order.ValidateAmendment()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// baselineOrder is an order as serialized by the clients with integer sizes
+const baselineOrder = `{"submitted_at":"2023-06-23T17:02:29Z","recorded_at":"0001-01-01T00:00:00Z",` +
+	`"market":"0x6f1b5a1e3c7d2b4a8e9f0c1d2e3f4a5b6c7d8e9f","size":10,"price":"2","side":"bid"}`
+
+func TestOrder_Serialize(t *testing.T) {
+	zero := `"submitted_at":"0001-01-01T00:00:00Z","recorded_at":"0001-01-01T00:00:00Z"`
+	tests := []struct {
+		name  string
+		order model.Order
+		want  string
+	}{
+		{
+			"baseline order",
+			model.Order{
+				SubmittedAt: time.Date(2023, 6, 23, 17, 2, 29, 0, time.UTC),
+				Market:      "0x6f1b5a1e3c7d2b4a8e9f0c1d2e3f4a5b6c7d8e9f",
+				Side:        model.SideBid,
+				Price:       "2",
+				Size:        decimal.NewFromInt(10),
+			},
+			baselineOrder,
+		},
+		{
+			"fractional sizes",
+			model.Order{Market: "m", Side: model.SideAsk, Price: "2", Size: decimal.RequireFromString("1.5"), DisplaySize: decimal.RequireFromString("0.5")},
+			`{` + zero + `,"market":"m","size":1.5,"price":"2","side":"ask","display_size":0.5}`,
+		},
+		{
+			"expiration",
+			model.Order{Market: "m", Side: model.SideBid, Price: "2", Size: decimal.NewFromInt(1), TimeInForce: model.TimeInForceGTD, ExpiresAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+			`{` + zero + `,"market":"m","size":1,"price":"2","side":"bid","time_in_force":"GTD","expires_at":"2024-01-02T03:04:05Z"}`,
+		},
+		{
+			"no size",
+			model.Order{Market: "m"},
+			`{` + zero + `,"market":"m"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.order.Serialize()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, string(got))
+		})
+	}
+}
+
+func TestHeartbeat_Validate(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		heartbeat model.Heartbeat
+		wantErr   bool
+	}{
+		{"ok: armed", model.Heartbeat{Timeout: 30, SubmittedAt: now}, false},
+		{"ok: disarmed", model.Heartbeat{SubmittedAt: now}, false},
+		{"ok: max timeout", model.Heartbeat{Timeout: model.MaxHeartbeatTimeout, SubmittedAt: now}, false},
+		{"ERR: negative timeout", model.Heartbeat{Timeout: -1, SubmittedAt: now}, true},
+		{"ERR: timeout too long", model.Heartbeat{Timeout: model.MaxHeartbeatTimeout + 1, SubmittedAt: now}, true},
+		{"ERR: no submission time", model.Heartbeat{Timeout: 30}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.heartbeat.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestMarketFees(t *testing.T) {
+	d := decimal.RequireFromString
+	fees := model.MarketFees{
+		MakerFee: d("0.001"),
+		TakerFee: d("0.002"),
+		FeeTiers: []model.FeeTier{
+			{MinVolume: d("100000"), MakerFee: d("-0.0005"), TakerFee: d("0.001")},
+			{MinVolume: d("10000"), MakerFee: d("0"), TakerFee: d("0.0015")},
+		},
+	}
+	tests := []struct {
+		name      string
+		fees      model.MarketFees
+		volume    string
+		wantMaker string
+		wantTaker string
+		wantErr   bool
+	}{
+		{"ok: no fees", model.MarketFees{}, "0", "0", "0", false},
+		{"ok: default rates", fees, "9999.99", "0.001", "0.002", false},
+		{"ok: tier reached", fees, "10000", "0", "0.0015", false},
+		{"ok: highest tier reached", fees, "250000", "-0.0005", "0.001", false},
+		{"ERR: negative taker fee", model.MarketFees{TakerFee: d("-0.001")}, "0", "0", "-0.001", true},
+		{"ERR: rebate above the taker fee", model.MarketFees{MakerFee: d("-0.002"), TakerFee: d("0.001")}, "0", "-0.002", "0.001", true},
+		{"ERR: taker fee of 1", model.MarketFees{TakerFee: d("1")}, "0", "0", "1", true},
+		{"ERR: tier without volume", model.MarketFees{FeeTiers: []model.FeeTier{{}}}, "0", "0", "0", true},
+		{"ERR: duplicated tier", model.MarketFees{FeeTiers: []model.FeeTier{{MinVolume: d("10")}, {MinVolume: d("10.0")}}}, "0", "0", "0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.fees.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			maker, taker := tt.fees.Rates(d(tt.volume))
+			assert.True(t, d(tt.wantMaker).Equal(maker), "maker fee %s, want %s", maker, tt.wantMaker)
+			assert.True(t, d(tt.wantTaker).Equal(taker), "taker fee %s, want %s", taker, tt.wantTaker)
+		})
+	}
+}
+
+func TestMarketFees_Charged(t *testing.T) {
+	d := decimal.RequireFromString
+	tests := []struct {
+		name string
+		fees model.MarketFees
+		want bool
+	}{
+		{"no fees", model.MarketFees{}, false},
+		{"zero tiers", model.MarketFees{FeeTiers: []model.FeeTier{{MinVolume: d("10")}}}, false},
+		{"taker fee", model.MarketFees{TakerFee: d("0.001")}, true},
+		{"maker rebate", model.MarketFees{MakerFee: d("-0.001"), TakerFee: d("0.001")}, true},
+		{"tier fee", model.MarketFees{FeeTiers: []model.FeeTier{{MinVolume: d("10"), TakerFee: d("0.001")}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.fees.Charged())
+		})
+	}
+}
+
+func TestMarketRules_ValidateOrder(t *testing.T) {
+	d := decimal.RequireFromString
+	rules := model.MarketRules{
+		TickSize:    d("0.5"),
+		LotSize:     d("0.01"),
+		MinSize:     d("0.1"),
+		MinNotional: d("10"),
+	}
+	order := func(size, price, stopPrice string) model.Order {
+		return model.Order{Market: "0x1", Side: model.SideBid, Size: d(size), Price: price, StopPrice: stopPrice}
+	}
+	tests := []struct {
+		name    string
+		rules   model.MarketRules
+		order   model.Order
+		wantErr bool
+	}{
+		{"ok: no rules", model.MarketRules{}, order("0.001", "0.003", ""), false},
+		{"ok: limit", rules, order("0.25", "100.5", ""), false},
+		{"ok: market", rules, order("0.25", "", ""), false},
+		{"ok: stop", rules, order("0.25", "100", "99.5"), false},
+		{"ERR: below min size", rules, order("0.05", "500", ""), true},
+		{"ERR: not a multiple of the lot size", rules, order("0.255", "100", ""), true},
+		{"ERR: not a multiple of the tick size", rules, order("0.25", "100.1", ""), true},
+		{"ERR: stop not a multiple of the tick size", rules, order("0.25", "100", "99.9"), true},
+		{"ERR: below min notional", rules, order("0.1", "99.5", ""), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rules.ValidateOrder(tt.order)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, model.ErrInvalidOrder)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestLedgerEntry_Validate(t *testing.T) {
+	d := decimal.RequireFromString
+	leg := func(asset, account, orderID, amount string) model.LedgerLeg {
+		return model.LedgerLeg{Address: "0x1", Asset: asset, Account: account, OrderID: orderID, Amount: d(amount)}
+	}
+	tests := []struct {
+		name    string
+		legs    []model.LedgerLeg
+		wantErr bool
+	}{
+		{"ok: no legs", nil, false},
+		{"ok: funding", []model.LedgerLeg{leg("usd", model.LedgerAvailable, "", "10"), leg("usd", model.LedgerExternal, "", "-10")}, false},
+		{"ok: pending deposit", []model.LedgerLeg{leg("usd", model.LedgerPending, "", "10"), leg("usd", model.LedgerExternal, "", "-10")}, false},
+		{"ok: hold", []model.LedgerLeg{leg("usd", model.LedgerAvailable, "", "-10"), leg("usd", model.LedgerHeld, "o1", "10")}, false},
+		{"ok: trade", []model.LedgerLeg{
+			leg("usd", model.LedgerHeld, "o1", "-100"), leg("usd", model.LedgerAvailable, "o1", "2"), leg("usd", model.LedgerAvailable, "o2", "97.9"), leg("usd", model.LedgerAvailable, "", "0.1"),
+			leg("eur", model.LedgerHeld, "o2", "-1"), leg("eur", model.LedgerAvailable, "o1", "1"),
+		}, false},
+		{"ERR: unbalanced", []model.LedgerLeg{leg("usd", model.LedgerAvailable, "", "10"), leg("usd", model.LedgerExternal, "", "-9")}, true},
+		{"ERR: balanced across assets", []model.LedgerLeg{leg("usd", model.LedgerAvailable, "", "10"), leg("eur", model.LedgerExternal, "", "-10")}, true},
+		{"ERR: held without order", []model.LedgerLeg{leg("usd", model.LedgerAvailable, "", "-10"), leg("usd", model.LedgerHeld, "", "10")}, true},
+		{"ERR: unknown account", []model.LedgerLeg{leg("usd", model.LedgerAvailable, "", "-10"), leg("usd", "savings", "", "10")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &model.LedgerEntry{Reason: model.LedgerFunding, Legs: tt.legs}
+			if tt.wantErr {
+				assert.ErrorIs(t, e.Validate(), model.ErrUnbalancedEntry)
+			} else {
+				assert.NoError(t, e.Validate())
+			}
+		})
+	}
+}
@@ -4,25 +4,56 @@ import (
 	"authex/helpers"
 	"authex/model"
 	"authex/network/abi"
+	"context"
 	"fmt"
 	"math/big"
 	"os"
+	"time"
 
 	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/labstack/gommon/log"
 	"github.com/shopspring/decimal"
 )
 
+// backfillChunk is the number of blocks whose transfers are requested at once
+// when the transfers missed while the token was not monitored are recovered
+const backfillChunk = 1000
+
+// reconnectDelay is the time waited before a lost websocket connection is restored
+const reconnectDelay = 5 * time.Second
+
+// Storage records the transfers and the confirmations sent by the client
+type Storage interface {
+	// Transfers returns the channel of the deposits to credit
+	Transfers() chan *model.BalanceChange
+	// Confirmations returns the channel of the blocks whose deposits are confirmed
+	Confirmations() chan *model.Confirmation
+	// GetAssetBlocks returns the first block of a token and the last one with a recorded transfer
+	GetAssetBlocks(address string) (first, last uint64, err error)
+	// SetAssetFirstBlock records the first block of a token, if not set yet
+	SetAssetFirstBlock(address string, block uint64) error
+}
+
+// tokenClient is the connection used to watch the transfers of a token
+type tokenClient interface {
+	bind.ContractBackend
+	BlockNumber(ctx context.Context) (uint64, error)
+}
+
 // NodeClient is the client to interact with the ethereum node
 type NodeClient struct {
 	keystore *keystore.KeyStore
 	signer   accounts.Account
 	client   *ethclient.Client
 	wsURL    string
+	chainID  string
+	// confirmations is the number of blocks a deposit waits before it's credited
+	confirmations uint64
 	// contracts
 	accessControl *abi.AccessControl
 	// when a new token need to be monitored is sent to this
@@ -30,12 +61,12 @@ type NodeClient struct {
 	Tokens chan string
 	// track the currently monitored tokens
 	monitoredTokens map[string]int
-	// channel to send monitored transfers
-	Transfers chan *model.BalanceChange
+	// storage receives the monitored transfers
+	storage Storage
 }
 
 // NewNodeClient create a new node client
-func NewNodeClient(settings *model.Settings, transfers chan *model.BalanceChange) (*NodeClient, error) {
+func NewNodeClient(settings *model.Settings, storage Storage) (*NodeClient, error) {
 	// check if the account has the admin privileges
 	client, err := ethclient.Dial(settings.Network.RPCEndpoint)
 	if err != nil {
@@ -60,16 +91,19 @@ func NewNodeClient(settings *model.Settings, transfers chan *model.BalanceChange
 		keystore:        ks,
 		client:          client,
 		wsURL:           settings.Network.WSEndpoint,
+		chainID:         settings.Network.ChainID,
+		confirmations:   settings.Network.Confirmations,
 		signer:          signer,
 		accessControl:   ac,
 		monitoredTokens: map[string]int{},
 		Tokens:          make(chan string),
-		Transfers:       transfers,
+		storage:         storage,
 	}, nil
 }
 
 // Run begin listening for network events
 func (n *NodeClient) Run() {
+	go n.monitorHeads()
 	monitors := 0
 	for {
 		token, ok := <-n.Tokens
@@ -91,65 +125,190 @@ func (n *NodeClient) Run() {
 
 // monitorToken listen to transfer events for the given erc20 token
 // to and from the CLOB address. This way the CLOB can track balance changes
-// of the users
+// of the users. The connection is restored when it's lost.
 func (n *NodeClient) monitorToken(address string, monitorID int) {
+	for {
+		err := n.watchToken(address, monitorID)
+		log.Errorf("[monitor: %d] %v, reconnecting in %s", monitorID, err, reconnectDelay)
+		time.Sleep(reconnectDelay)
+	}
+}
+
+// watchToken connects to the node and watches the transfers of a token until the connection fails
+func (n *NodeClient) watchToken(address string, monitorID int) error {
 	client, err := ethclient.Dial(n.wsURL)
 	if err != nil {
-		log.Errorf("[monitor: %d] websocket connection: %v", monitorID, err)
-		return
+		return fmt.Errorf("websocket connection: %w", err)
 	}
+	defer client.Close()
+	return n.watch(client, address, monitorID)
+}
+
+// watch subscribes to the transfers of a token, recovers the transfers made since
+// the last one recorded and then sends the transfers of the subscription until it fails
+func (n *NodeClient) watch(client tokenClient, address string, monitorID int) error {
 	contractAddress := common.HexToAddress(address)
 	logs := make(chan *abi.ERC20Transfer)
 
 	erc20, err := abi.NewERC20(contractAddress, client)
 	if err != nil {
-		log.Errorf("[monitor: %d] erc20 contract: %v", monitorID, err)
-		return
+		return fmt.Errorf("erc20 contract: %w", err)
 	}
 
 	// REMEMBER! this is the balance on the CLOB, not of the wallet
 
+	// the subscription starts before the head is read, so that no transfer is missed
+	// between the recovered ones and the live ones, the transfers sent twice are
+	// credited once
 	sub, err := erc20.WatchTransfer(&bind.WatchOpts{}, logs, nil, nil)
+	if err != nil {
+		return fmt.Errorf("logs subscription filter: %w", err)
+	}
 	defer sub.Unsubscribe()
-
+	head, err := client.BlockNumber(context.Background())
 	if err != nil {
-		log.Errorf("[monitor: %d] logs subscription filter: %v", monitorID, err)
-		return
+		return fmt.Errorf("chain head: %w", err)
+	}
+	first, last, err := n.storage.GetAssetBlocks(address)
+	if err != nil {
+		return fmt.Errorf("token blocks: %w", err)
+	}
+	// a token without a recorded block is watched from the current head,
+	// the head is recorded so that the next connection starts from there
+	if first == 0 && last == 0 {
+		if err = n.storage.SetAssetFirstBlock(address, head); err != nil {
+			return fmt.Errorf("token first block: %w", err)
+		}
+		first = head
+	}
+	// the last block is scanned again, its transfers are recorded one by one
+	// and the ones already recorded are credited once
+	from := first
+	if last >= from {
+		from = last
+	}
+	if err = n.backfill(erc20, address, monitorID, from, head); err != nil {
+		return err
 	}
 
 	for {
 		select {
 		case err = <-sub.Err():
-			log.Errorf("[monitor: %d] log: %v", monitorID, err)
+			return fmt.Errorf("log: %w", err)
 		case t := <-logs:
+			n.sendTransfer(address, monitorID, t)
+		}
+	}
+}
 
-			log.Infof("[monitor: %d] transfer: %v", monitorID, t)
-			if helpers.IsZeroAddress(t.From) {
-				continue
-			}
-			if helpers.IsZeroAddress(t.To) {
-				continue
-			}
+// backfill sends the transfers of a token from a block to the head of the chain,
+// requested in chunks of blocks, the subscription buffers the live ones meanwhile
+func (n *NodeClient) backfill(erc20 *abi.ERC20, address string, monitorID int, from, head uint64) error {
+	for start := from; start <= head; start += backfillChunk {
+		end := start + backfillChunk - 1
+		if end > head {
+			end = head
+		}
+		log.Infof("[monitor: %d] recovering the transfers of blocks %d-%d", monitorID, start, end)
+		it, err := erc20.FilterTransfer(&bind.FilterOpts{Start: start, End: &end}, nil, nil)
+		if err != nil {
+			return fmt.Errorf("transfers of blocks %d-%d: %w", start, end, err)
+		}
+		for it.Next() {
+			n.sendTransfer(address, monitorID, it.Event)
+		}
+		err = it.Error()
+		it.Close()
+		if err != nil {
+			return fmt.Errorf("transfers of blocks %d-%d: %w", start, end, err)
+		}
+	}
+	return nil
+}
 
-			var deltas []*model.BalanceDelta
-			if t.From.Hex() == n.signer.Address.Hex() {
-				d := decimal.NewFromBigInt(t.Value.Neg(t.Value), 0)
-				// it's a withdrawal
-				deltas = append(deltas, model.NewBalanceDelta(t.From.Hex(), d))
-			} else {
-				// is a deposit
-				d := decimal.NewFromBigInt(t.Value, 0)
-				deltas = append(deltas, model.NewBalanceDelta(t.To.Hex(), d))
-			}
-			n.Transfers <- &model.BalanceChange{
-				TokenAddress: address,
-				BlockNumber:  t.Raw.BlockNumber,
-				Deltas:       deltas,
+// sendTransfer sends a transfer of a token to the storage
+func (n *NodeClient) sendTransfer(address string, monitorID int, t *abi.ERC20Transfer) {
+	log.Infof("[monitor: %d] transfer: %v, removed: %t", monitorID, t, t.Raw.Removed)
+	if helpers.IsZeroAddress(t.From) {
+		return
+	}
+	if helpers.IsZeroAddress(t.To) {
+		return
+	}
+
+	var deltas []*model.BalanceDelta
+	if t.From.Hex() == n.signer.Address.Hex() {
+		d := decimal.NewFromBigInt(t.Value.Neg(t.Value), 0)
+		// it's a withdrawal
+		deltas = append(deltas, model.NewBalanceDelta(t.From.Hex(), d))
+	} else {
+		// is a deposit
+		d := decimal.NewFromBigInt(t.Value, 0)
+		deltas = append(deltas, model.NewBalanceDelta(t.To.Hex(), d))
+	}
+	// the log identifies the transfer, so that it is credited once,
+	// a removed log reverses the transfer if it's not confirmed yet
+	n.storage.Transfers() <- &model.BalanceChange{
+		TokenAddress: address,
+		BlockNumber:  t.Raw.BlockNumber,
+		ChainID:      n.chainID,
+		TxHash:       t.Raw.TxHash.Hex(),
+		LogIndex:     t.Raw.Index,
+		Removed:      t.Raw.Removed,
+		Deltas:       deltas,
+	}
+}
+
+// monitorHeads listen to the new blocks of the chain and confirms the deposits
+// of the blocks that have enough confirmations. The connection is restored when it's lost.
+func (n *NodeClient) monitorHeads() {
+	for {
+		err := n.watchHeads()
+		log.Errorf("[heads] %v, reconnecting in %s", err, reconnectDelay)
+		time.Sleep(reconnectDelay)
+	}
+}
+
+// watchHeads subscribes to the new blocks of the chain until the subscription fails
+func (n *NodeClient) watchHeads() error {
+	client, err := ethclient.Dial(n.wsURL)
+	if err != nil {
+		return fmt.Errorf("websocket connection: %w", err)
+	}
+	defer client.Close()
+	heads := make(chan *types.Header)
+	sub, err := client.SubscribeNewHead(context.Background(), heads)
+	if err != nil {
+		return fmt.Errorf("new heads subscription: %w", err)
+	}
+	defer sub.Unsubscribe()
+
+	for {
+		select {
+		case err = <-sub.Err():
+			return fmt.Errorf("subscription: %w", err)
+		case h := <-heads:
+			block, ok := confirmedBlock(h.Number.Uint64(), n.confirmations)
+			if !ok {
+				continue
 			}
+			n.storage.Confirmations() <- &model.Confirmation{ChainID: n.chainID, BlockNumber: block}
 		}
 	}
 }
 
+// confirmedBlock returns the last block that has the confirmations at the head
+// of the chain, the head counts as the first confirmation of its block
+func confirmedBlock(head, confirmations uint64) (uint64, bool) {
+	if confirmations == 0 {
+		return head, true
+	}
+	if head+1 < confirmations {
+		return 0, false
+	}
+	return head + 1 - confirmations, true
+}
+
 // GetSigner return the address of the signer account for this server instance
 func (n *NodeClient) GetSigner() string {
 	return n.signer.Address.Hex()
@@ -0,0 +1,172 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"authex/db"
+	"authex/model"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testChain is a node that serves the transfer logs of a token,
+// the live logs are sent to the last subscription
+type testChain struct {
+	bind.ContractBackend
+	mu   sync.Mutex
+	head uint64
+	logs []types.Log
+	live chan<- types.Log
+	errs chan error
+}
+
+func (c *testChain) BlockNumber(_ context.Context) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.head, nil
+}
+
+func (c *testChain) FilterLogs(_ context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	logs := make([]types.Log, 0)
+	for _, l := range c.logs {
+		if l.BlockNumber >= q.FromBlock.Uint64() && l.BlockNumber <= q.ToBlock.Uint64() {
+			logs = append(logs, l)
+		}
+	}
+	return logs, nil
+}
+
+func (c *testChain) SubscribeFilterLogs(_ context.Context, _ ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.live, c.errs = ch, make(chan error, 1)
+	return &testSubscription{errs: c.errs}, nil
+}
+
+// mine adds a log to the chain and sends it to the subscription
+func (c *testChain) mine(l types.Log) {
+	c.mu.Lock()
+	c.logs = append(c.logs, l)
+	if l.BlockNumber > c.head {
+		c.head = l.BlockNumber
+	}
+	live := c.live
+	c.mu.Unlock()
+	if live != nil {
+		live <- l
+	}
+}
+
+// disconnect fails the subscription, the logs mined meanwhile are not sent
+func (c *testChain) disconnect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errs <- errors.New("connection lost")
+	c.live = nil
+}
+
+type testSubscription struct {
+	errs chan error
+}
+
+func (s *testSubscription) Err() <-chan error { return s.errs }
+func (s *testSubscription) Unsubscribe()      {}
+
+// transferLog returns the log of a transfer of a token
+func transferLog(token, from, to common.Address, value int64, block uint64, tx string, index uint) types.Log {
+	return types.Log{
+		Address: token,
+		Topics: []common.Hash{
+			crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)")),
+			common.BytesToHash(from.Bytes()),
+			common.BytesToHash(to.Bytes()),
+		},
+		Data:        common.LeftPadBytes(big.NewInt(value).Bytes(), 32),
+		BlockNumber: block,
+		TxHash:      common.HexToHash(tx),
+		Index:       index,
+	}
+}
+
+// TestNodeClient_watch tests that the transfers are credited once
+// when the logs of a block are received across a disconnection
+func TestNodeClient_watch(t *testing.T) {
+	var (
+		token  = common.HexToAddress("0x1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d")
+		sender = common.HexToAddress("0x5c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d")
+		alice  = common.HexToAddress("0xaa992902d88EA6192585B72D0B01C020F036bb99")
+		bob    = common.HexToAddress("0xbb992902d88EA6192585B72D0B01C020F036bb99")
+	)
+	storage := db.NewMemory(&model.Settings{})
+	go storage.Run()
+	defer storage.Close()
+	base, quote := model.NewERC20Token("TKN", token.Hex()), model.NewOffChainAsset("EUR")
+	require.NoError(t, storage.SaveMarket("0x6f1b5a1e3c7d2b4a8e9f0c1d2e3f4a5b6c7d8e9f", base, quote, model.MarketRules{}, model.MarketFees{}))
+
+	n := &NodeClient{chainID: "1", storage: storage, signer: accounts.Account{Address: common.HexToAddress("0xcc992902d88EA6192585B72D0B01C020F036bb99")}}
+	chain := &testChain{head: 4}
+	watch := func() chan error {
+		done := make(chan error, 1)
+		go func() { done <- n.watch(chain, token.Hex(), 1) }()
+		require.Eventually(t, func() bool {
+			chain.mu.Lock()
+			defer chain.mu.Unlock()
+			return chain.live != nil
+		}, time.Second, time.Millisecond)
+		return done
+	}
+	lastBlock := func(block uint64) func() bool {
+		return func() bool {
+			_, last, err := storage.GetAssetBlocks(token.Hex())
+			return err == nil && last == block
+		}
+	}
+
+	// the first transfer of block 5 is received, then the connection is lost
+	done := watch()
+	chain.mine(transferLog(token, sender, alice, 10, 5, "0xa", 0))
+	require.Eventually(t, lastBlock(5), time.Second, time.Millisecond)
+	chain.disconnect()
+	assert.Error(t, <-done)
+	// the rest of block 5 and block 7 are mined while disconnected
+	chain.mine(transferLog(token, sender, bob, 20, 5, "0xa", 1))
+	chain.mine(transferLog(token, sender, alice, 5, 7, "0xb", 0))
+
+	// the transfers are recovered when the connection is restored
+	done = watch()
+	require.Eventually(t, lastBlock(7), time.Second, time.Millisecond)
+	chain.disconnect()
+	assert.Error(t, <-done)
+
+	// each transfer is credited once
+	first, _, err := storage.GetAssetBlocks(token.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), first)
+	for address, want := range map[common.Address]int64{alice: 15, bob: 20} {
+		deposits, err := storage.GetDeposits(address.Hex(), 10)
+		require.NoError(t, err)
+		total := decimal.Zero
+		for _, d := range deposits {
+			total = total.Add(d.Amount)
+		}
+		assert.True(t, decimal.NewFromInt(want).Equal(total), "%s deposits %s, want %d", address.Hex(), total, want)
+	}
+	deposits, err := storage.GetDeposits(alice.Hex(), 10)
+	require.NoError(t, err)
+	assert.Len(t, deposits, 2)
+}
@@ -9,6 +9,7 @@ import (
 	"html/template"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"authex/clob"
@@ -17,6 +18,7 @@ import (
 	"authex/model"
 	"authex/network"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -34,7 +36,7 @@ type AuthexServer struct {
 	runtime *Runtime
 	clobCli *clob.Pool
 	nodeCli *network.NodeClient
-	dbCli   *db.Connection
+	dbCli   db.Storage
 }
 
 // Endpoint is a REST endpoint
@@ -52,14 +54,24 @@ type Route struct {
 }
 
 const (
-	keyRequestID = "request-id"
-	keyOrderID   = "order-id"
-	valError     = "error"
-	valSuccess   = "ok"
+	keyRequestID   = "request-id"
+	keyOrderID     = "order-id"
+	keyAmendmentID = "amendment-id"
+	valError       = "error"
+	valSuccess     = "ok"
 )
 
+// defaultDepthLimit is the number of price levels per side returned by default
+const defaultDepthLimit = 10
+
+// defaultLedgerLimit is the number of ledger entries returned by default
+const defaultLedgerLimit = 100
+
+// defaultDepositLimit is the number of deposits returned by default
+const defaultDepositLimit = 100
+
 // NewAuthexServer creates a new CLOB server
-func NewAuthexServer(opts *model.Settings, clobCli *clob.Pool, nodeCli *network.NodeClient, dbCli *db.Connection) (AuthexServer, error) {
+func NewAuthexServer(opts *model.Settings, clobCli *clob.Pool, nodeCli *network.NodeClient, dbCli db.Storage) (AuthexServer, error) {
 	var err error
 
 	r := AuthexServer{
@@ -113,6 +125,12 @@ func NewAuthexServer(opts *model.Settings, clobCli *clob.Pool, nodeCli *network.
 					Handler: r.handleAuthorization,
 					Help:    "Add/remove an account to the access list",
 				},
+				{
+					Path:    "/orders/cancel-all",
+					Method:  http.MethodPost,
+					Handler: r.forceCancelAll,
+					Help:    "Cancel all the orders of a market",
+				},
 			},
 		},
 		{
@@ -137,6 +155,18 @@ func NewAuthexServer(opts *model.Settings, clobCli *clob.Pool, nodeCli *network.
 					Handler: r.getMarketQuote,
 					Help:    "Get a market quote",
 				},
+				{
+					Path:    "/markets/:address/depth",
+					Method:  http.MethodGet,
+					Handler: r.getMarketDepth,
+					Help:    "Get the aggregated price levels of a market",
+				},
+				{
+					Path:    "/markets/:address/trades",
+					Method:  http.MethodGet,
+					Handler: r.getMarketTrades,
+					Help:    "Get the trades of a market, with their fees",
+				},
 				{
 					Path:    "/orders/:id",
 					Method:  http.MethodGet,
@@ -168,6 +198,24 @@ func NewAuthexServer(opts *model.Settings, clobCli *clob.Pool, nodeCli *network.
 					Handler: r.cancelOrder,
 					Help:    "Cancel an order",
 				},
+				{
+					Path:    "/orders/cancel-all",
+					Method:  http.MethodPost,
+					Handler: r.cancelAll,
+					Help:    "Cancel all the orders of an account, optionally of one market or side",
+				},
+				{
+					Path:    "/heartbeat",
+					Method:  http.MethodPost,
+					Handler: r.heartbeat,
+					Help:    "Arm the dead man's switch that cancels the orders of an account",
+				},
+				{
+					Path:    "/orders/amend",
+					Method:  http.MethodPost,
+					Handler: r.amendOrder,
+					Help:    "Change the price and/or the size of an order",
+				},
 				{
 					Path:    "/withdraw",
 					Method:  http.MethodPost,
@@ -186,6 +234,24 @@ func NewAuthexServer(opts *model.Settings, clobCli *clob.Pool, nodeCli *network.
 					Handler: r.getOrder,
 					Help:    "Get all orders for an account",
 				},
+				{
+					Path:    "/:address/balances",
+					Method:  http.MethodGet,
+					Handler: r.getBalances,
+					Help:    "Get the available, locked, total and pending balances of an account",
+				},
+				{
+					Path:    "/:address/ledger",
+					Method:  http.MethodGet,
+					Handler: r.getLedger,
+					Help:    "Get the ledger entries that moved the balances of an account",
+				},
+				{
+					Path:    "/:address/deposits",
+					Method:  http.MethodGet,
+					Handler: r.getDeposits,
+					Help:    "Get the deposits of an account, pending or confirmed",
+				},
 				{
 					Path:    "/:address/balance/:symbol",
 					Method:  http.MethodGet,
@@ -294,18 +360,17 @@ func (r AuthexServer) isAuthorized(address string) (err error) {
 	return
 }
 
-func (r AuthexServer) isAdmin(c echo.Context, signature string, payload model.Serializable) error {
-	requestID := reqID(c)
+func (r AuthexServer) isAdmin(signature string, payload model.Serializable) error {
 	sender, err := extractAddress(signature, payload)
 	if err != nil {
-		return c.JSON(http.StatusUnauthorized, er(requestID, err.Error()))
+		return err
 	}
 	isAdmin, err := r.nodeCli.IsAdmin(sender)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, er(requestID, err.Error()))
+		return err
 	}
 	if !isAdmin {
-		return c.JSON(http.StatusUnauthorized, er(requestID, "only the admin can perform this action"))
+		return fmt.Errorf("only the admin can perform this action")
 	}
 	return nil
 }
@@ -320,7 +385,7 @@ func (r AuthexServer) registerMarket(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, er(requestID, "invalid market request"))
 	}
 	// admin only
-	if err := r.isAdmin(c, cmr.Signature, cmr.Payload); err != nil {
+	if err := r.isAdmin(cmr.Signature, cmr.Payload); err != nil {
 		log.Errorf("error registering market: %v, [incident: %s]", err, requestID)
 		return c.JSON(http.StatusUnauthorized, er(requestID, "unauthorized"))
 	}
@@ -348,6 +413,18 @@ func (r AuthexServer) registerMarket(c echo.Context) error {
 		return
 	}
 
+	if err := cmr.Payload.MarketRules.Validate(); err != nil {
+		log.Errorf("error validating market rules: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusBadRequest, er(requestID, err.Error()))
+	}
+	if err := cmr.Payload.MarketFees.Validate(); err != nil {
+		log.Errorf("error validating market fees: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusBadRequest, er(requestID, err.Error()))
+	}
+	if h.IsEmpty(r.opts.Fees.Account) && cmr.Payload.MarketFees.Charged() {
+		log.Errorf("market fees without a fee account, [incident: %s]", requestID)
+		return c.JSON(http.StatusBadRequest, er(requestID, "the market charges fees but the server has no fee account"))
+	}
 	// set the base and quote tokens
 	base, err := parseToken(cmr.Payload.BaseSymbol, cmr.Payload.BaseAddress)
 	if err != nil {
@@ -367,12 +444,13 @@ func (r AuthexServer) registerMarket(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, er(requestID, "invalid addresses for base or quote"))
 	}
 	log.Infof("new market address: %s", marketAddr)
-	if err = r.dbCli.SaveMarket(marketAddr, base, quote); err != nil {
+	if err = r.dbCli.SaveMarket(marketAddr, base, quote, cmr.Payload.MarketRules, cmr.Payload.MarketFees); err != nil {
 		log.Errorf("error saving market: %s [incident: %s]", err.Error(), requestID)
 		return c.JSON(http.StatusInternalServerError, er(requestID, "error saving market"))
 	}
 	// open the market
 	r.clobCli.OpenMarket(marketAddr)
+	r.clobCli.SetMarketRules(marketAddr, cmr.Payload.MarketRules)
 	// start listening
 	if base.IsERC20() {
 		r.nodeCli.Tokens <- base.Address
@@ -393,8 +471,9 @@ func (r AuthexServer) getMarketByAddress(c echo.Context) error {
 		log.Errorf("error getting market: %s [incident: %s]", err.Error(), requestID)
 		return c.JSON(http.StatusNotFound, er(requestID, "market not found"))
 	}
-	// TODO: add the market dept
-	m.OrderBook = r.clobCli.GetOrderBook(marketID)
+	if m.Depth, err = r.clobCli.GetDepth(marketID, defaultDepthLimit, decimal.Zero); err != nil {
+		log.Warnf("error getting market depth: %s [incident: %s]", err.Error(), requestID)
+	}
 	return c.JSON(http.StatusOK, ok(requestID, withData("market", m)))
 }
 
@@ -419,7 +498,7 @@ func (r AuthexServer) fund(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, er(requestID, "invalid funding request"))
 	}
 	// admin only
-	if err := r.isAdmin(c, req.Signature, req.Payload); err != nil {
+	if err := r.isAdmin(req.Signature, req.Payload); err != nil {
 		log.Errorf("error funding account: %v, [incident: %s]", err, requestID)
 		return c.JSON(http.StatusUnauthorized, er(requestID, "unauthorized"))
 	}
@@ -436,7 +515,7 @@ func (r AuthexServer) fund(c echo.Context) error {
 			model.NewBalanceDelta(req.Payload.Account, amount),
 		},
 	}
-	r.dbCli.Transfers <- bc
+	r.dbCli.Transfers() <- bc
 	return c.JSON(http.StatusOK, ok(requestID, withMsg("scheduled")))
 }
 
@@ -450,7 +529,7 @@ func (r AuthexServer) handleAuthorization(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, er(requestID, "invalid authorization request"))
 	}
 	// admin only
-	if err := r.isAdmin(c, req.Signature, req.Payload); err != nil {
+	if err := r.isAdmin(req.Signature, req.Payload); err != nil {
 		log.Errorf("error authorizing account: %v, [incident: %s]", err, requestID)
 		return c.JSON(http.StatusUnauthorized, er(requestID, "unauthorized"))
 	}
@@ -499,25 +578,60 @@ func (r AuthexServer) postOrder(c echo.Context) error {
 	// validate the order
 	if err = req.Payload.Validate(); err != nil {
 		log.Errorf("error validating order: %v, [incident: %s]", err, requestID)
-		return c.JSON(http.StatusBadRequest, er(requestID, "invalid order"))
+		return c.JSON(http.StatusBadRequest, er(requestID, fmt.Sprintf("invalid order: %v", err)))
 	}
 	// it's a market order or a limit order?
+	// stop market orders are quoted when they are triggered
 	var quote decimal.Decimal
-	if h.IsEmpty(req.Payload.Price) {
-		size := decimal.NewFromInt(int64(req.Payload.Size))
-		quote, err = r.clobCli.GetQuote(req.Payload.Market, req.Payload.Side, size)
+	if h.IsEmpty(req.Payload.Price) && !req.Payload.IsStop() {
+		quote, err = r.clobCli.GetQuote(req.Payload.Market, req.Payload.Side, req.Payload.Size)
 		if err != nil {
 			log.Errorf("error getting quote: %v, [incident: %s]", err, requestID)
 			return c.JSON(http.StatusBadRequest, er(requestID, "order cannot be processed"))
 		}
+		// the order cannot trade beyond the worst price walked in the book plus the slippage,
+		// the funds of market bids are reserved at that price
+		worst, err := r.clobCli.GetWorstPrice(req.Payload.Market, req.Payload.Side, req.Payload.Size)
+		if err != nil {
+			log.Errorf("error getting worst price: %v, [incident: %s]", err, requestID)
+			return c.JSON(http.StatusBadRequest, er(requestID, "order cannot be processed"))
+		}
+		slippage := r.opts.CLOB.MarketSlippage
+		if req.Payload.Side == model.SideAsk {
+			slippage = slippage.Neg()
+		}
+		req.Payload.ProtectionPrice = worst.Mul(decimal.NewFromInt(1).Add(slippage)).String()
+	} else if h.IsEmpty(req.Payload.Price) {
+		// stop market orders cannot trade beyond their stop price plus the slippage,
+		// the funds of stop market bids are reserved at that price
+		stopPrice, err := h.ParseAmount(req.Payload.StopPrice)
+		if err != nil {
+			log.Errorf("error parsing stop price: %v, [incident: %s]", err, requestID)
+			return c.JSON(http.StatusBadRequest, er(requestID, "invalid stop price"))
+		}
+		slippage := r.opts.CLOB.MarketSlippage
+		if req.Payload.Side == model.SideAsk {
+			slippage = slippage.Neg()
+		}
+		req.Payload.ProtectionPrice = stopPrice.Mul(decimal.NewFromInt(1).Add(slippage)).String()
+	} else {
+		// the protection price is populated by the server
+		req.Payload.ProtectionPrice = ""
 	}
 	// TODO this modifies the order (assign the ID), refactor
 	if err = r.dbCli.ValidateOrder(&req.Payload, sender, quote); err != nil {
 		log.Errorf("error validating order on db: %v, [incident: %s]", err, requestID)
+		// report the market rules that the order does not comply with
+		if errors.Is(err, model.ErrInvalidOrder) {
+			return c.JSON(http.StatusBadRequest, er(requestID, err.Error()))
+		}
 		return c.JSON(http.StatusBadRequest, er(requestID, "invalid order"))
 	}
 	// queue the order for processing
-	r.clobCli.Inbound <- req
+	if err = r.clobCli.Submit(req); err != nil {
+		log.Errorf("error submitting order: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusServiceUnavailable, er(requestID, "order not accepted"))
+	}
 	// reply with the order
 	return c.JSON(http.StatusOK, ok(requestID, withData(keyOrderID, req.Payload.ID)))
 }
@@ -541,35 +655,230 @@ func (r AuthexServer) cancelOrder(c echo.Context) error {
 	}
 
 	// handle cancel orders
-	_, from, status, err := r.dbCli.GetOrder(req.Payload.ID)
+	order, from, status, err := r.dbCli.GetOrder(req.Payload.ID)
 	if err != nil {
 		log.Errorf("error getting order: %v, [incident: %s]", err, requestID)
 		return c.JSON(http.StatusBadRequest, er(requestID, "invalid order"))
 	}
 	if from != sender {
-		log.Errorf("error order owner and request sender mismatch, [incident: %s]", err, requestID)
+		log.Errorf("error order owner and request sender mismatch, [incident: %s]", requestID)
 		return c.JSON(http.StatusUnauthorized, er(requestID, "unauthorized"))
 	}
-	if status != model.StatusOpen {
-		log.Errorf("error order is filled, [incident: %s]", err, requestID)
+	if model.IsClosed(status) {
+		log.Errorf("error order is filled, [incident: %s]", requestID)
 		return c.JSON(http.StatusUnauthorized, er(requestID, "processed"))
 	}
+	// route the cancellation to the order book (or trigger book) of the order
+	req.Payload.Market = order.Market
+	req.Payload.Side = model.CancelOrder
 	// queue the order for processing
-	r.clobCli.Inbound <- req
+	if err = r.clobCli.Submit(req); err != nil {
+		log.Errorf("error submitting cancellation: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusServiceUnavailable, er(requestID, "cancellation not accepted"))
+	}
 	return c.JSON(http.StatusOK, ok(requestID, withData(keyOrderID, req.Payload.ID), withMsg("scheduled")))
 }
 
+// cancelAll cancels the open orders of the sender, the request
+// market and side (if set) limit the orders cancelled
+func (r AuthexServer) cancelAll(c echo.Context) error {
+	requestID := reqID(c)
+	req := &model.SignedRequest[model.Order]{}
+	if err := c.Bind(req); err != nil {
+		log.Errorf("error binding request: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusBadRequest, er(requestID, "invalid cancel request"))
+	}
+	// extract the address from the signature
+	sender, err := extractAddress(req.Signature, req.Payload)
+	if err != nil {
+		log.Errorf("error extracting account address: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusUnauthorized, er(requestID, "error extracting account address"))
+	}
+	if err = r.isAuthorized(sender); err != nil {
+		log.Errorf("error authorizing address: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusUnauthorized, er(requestID, "unauthorized"))
+	}
+	// a cancel request sent again must not cancel the orders placed since
+	if time.Since(req.Payload.SubmittedAt) > 2*time.Second {
+		log.Errorf("error validating cancel request: request is older than 2 seconds, [incident: %s]", requestID)
+		return c.JSON(http.StatusBadRequest, er(requestID, "cancel request is older than 2 seconds"))
+	}
+	return r.cancelOrders(c, sender, req.Payload.Market, req.Payload.Side, "")
+}
+
+// forceCancelAll cancels the open orders of all the accounts in the request market,
+// the request side (if set) limits the orders cancelled
+func (r AuthexServer) forceCancelAll(c echo.Context) error {
+	requestID := reqID(c)
+	req := &model.SignedRequest[model.Order]{}
+	if err := c.Bind(req); err != nil {
+		log.Errorf("error binding request: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusBadRequest, er(requestID, "invalid cancel request"))
+	}
+	// admin only
+	if err := r.isAdmin(req.Signature, req.Payload); err != nil {
+		log.Errorf("error cancelling orders: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusUnauthorized, er(requestID, "unauthorized"))
+	}
+	if time.Since(req.Payload.SubmittedAt) > 2*time.Second {
+		log.Errorf("error validating cancel request: request is older than 2 seconds, [incident: %s]", requestID)
+		return c.JSON(http.StatusBadRequest, er(requestID, "cancel request is older than 2 seconds"))
+	}
+	if h.IsEmpty(req.Payload.Market) {
+		return c.JSON(http.StatusBadRequest, er(requestID, "market must be set"))
+	}
+	return r.cancelOrders(c, "", req.Payload.Market, req.Payload.Side, model.ReasonAdmin)
+}
+
+// cancelOrders cancels the open orders of an owner (of all the owners if empty)
+// and replies with the IDs of the cancelled orders
+func (r AuthexServer) cancelOrders(c echo.Context, owner, market, side, reason string) error {
+	requestID := reqID(c)
+	if side != "" && side != model.SideBid && side != model.SideAsk {
+		return c.JSON(http.StatusBadRequest, er(requestID, fmt.Sprintf("side is either bid or ask, got %s", side)))
+	}
+	cancelled, err := r.clobCli.CancelAll(owner, market, side, reason)
+	if err != nil {
+		log.Errorf("error cancelling orders: %v, [incident: %s]", err, requestID)
+		if errors.Is(err, model.ErrMarketNotFound) {
+			return c.JSON(http.StatusNotFound, er(requestID, "market not found"))
+		}
+		// the orders cancelled before the error are reported
+		return c.JSON(http.StatusServiceUnavailable, er(requestID, "cancellation not completed", withData("cancelled", cancelled)))
+	}
+	return c.JSON(http.StatusOK, ok(requestID, withData("cancelled", cancelled)))
+}
+
+// heartbeat arms the dead man's switch of the sender: the open orders of the
+// account are cancelled if no other heartbeat arrives before the timeout
+func (r AuthexServer) heartbeat(c echo.Context) error {
+	requestID := reqID(c)
+	req := &model.SignedRequest[model.Heartbeat]{}
+	if err := c.Bind(req); err != nil {
+		log.Errorf("error binding request: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusBadRequest, er(requestID, "invalid heartbeat request"))
+	}
+	// extract the address from the signature
+	sender, err := extractAddress(req.Signature, req.Payload)
+	if err != nil {
+		log.Errorf("error extracting account address: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusUnauthorized, er(requestID, "error extracting account address"))
+	}
+	if err = r.isAuthorized(sender); err != nil {
+		log.Errorf("error authorizing address: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusUnauthorized, er(requestID, "unauthorized"))
+	}
+	if err = req.Payload.Validate(); err != nil {
+		log.Errorf("error validating heartbeat: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusBadRequest, er(requestID, fmt.Sprintf("invalid heartbeat: %v", err)))
+	}
+	// a heartbeat sent again must not keep the switch armed
+	if time.Since(req.Payload.SubmittedAt) > 2*time.Second {
+		log.Errorf("error validating heartbeat: heartbeat is older than 2 seconds, [incident: %s]", requestID)
+		return c.JSON(http.StatusBadRequest, er(requestID, "heartbeat is older than 2 seconds"))
+	}
+	expiresAt, err := r.clobCli.Heartbeat(sender, time.Duration(req.Payload.Timeout)*time.Second)
+	if err != nil {
+		log.Errorf("error arming heartbeat: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusServiceUnavailable, er(requestID, "heartbeat not accepted"))
+	}
+	if expiresAt.IsZero() {
+		return c.JSON(http.StatusOK, ok(requestID, withMsg("disarmed")))
+	}
+	return c.JSON(http.StatusOK, ok(requestID, withData("expires_at", expiresAt)))
+}
+
+// amendOrder changes the price and/or the open size of an order
+func (r AuthexServer) amendOrder(c echo.Context) error {
+	requestID := reqID(c)
+	req := &model.SignedRequest[model.Order]{}
+	if err := c.Bind(req); err != nil {
+		log.Errorf("error binding request: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusBadRequest, er(requestID, "invalid amend request"))
+	}
+	// extract the address from the signature
+	sender, err := extractAddress(req.Signature, req.Payload)
+	if err != nil {
+		log.Errorf("error extracting account address: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusUnauthorized, er(requestID, "error extracting account address"))
+	}
+	if err = r.isAuthorized(sender); err != nil {
+		log.Errorf("error authorizing address: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusUnauthorized, er(requestID, "unauthorized"))
+	}
+	if err = req.Payload.ValidateAmendment(); err != nil {
+		log.Errorf("error validating amendment: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusBadRequest, er(requestID, fmt.Sprintf("invalid amendment: %v", err)))
+	}
+	order, from, status, err := r.dbCli.GetOrder(req.Payload.Amends)
+	if err != nil {
+		log.Errorf("error getting order: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusBadRequest, er(requestID, "invalid order"))
+	}
+	if from != sender {
+		log.Errorf("error order owner and request sender mismatch, [incident: %s]", requestID)
+		return c.JSON(http.StatusUnauthorized, er(requestID, "unauthorized"))
+	}
+	if model.IsClosed(status) {
+		log.Errorf("error order is closed, [incident: %s]", requestID)
+		return c.JSON(http.StatusBadRequest, er(requestID, "processed"))
+	}
+	// TODO this modifies the amendment (assign the ID), refactor
+	if err = r.dbCli.ValidateAmendment(&req.Payload, order); err != nil {
+		log.Errorf("error validating amendment on db: %v, [incident: %s]", err, requestID)
+		if errors.Is(err, model.ErrInvalidOrder) {
+			return c.JSON(http.StatusBadRequest, er(requestID, err.Error()))
+		}
+		return c.JSON(http.StatusBadRequest, er(requestID, "invalid amendment"))
+	}
+	// route the amendment to the order book (or trigger book) of the order
+	req.From = sender
+	req.Payload.Market = order.Market
+	req.Payload.Side = model.AmendOrder
+	req.Payload.RecordedAt = time.Now().UTC()
+	// queue the amendment for processing
+	if err = r.clobCli.Submit(req); err != nil {
+		log.Errorf("error submitting amendment: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusServiceUnavailable, er(requestID, "amendment not accepted"))
+	}
+	return c.JSON(http.StatusOK, ok(requestID,
+		withData(keyOrderID, order.ID),
+		withData(keyAmendmentID, req.Payload.ID),
+		withMsg("scheduled")))
+}
+
 func (r AuthexServer) getOrder(c echo.Context) error {
 	requestID := reqID(c)
 	orderID := c.Param("id")
-	order, _, status, err := r.dbCli.GetOrder(orderID)
+	order, _, _, err := r.dbCli.GetOrder(orderID)
 	if err != nil {
 		log.Errorf("error getting order: %v, [incident: %s]", err, requestID)
 		return c.JSON(http.StatusNotFound, er(requestID, "order not found"))
 	}
+	state, err := r.dbCli.GetOrderState(orderID)
+	if err != nil {
+		log.Errorf("error getting order state: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusInternalServerError, er(requestID, "order cannot be retrieved"))
+	}
+	_, displayed, err := r.dbCli.GetOrderRemaining(orderID)
+	if err != nil {
+		log.Errorf("error getting order remaining size: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusInternalServerError, er(requestID, "order cannot be retrieved"))
+	}
+	fees, err := r.dbCli.GetOrderFees(orderID)
+	if err != nil {
+		log.Errorf("error getting order fees: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusInternalServerError, er(requestID, "order cannot be retrieved"))
+	}
 	return c.JSON(http.StatusOK, ok(requestID,
 		withData("order", order),
-		withData("status", status),
+		withData("status", state.Status),
+		withData("filled", state.Filled),
+		withData("remaining", state.Remaining),
+		withData("average_price", state.AveragePrice),
+		withData("history", state.History),
+		withData("displayed", displayed),
+		withData("fees", fees),
 	))
 }
 
@@ -577,6 +886,74 @@ func (r AuthexServer) withdraw(c echo.Context) error {
 	return c.JSON(http.StatusNotImplemented, er(c.Get(keyRequestID).(string), "not implemented"))
 }
 
+// getBalances returns the balances of an account, the locked amount
+// is held by the open orders of the account
+func (r AuthexServer) getBalances(c echo.Context) error {
+	requestID := reqID(c)
+	if !common.IsHexAddress(c.Param("address")) {
+		return c.JSON(http.StatusBadRequest, er(requestID, "invalid address"))
+	}
+	// the accounts are recorded with the checksum address
+	address := common.HexToAddress(c.Param("address")).Hex()
+	balances, err := r.dbCli.GetBalances(address)
+	if err != nil {
+		log.Errorf("error getting balances: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusInternalServerError, er(requestID, "error getting balances"))
+	}
+	return c.JSON(http.StatusOK, ok(requestID, withData("address", address), withData("balances", balances)))
+}
+
+// getLedger returns the latest ledger entries of an account, the asset
+// and limit query params select the asset and the number of entries
+func (r AuthexServer) getLedger(c echo.Context) error {
+	requestID := reqID(c)
+	if !common.IsHexAddress(c.Param("address")) {
+		return c.JSON(http.StatusBadRequest, er(requestID, "invalid address"))
+	}
+	// the accounts are recorded with the checksum address
+	address := common.HexToAddress(c.Param("address")).Hex()
+	limit := defaultLedgerLimit
+	if v := c.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 {
+			log.Errorf("error parsing limit: %v, [incident: %s]", err, requestID)
+			return c.JSON(http.StatusBadRequest, er(requestID, "invalid limit"))
+		}
+		limit = l
+	}
+	entries, err := r.dbCli.GetLedger(address, c.QueryParam("asset"), limit)
+	if err != nil {
+		log.Errorf("error getting ledger: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusInternalServerError, er(requestID, "error getting ledger"))
+	}
+	return c.JSON(http.StatusOK, ok(requestID, withData("address", address), withData("entries", entries)))
+}
+
+// getDeposits returns the latest deposits of an account with their status
+func (r AuthexServer) getDeposits(c echo.Context) error {
+	requestID := reqID(c)
+	if !common.IsHexAddress(c.Param("address")) {
+		return c.JSON(http.StatusBadRequest, er(requestID, "invalid address"))
+	}
+	// the accounts are recorded with the checksum address
+	address := common.HexToAddress(c.Param("address")).Hex()
+	limit := defaultDepositLimit
+	if v := c.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l <= 0 {
+			log.Errorf("error parsing limit: %v, [incident: %s]", err, requestID)
+			return c.JSON(http.StatusBadRequest, er(requestID, "invalid limit"))
+		}
+		limit = l
+	}
+	deposits, err := r.dbCli.GetDeposits(address, limit)
+	if err != nil {
+		log.Errorf("error getting deposits: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusInternalServerError, er(requestID, "error getting deposits"))
+	}
+	return c.JSON(http.StatusOK, ok(requestID, withData("address", address), withData("deposits", deposits)))
+}
+
 // getMarketQuote returns the current quote for a given market
 func (r AuthexServer) getMarketQuote(c echo.Context) error {
 	requestID := reqID(c)
@@ -605,6 +982,37 @@ func (r AuthexServer) getMarketQuote(c echo.Context) error {
 	)
 }
 
+// getMarketDepth returns the aggregated price levels of a market,
+// the depth can be limited and grouped with the limit and grouping query params
+func (r AuthexServer) getMarketDepth(c echo.Context) error {
+	requestID := reqID(c)
+	market := c.Param("address")
+	limit := defaultDepthLimit
+	if v := c.QueryParam("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 0 {
+			log.Errorf("error parsing limit: %v, [incident: %s]", err, requestID)
+			return c.JSON(http.StatusBadRequest, er(requestID, "invalid limit"))
+		}
+		limit = l
+	}
+	grouping := decimal.Zero
+	if v := c.QueryParam("grouping"); v != "" {
+		g, err := decimal.NewFromString(v)
+		if err != nil || g.IsNegative() {
+			log.Errorf("error parsing grouping: %v, [incident: %s]", err, requestID)
+			return c.JSON(http.StatusBadRequest, er(requestID, "invalid grouping"))
+		}
+		grouping = g
+	}
+	depth, err := r.clobCli.GetDepth(market, limit, grouping)
+	if err != nil {
+		log.Errorf("error getting depth: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusNotFound, er(requestID, "market not found"))
+	}
+	return c.JSON(http.StatusOK, ok(requestID, withData("depth", depth)))
+}
+
 // getMarketPrice returns the current price for a given market
 func (r AuthexServer) getMarketPrice(c echo.Context) error {
 	requestID := reqID(c)
@@ -621,6 +1029,19 @@ func (r AuthexServer) getMarketPrice(c echo.Context) error {
 	return c.JSON(http.StatusOK, ok(requestID, withData("price", price)))
 }
 
+// getMarketTrades returns the trades of a market in sequence,
+// with the fees paid by the maker and the taker
+func (r AuthexServer) getMarketTrades(c echo.Context) error {
+	requestID := reqID(c)
+	market := c.Param("address")
+	trades, err := r.dbCli.GetTrades(market)
+	if err != nil {
+		log.Errorf("error getting trades: %v, [incident: %s]", err, requestID)
+		return c.JSON(http.StatusInternalServerError, er(requestID, "error getting trades"))
+	}
+	return c.JSON(http.StatusOK, ok(requestID, withData("market", market), withData("trades", trades)))
+}
+
 func index(c echo.Context, template *template.Template, runtime *Runtime, endpoints []Endpoint) error {
 	var bb bytes.Buffer
 	if err := template.Execute(&bb, struct {
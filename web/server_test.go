@@ -1,15 +1,23 @@
 package web
 
 import (
+	"authex/clob"
+	"authex/db"
+	h "authex/helpers"
 	"authex/model"
 	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
 	"encoding/json"
-	"fmt"
-	"github.com/stretchr/testify/assert"
-	"github.com/stretchr/testify/require"
-	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type payloadTest struct {
@@ -19,46 +27,362 @@ func (payloadTest) Serialize() ([]byte, error) {
 	return []byte{0}, nil
 }
 
+// testAccount is an account that signs its requests
+type testAccount struct {
+	key     *ecdsa.PrivateKey
+	address string
+}
+
+func newTestAccount(t *testing.T) testAccount {
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	return testAccount{key: key, address: crypto.PubkeyToAddress(key.PublicKey).Hex()}
+}
+
+// sign returns the signature of a payload as the client computes it
+func (a testAccount) sign(t *testing.T, payload model.Serializable) string {
+	msg, err := payload.Serialize()
+	require.NoError(t, err)
+	signature, err := crypto.Sign(crypto.Keccak256(msg), a.key)
+	require.NoError(t, err)
+	return hex.EncodeToString(signature)
+}
+
+// newTestServer returns a server backed by the in-memory storage, with a market
+// without rules and fees, the base and the quote asset of the market
+func newTestServer(t *testing.T) (AuthexServer, db.Storage, *model.MarketInfo) {
+	opts := &model.Settings{}
+	opts.CLOB.MarketSlippage = decimal.RequireFromString("0.05")
+	storage := db.NewMemory(opts)
+	go storage.Run()
+	pool := clob.NewPool(storage.Matches()).WithTrades(storage.Trades())
+	base, quote := model.NewOffChainAsset("USD"), model.NewOffChainAsset("EUR")
+	address, err := h.ComputeMarketAddress(base.Address, quote.Address)
+	require.NoError(t, err)
+	require.NoError(t, storage.SaveMarket(address, base, quote, model.MarketRules{}, model.MarketFees{}))
+	pool.OpenMarket(address)
+	go pool.Run()
+	t.Cleanup(pool.Close)
+
+	server, err := NewAuthexServer(opts, pool, nil, storage)
+	require.NoError(t, err)
+	market, err := storage.GetMarketByAddress(address)
+	require.NoError(t, err)
+	return server, storage, market
+}
+
+// call serves a request and returns the status code and the decoded response
+func call(t *testing.T, server AuthexServer, method, path string, body any) (int, map[string]any) {
+	var reqBody []byte
+	if body != nil {
+		var err error
+		reqBody, err = json.Marshal(body)
+		require.NoError(t, err)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	server.echo.ServeHTTP(rec, req)
+	rsp := make(map[string]any)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &rsp))
+	return rec.Code, rsp
+}
+
+// TestExtractAddress tests that the signatures of the clients that sent integer sizes are still valid
+func TestExtractAddress(t *testing.T) {
+	// an order and its signature made by such a client
+	var (
+		payload   = `{"submitted_at":"2023-06-23T17:02:29Z","recorded_at":"0001-01-01T00:00:00Z","market":"0x6f1b5a1e3c7d2b4a8e9f0c1d2e3f4a5b6c7d8e9f","size":10,"price":"2","side":"bid"}`
+		signature = "9015d52fbb374fdc1d01636b28034bc9557ebf5e710c4f8f3b39033589352d3a5abe14b676a5244649fc31a3a3ec48afdef42501278c377ca1c98f15198c2d4000"
+		signer    = "0x2c7536E3605D9C16a7a3D7b1898e529396a65c23"
+	)
+	order := model.Order{}
+	require.NoError(t, json.Unmarshal([]byte(payload), &order))
+	address, err := extractAddress(signature, order)
+	require.NoError(t, err)
+	assert.Equal(t, signer, address)
+}
+
 // TestPostOrder tests the postOrder endpoint
 func TestPostOrder(t *testing.T) {
+	alice, bob := newTestAccount(t), newTestAccount(t)
+
+	tests := []struct {
+		name       string
+		signer     testAccount
+		order      model.Order
+		badSig     bool
+		wantCode   int
+		wantMsg    string
+		wantStatus string
+		wantLocked decimal.Decimal
+	}{
+		{
+			name:       "limit bid",
+			signer:     alice,
+			order:      model.Order{Side: model.SideBid, Price: "2", Size: decimal.NewFromInt(10)},
+			wantCode:   http.StatusOK,
+			wantStatus: model.StatusOpen,
+			wantLocked: decimal.NewFromInt(20),
+		},
+		{
+			name:       "limit ask",
+			signer:     bob,
+			order:      model.Order{Side: model.SideAsk, Price: "3", Size: decimal.NewFromInt(5)},
+			wantCode:   http.StatusOK,
+			wantStatus: model.StatusOpen,
+			wantLocked: decimal.NewFromInt(5),
+		},
+		{
+			// the funds are reserved at the stop price plus the slippage
+			name:       "stop market bid",
+			signer:     alice,
+			order:      model.Order{Side: model.SideBid, StopPrice: "2", Size: decimal.NewFromInt(10)},
+			wantCode:   http.StatusOK,
+			wantStatus: model.StatusPending,
+			wantLocked: decimal.NewFromInt(21),
+		},
+		{
+			name:     "insufficient balance",
+			signer:   alice,
+			order:    model.Order{Side: model.SideBid, Price: "2", Size: decimal.NewFromInt(1000)},
+			wantCode: http.StatusBadRequest,
+			wantMsg:  "invalid order",
+		},
+		{
+			name:     "invalid signature",
+			signer:   alice,
+			order:    model.Order{Side: model.SideBid, Price: "2", Size: decimal.NewFromInt(1)},
+			badSig:   true,
+			wantCode: http.StatusUnauthorized,
+			wantMsg:  "error extracting account address",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, storage, market := newTestServer(t)
+			require.NoError(t, storage.UpdateBalance(alice.address, market.Base.Address, decimal.NewFromInt(100)))
+			require.NoError(t, storage.UpdateBalance(bob.address, market.Quote.Address, decimal.NewFromInt(100)))
 
-	// create a test order and sign it
-	order := &model.SignedRequest[model.Order]{}
-	order.From = "test From"
+			tt.order.Market = market.Address
+			tt.order.SubmittedAt = time.Now().UTC()
+			req := &model.SignedRequest[model.Order]{Payload: tt.order, Signature: tt.signer.sign(t, tt.order)}
+			if tt.badSig {
+				req.Signature = "00"
+			}
+			code, rsp := call(t, server, http.MethodPost, "/account/orders", req)
+			assert.Equal(t, tt.wantCode, code)
+			if tt.wantCode != http.StatusOK {
+				assert.Equal(t, valError, rsp["status"])
+				assert.Equal(t, tt.wantMsg, rsp["message"])
+				return
+			}
+			assert.Equal(t, valSuccess, rsp["status"])
+			assert.NotEmpty(t, rsp[keyRequestID])
+			orderID, _ := rsp[keyOrderID].(string)
+			require.NotEmpty(t, orderID)
 
-	// create a test request with the signed order
-	req := &model.SignedRequest[model.Order]{
-		From:      order.From,
-		Payload:   model.Order{},
-		Signature: order.Signature,
+			// the order rests in the book and holds its funds
+			code, rsp = call(t, server, http.MethodGet, "/query/orders/"+orderID, nil)
+			assert.Equal(t, http.StatusOK, code)
+			assert.Equal(t, tt.wantStatus, rsp["status"])
+			assert.Equal(t, tt.order.Size.String(), rsp["remaining"])
+			balances, err := storage.GetBalances(tt.signer.address)
+			require.NoError(t, err)
+			require.Len(t, balances, 1)
+			assert.True(t, tt.wantLocked.Equal(balances[0].Locked), "locked %s, want %s", balances[0].Locked, tt.wantLocked)
+		})
 	}
-	reqBody, err := json.Marshal(req)
-	require.NoError(t, err)
+}
+
+// TestGetOrder tests the state of the orders reported by the getOrder endpoint
+func TestGetOrder(t *testing.T) {
+	alice, bob := newTestAccount(t), newTestAccount(t)
+	server, storage, market := newTestServer(t)
+	require.NoError(t, storage.UpdateBalance(alice.address, market.Base.Address, decimal.NewFromInt(100)))
+	require.NoError(t, storage.UpdateBalance(bob.address, market.Quote.Address, decimal.NewFromInt(100)))
 
-	// create a test URL for the endpoint
-	url := fmt.Sprintf("%s/order", "server/test")
+	post := func(signer testAccount, order model.Order) string {
+		order.Market, order.SubmittedAt = market.Address, time.Now().UTC()
+		code, rsp := call(t, server, http.MethodPost, "/account/orders",
+			&model.SignedRequest[model.Order]{Payload: order, Signature: signer.sign(t, order)})
+		require.Equal(t, http.StatusOK, code, rsp["message"])
+		return rsp[keyOrderID].(string)
+	}
+	ask := post(bob, model.Order{Side: model.SideAsk, Price: "2", Size: decimal.NewFromInt(10)})
+	bid := post(alice, model.Order{Side: model.SideBid, Price: "2", Size: decimal.NewFromInt(4)})
 
-	// make a POST request to the endpoint
-	resp, err := http.Post(url, "application/json", bytes.NewReader(reqBody))
+	tests := []struct {
+		name          string
+		orderID       string
+		wantStatus    string
+		wantFilled    string
+		wantRemaining string
+		wantHistory   []string
+	}{
+		{"partially filled maker", ask, model.StatusPartial, "4", "6", []string{model.StatusOpen, model.StatusPartial}},
+		{"filled taker", bid, model.StatusFilled, "4", "0", []string{model.StatusOpen, model.StatusFilled}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rsp map[string]any
+			// the trades are settled asynchronously
+			require.Eventually(t, func() bool {
+				_, rsp = call(t, server, http.MethodGet, "/query/orders/"+tt.orderID, nil)
+				return rsp["status"] == tt.wantStatus
+			}, time.Second, 10*time.Millisecond, "status %v, want %s", rsp["status"], tt.wantStatus)
+			assert.Equal(t, tt.wantFilled, rsp["filled"])
+			assert.Equal(t, tt.wantRemaining, rsp["remaining"])
+			assert.Equal(t, "2", rsp["average_price"])
+			history, _ := rsp["history"].([]any)
+			statuses := make([]string, 0, len(history))
+			for _, c := range history {
+				statuses = append(statuses, c.(map[string]any)["status"].(string))
+			}
+			assert.Equal(t, tt.wantHistory, statuses)
+		})
+	}
+	code, _ := call(t, server, http.MethodGet, "/query/orders/unknown", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+	// the ledger matches the balances
+	differences, err := storage.CheckLedger()
 	require.NoError(t, err)
-	defer resp.Body.Close()
+	assert.Empty(t, differences)
+}
 
-	// check the status code
-	assert.Equal(t, http.StatusOK, resp.StatusCode)
+// TestGetDeposits tests that the transfers on chain are recorded once,
+// credited once confirmed and reversed if removed before
+func TestGetDeposits(t *testing.T) {
+	alice, bob := newTestAccount(t), newTestAccount(t)
+	server, storage, market := newTestServer(t)
 
-	// read the response body
-	respBody, err := ioutil.ReadAll(resp.Body)
-	require.NoError(t, err)
+	transfer := func(block uint64, txHash string, amount int64, removed bool) *model.BalanceChange {
+		return &model.BalanceChange{
+			BlockNumber:  block,
+			TokenAddress: market.Base.Address,
+			ChainID:      "65110000",
+			TxHash:       txHash,
+			Removed:      removed,
+			Deltas:       []*model.BalanceDelta{model.NewBalanceDelta(alice.address, decimal.NewFromInt(amount))},
+		}
+	}
+	// the transfers are settled in the order they are sent, the funding
+	// of bob marks the end of the transfers sent before
+	fundings := int64(0)
+	settle := func() {
+		fundings++
+		storage.Transfers() <- &model.BalanceChange{
+			TokenAddress: market.Base.Address,
+			Deltas:       []*model.BalanceDelta{model.NewBalanceDelta(bob.address, decimal.NewFromInt(1))},
+		}
+		require.Eventually(t, func() bool {
+			b, err := storage.GetBalance(bob.address, market.Base.Address)
+			return err == nil && b.Equal(decimal.NewFromInt(fundings))
+		}, time.Second, 10*time.Millisecond)
+	}
+	assertBalance := func(wantAvailable, wantPending int64) {
+		balances, err := storage.GetBalances(alice.address)
+		require.NoError(t, err)
+		require.Len(t, balances, 1)
+		assert.True(t, decimal.NewFromInt(wantAvailable).Equal(balances[0].Available), "available %s, want %d", balances[0].Available, wantAvailable)
+		assert.True(t, decimal.NewFromInt(wantPending).Equal(balances[0].Pending), "pending %s, want %d", balances[0].Pending, wantPending)
+	}
+	confirmedTx := "0x1f0b5c7a3a5ddc5bdcb2b1c3c4b0a6f8e1a9b2c3d4e5f60718293a4b5c6d7e8f"
+	removedTx := "0x2a1c6d8b4b6eed6cedc3c2d4d5c1b7f9f2bac3d4e5f6071829304a5b6c7d8e9f"
+
+	// the log of the first deposit is delivered twice
+	storage.Transfers() <- transfer(10, confirmedTx, 50, false)
+	storage.Transfers() <- transfer(10, confirmedTx, 50, false)
+	storage.Transfers() <- transfer(11, removedTx, 20, false)
+	settle()
+	assertBalance(0, 70)
+	// the pending amount can't be spent
+	order := model.Order{Market: market.Address, Side: model.SideBid, Price: "2", Size: decimal.NewFromInt(10), SubmittedAt: time.Now().UTC()}
+	code, _ := call(t, server, http.MethodPost, "/account/orders",
+		&model.SignedRequest[model.Order]{Payload: order, Signature: alice.sign(t, order)})
+	assert.Equal(t, http.StatusBadRequest, code)
 
-	// unmarshal the response into a map
-	respMap := make(map[string]interface{})
-	err = json.Unmarshal(respBody, &respMap)
+	// the second deposit is removed by a reorganization before the first is confirmed
+	storage.Transfers() <- transfer(11, removedTx, 20, true)
+	storage.Confirmations() <- &model.Confirmation{ChainID: "65110000", BlockNumber: 10}
+	settle()
+	assertBalance(50, 0)
+	// the token monitor recovers the transfers from the last block recorded
+	_, last, err := storage.GetAssetBlocks(market.Base.Address)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(11), last)
+	// the first block is recorded once
+	require.NoError(t, storage.SetAssetFirstBlock(market.Base.Address, 5))
+	require.NoError(t, storage.SetAssetFirstBlock(market.Base.Address, 8))
+	first, _, err := storage.GetAssetBlocks(market.Base.Address)
 	require.NoError(t, err)
+	assert.Equal(t, uint64(5), first)
+	differences, err := storage.CheckLedger()
+	require.NoError(t, err)
+	assert.Empty(t, differences)
+
+	tests := []struct {
+		name         string
+		address      string
+		query        string
+		wantCode     int
+		wantStatuses []string
+	}{
+		{"deposits recorded once", alice.address, "", http.StatusOK, []string{model.DepositReversed, model.DepositConfirmed}},
+		{"limit", alice.address, "?limit=1", http.StatusOK, []string{model.DepositReversed}},
+		{"funding is not a deposit", bob.address, "", http.StatusOK, []string{}},
+		{"invalid limit", alice.address, "?limit=0", http.StatusBadRequest, nil},
+		{"invalid address", "0x123", "", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, rsp := call(t, server, http.MethodGet, "/account/"+tt.address+"/deposits"+tt.query, nil)
+			assert.Equal(t, tt.wantCode, code)
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			deposits, _ := rsp["deposits"].([]any)
+			statuses := make([]string, 0, len(deposits))
+			for _, d := range deposits {
+				statuses = append(statuses, d.(map[string]any)["status"].(string))
+			}
+			assert.Equal(t, tt.wantStatuses, statuses)
+		})
+	}
+}
+
+// TestCancelAll tests that the cancel all requests sent again are rejected
+func TestCancelAll(t *testing.T) {
+	alice := newTestAccount(t)
 
-	// check the response fields
-	assert.Equal(t, "ok", respMap["status"])
-	assert.NotEmpty(t, respMap["incident"])
-	assert.NotEmpty(t, respMap["data"])
-	dataMap := respMap["data"].(map[string]interface{})
-	assert.Equal(t, order.Payload.ID, dataMap["order_id"])
+	tests := []struct {
+		name        string
+		submittedAt time.Time
+		wantCode    int
+		wantMsg     string
+	}{
+		{"fresh request", time.Now().UTC(), http.StatusOK, ""},
+		{"stale request", time.Now().UTC().Add(-3 * time.Second), http.StatusBadRequest, "cancel request is older than 2 seconds"},
+		{"no submission time", time.Time{}, http.StatusBadRequest, "cancel request is older than 2 seconds"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, storage, market := newTestServer(t)
+			require.NoError(t, storage.UpdateBalance(alice.address, market.Base.Address, decimal.NewFromInt(100)))
+			order := model.Order{Market: market.Address, Side: model.SideBid, Price: "2", Size: decimal.NewFromInt(10), SubmittedAt: time.Now().UTC()}
+			code, rsp := call(t, server, http.MethodPost, "/account/orders",
+				&model.SignedRequest[model.Order]{Payload: order, Signature: alice.sign(t, order)})
+			require.Equal(t, http.StatusOK, code, rsp["message"])
+
+			cancel := model.Order{Market: market.Address, SubmittedAt: tt.submittedAt}
+			code, rsp = call(t, server, http.MethodPost, "/account/orders/cancel-all",
+				&model.SignedRequest[model.Order]{Payload: cancel, Signature: alice.sign(t, cancel)})
+			assert.Equal(t, tt.wantCode, code)
+			if tt.wantCode != http.StatusOK {
+				assert.Equal(t, tt.wantMsg, rsp["message"])
+				return
+			}
+			assert.Len(t, rsp["cancelled"], 1)
+		})
+	}
 }